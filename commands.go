@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/akmanon/kpi-metricsd/internal/app"
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logmetrics"
+)
+
+// runValidate implements the validate subcommand and returns the exit code.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfgPath := fs.String("config", "config.yaml", "Path to yaml config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := app.LoadCfg(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: invalid config: %v\n", *cfgPath, err)
+		return 1
+	}
+	kpis := 0
+	for _, src := range cfg.LogSources {
+		kpis += len(src.KPIs)
+	}
+	fmt.Fprintf(stdout, "%s: config is valid, %d log sources, %d KPIs\n", *cfgPath, len(cfg.LogSources), kpis)
+	return 0
+}
+
+// runTestKPIs implements the test-kpis subcommand and returns the exit code.
+func runTestKPIs(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("test-kpis", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfgPath := fs.String("config", "config.yaml", "Path to yaml config file")
+	input := fs.String("input", "", "Path to a sample log file")
+	source := fs.String("source", "", "Only evaluate the KPIs of this log source")
+	lines := fs.Int("lines", 5, "Number of matching lines to print per KPI")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *input == "" {
+		fmt.Fprintln(stderr, "test-kpis: -input is required")
+		return 2
+	}
+
+	cfg, err := app.LoadCfg(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: invalid config: %v\n", *cfgPath, err)
+		return 1
+	}
+	var srcs []config.LogSource
+	for _, src := range cfg.LogSources {
+		if *source == "" || src.Name == *source {
+			srcs = append(srcs, src)
+		}
+	}
+	if len(srcs) == 0 {
+		fmt.Fprintf(stderr, "test-kpis: log source %q is not defined\n", *source)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tKPI\tMATCHES\tSERIES\tVALUE")
+	samples := make(map[string][]string)
+	var order []string
+	for _, src := range srcs {
+		results, err := logmetrics.EvaluateFile(src, *input, *lines)
+		if err != nil {
+			fmt.Fprintf(stderr, "log source %q: %v\n", src.Name, err)
+			return 1
+		}
+		for _, r := range results {
+			if len(r.Series) == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t\t\n", src.Name, r.Name, r.Matches)
+			}
+			for _, series := range slices.Sorted(maps.Keys(r.Series)) {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%g\n", src.Name, r.Name, r.Matches, series, r.Series[series])
+			}
+			if len(r.Lines) > 0 {
+				name := src.Name + "/" + r.Name
+				order = append(order, name)
+				samples[name] = r.Lines
+			}
+		}
+	}
+	tw.Flush()
+
+	for _, name := range order {
+		fmt.Fprintf(stdout, "\n%s:\n", name)
+		for _, line := range samples[name] {
+			fmt.Fprintf(stdout, "  %s\n", strings.ReplaceAll(line, "\n", "\n  "))
+		}
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, `Usage:
+  %[1]s -config config.yaml                         run the daemon
+  %[1]s -config config.yaml -input -|FIFO           run the daemon on stdin or a named pipe
+  %[1]s validate -config config.yaml                validate a config file
+  %[1]s test-kpis -config config.yaml -input FILE   evaluate the KPIs over a sample log
+`, os.Args[0])
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunValidate(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.yaml")
+	assert.NoError(t, os.WriteFile(invalid, []byte("server:\n  port: 0\n"), 0644))
+	dir := t.TempDir()
+	conflict := filepath.Join(dir, "conflict.yaml")
+	assert.NoError(t, os.WriteFile(conflict, []byte(`server:
+  port: 9099
+log_sources:
+  - name: app
+    source_log_file: `+filepath.Join(dir, "app.log")+`
+    redirect_log_file: `+filepath.Join(dir, "app_redirect.log")+`
+    rotated_log_file: `+filepath.Join(dir, "app_rotated.log")+`
+    rotation_interval: 1m
+    kpis:
+      - name: errors
+        regex: ERROR
+  - name: nginx
+    source_log_file: `+filepath.Join(dir, "nginx.log")+`
+    redirect_log_file: `+filepath.Join(dir, "nginx_redirect.log")+`
+    rotated_log_file: `+filepath.Join(dir, "nginx_rotated.log")+`
+    rotation_interval: 1m
+    kpis:
+      - name: errors
+        regex: '" (?P<status>5\d\d) '
+`), 0644))
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "valid config",
+			args:   []string{"-config", "internal/testdata/valid_config.yaml"},
+			code:   0,
+			stdout: "internal/testdata/valid_config.yaml: config is valid, 1 log sources, 3 KPIs\n",
+		},
+		{
+			name:   "invalid config",
+			args:   []string{"-config", invalid},
+			code:   1,
+			stderr: invalid + ": invalid config: config validation failed: no log sources defined in config\n",
+		},
+		{
+			name:   "KPIs sharing a name with different labels",
+			args:   []string{"-config", conflict},
+			code:   1,
+			stderr: conflict + ": invalid config: ",
+		},
+		{
+			name:   "missing config",
+			args:   []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			code:   1,
+			stderr: "invalid config",
+		},
+		{
+			name:   "unknown flag",
+			args:   []string{"-nope"},
+			code:   2,
+			stderr: "flag provided but not defined: -nope",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tc.code, runValidate(tc.args, &stdout, &stderr))
+			assert.Equal(t, tc.stdout, stdout.String())
+			if tc.stderr == "" {
+				assert.Empty(t, stderr.String())
+			} else {
+				assert.Contains(t, stderr.String(), tc.stderr)
+			}
+		})
+	}
+}
+
+func TestRunTestKPIs(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(cfgPath, []byte(`server:
+  port: 9099
+  metrics_path: /metrics
+log_sources:
+  - name: app
+    source_log_file: app.log
+    redirect_log_file: app_redirect.log
+    rotated_log_file: app_rotated.log
+    rotation_interval: 1m
+    kpis:
+      - name: errors
+        regex: ERROR
+      - name: requests
+        regex: 'status=(?P<status>\d+)'
+  - name: other
+    source_log_file: other.log
+    redirect_log_file: other_redirect.log
+    rotated_log_file: other_rotated.log
+    rotation_interval: 1m
+    kpis:
+      - name: warnings
+        regex: WARN
+`), 0644))
+	input := filepath.Join(dir, "sample.log")
+	assert.NoError(t, os.WriteFile(input, []byte("ERROR status=500\nINFO status=200\nINFO status=200\nWARN slow\n"), 0644))
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{
+			name: "counts per KPI",
+			args: []string{"-config", cfgPath, "-input", input, "-lines", "1"},
+			code: 0,
+			stdout: `SOURCE  KPI       MATCHES  SERIES          VALUE
+app     errors    1                        1
+app     requests  3        {status="200"}  2
+app     requests  3        {status="500"}  1
+other   warnings  1                        1
+
+app/errors:
+  ERROR status=500
+
+app/requests:
+  ERROR status=500
+
+other/warnings:
+  WARN slow
+`,
+		},
+		{
+			name: "one source",
+			args: []string{"-config", cfgPath, "-input", input, "-source", "other", "-lines", "0"},
+			code: 0,
+			stdout: `SOURCE  KPI       MATCHES  SERIES  VALUE
+other   warnings  1                1
+`,
+		},
+		{
+			name:   "unknown source",
+			args:   []string{"-config", cfgPath, "-input", input, "-source", "nope"},
+			code:   1,
+			stderr: "test-kpis: log source \"nope\" is not defined\n",
+		},
+		{
+			name:   "missing input flag",
+			args:   []string{"-config", cfgPath},
+			code:   2,
+			stderr: "test-kpis: -input is required\n",
+		},
+		{
+			name:   "missing input file",
+			args:   []string{"-config", cfgPath, "-input", filepath.Join(dir, "missing.log")},
+			code:   1,
+			stderr: "log source \"app\": failed to open input file",
+		},
+		{
+			name:   "invalid config",
+			args:   []string{"-config", filepath.Join(dir, "missing.yaml"), "-input", input},
+			code:   1,
+			stderr: "invalid config",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tc.code, runTestKPIs(tc.args, &stdout, &stderr))
+			assert.Equal(t, tc.stdout, stdout.String())
+			if tc.stderr == "" {
+				assert.Empty(t, stderr.String())
+			} else {
+				assert.Contains(t, stderr.String(), tc.stderr)
+			}
+		})
+	}
+}
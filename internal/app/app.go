@@ -2,108 +2,729 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/akmanon/kpi-metricsd/internal/archive"
+	"github.com/akmanon/kpi-metricsd/internal/checkpoint"
 	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/cron"
+	"github.com/akmanon/kpi-metricsd/internal/journal"
 	"github.com/akmanon/kpi-metricsd/internal/logmetrics"
 	"github.com/akmanon/kpi-metricsd/internal/logrotate"
 	"github.com/akmanon/kpi-metricsd/internal/logtail"
+	"github.com/akmanon/kpi-metricsd/internal/syslog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
 type App struct {
+	cfg       *config.Cfg
+	cfgPath   string
+	input     string
+	pipelines []*Pipeline
+	server    *http.Server
+	logger    *zap.Logger
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	errChan chan error
+	running bool
+	// endOfInput stops Run once the input of a source has ended.
+	endOfInput context.CancelFunc
+
+	// discoverCtx is the parent of the file discovery of every source split
+	// by file, which can be cancelled one source at a time on reload.
+	discoverCtx context.Context
+	discoveries map[string]context.CancelFunc
+
+	reloadMu sync.Mutex
+}
+
+// discoveryInterval is how often sources split by file are globbed for
+// files that appeared after startup.
+const discoveryInterval = 5 * time.Second
+
+// fileGracePeriod is how long the pipeline of a file of a source split by
+// file is kept after the file disappeared, in case it is recreated.
+const fileGracePeriod = 5 * time.Minute
+
+// checkpointInterval is how often tail offsets are written to the
+// checkpoint file of a source.
+const checkpointInterval = 5 * time.Second
+
+// streamBufferSize bounds the lines queued between the tailer and the KPI
+// matchers of a streaming source. A full buffer blocks the tailer.
+const streamBufferSize = 4096
+
+// Pipeline tails, rotates and evaluates the KPIs of a single log source.
+type Pipeline struct {
+	Name            string
+	File            string
 	LogRotate       *logrotate.LogRotate
 	TailAndRedirect *logtail.TailAndRedirect
 	LogMetrics      *logmetrics.LogMetrics
 	logger          *zap.Logger
+	// ownFiles are the files written for File only, removed with the
+	// pipeline once File is gone.
+	ownFiles []string
+
+	// stopped is set once the pipeline is stopped, so that its components
+	// returning is not reported as a failure.
+	stopped atomic.Bool
+	done    sync.WaitGroup
 }
 
-func New(cfg *config.Cfg, logger *zap.Logger) (*App, error) {
+// New creates the pipelines of every source of cfg. cfgPath is the file
+// cfg was loaded from and is read again on Reload.
+func New(cfg *config.Cfg, cfgPath string, logger *zap.Logger) (*App, error) {
+	var pipelines []*Pipeline
+	for _, src := range cfg.LogSources {
+		ps, err := newPipelines(cfg, src, logger)
+		if err != nil {
+			logger.Error("", zap.String("source", src.Name), zap.Error(err))
+			return nil, err
+		}
+		pipelines = append(pipelines, ps...)
+	}
 
-	srcFile := cfg.LogCfg.SourceLogFile
-	destFile := cfg.LogCfg.RedirectLogFile
-	destFileRotated := cfg.LogCfg.RotatedLogFile
-	rotateInt, _ := time.ParseDuration(cfg.LogCfg.RotationInterval)
+	app := &App{
+		cfg:         cfg,
+		cfgPath:     cfgPath,
+		pipelines:   pipelines,
+		logger:      logger,
+		errChan:     make(chan error, 1),
+		discoveries: make(map[string]context.CancelFunc),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Server.MetricsPath, promhttp.Handler())
+	mux.HandleFunc("POST /-/reload", app.handleReload)
+	app.server = &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.Server.Port),
+		Handler: mux,
+	}
+	return app, nil
+}
+
+// newPipelines creates the pipeline of src, or one pipeline per matching
+// file for a source split by file.
+func newPipelines(cfg *config.Cfg, src config.LogSource, logger *zap.Logger) ([]*Pipeline, error) {
+	srcs := []config.LogSource{src}
+	if src.FileLabel {
+		var err error
+		if srcs, err = matchFiles(src, nil); err != nil {
+			return nil, err
+		}
+	}
+	var pipelines []*Pipeline
+	for _, s := range srcs {
+		p, err := newPipeline(cfg, s, logger)
+		if err != nil {
+			for _, p := range pipelines {
+				p.LogMetrics.Stop()
+			}
+			return nil, err
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, nil
+}
 
-	logTail := logtail.NewTailAndRedirect(srcFile, destFile, logger)
-	logRotate := logrotate.NewLogRotate(destFile, destFileRotated, rotateInt, logger)
-	logMetrics, err := logmetrics.NewLogMetrics(cfg, destFileRotated, logger)
+// matchFiles returns src narrowed to every file matching its glob that is
+// not in seen.
+func matchFiles(src config.LogSource, seen map[string]bool) ([]config.LogSource, error) {
+	matches, err := filepath.Glob(src.SourceLogFile)
 	if err != nil {
-		logger.Error("", zap.Error(err))
 		return nil, err
 	}
-	return &App{
+	var srcs []config.LogSource
+	for _, path := range matches {
+		if !seen[path] {
+			srcs = append(srcs, src.ForFile(path))
+		}
+	}
+	return srcs, nil
+}
+
+func newPipeline(cfg *config.Cfg, src config.LogSource, logger *zap.Logger) (*Pipeline, error) {
+	logger = logger.With(zap.String("source", src.Name))
+	if file, ok := src.Labels[config.FileLabel]; ok {
+		logger = logger.With(zap.String("source_file", file))
+	}
+	rotateInt, _ := time.ParseDuration(src.RotationInterval)
+
+	logTail := logtail.NewTailAndRedirect(src.SourceLogFile, src.RedirectLogFile, logger)
+	if src.StartPosition == config.StartPositionBeginning {
+		logTail.ReadFromBeginning()
+	}
+	switch src.Input {
+	case config.InputSyslog:
+		logTail.ReadFrom(syslog.NewReceiver(src.Syslog, logger))
+	case config.InputStdin:
+		logTail.ReadFrom(logtail.NewStdinReader(logger))
+	case config.InputFIFO:
+		logTail.ReadFrom(logtail.NewFIFOReader(src.SourceLogFile, logger))
+	case config.InputJournal:
+		logTail.ReadFrom(journal.NewReader(src.Journal, src.StartPosition == config.StartPositionBeginning, logger))
+	}
+	if src.CheckpointFile != "" {
+		store, err := checkpoint.Open(src.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		logTail.UseCheckpoint(store, checkpointInterval)
+	}
+	logRotate := logrotate.NewLogRotate(src.RedirectLogFile, src.RotatedLogFile, rotateInt, logger)
+	if src.AlignToWallClock {
+		logRotate.UseSchedule(logrotate.AlignedSchedule(rotateInt, src.Location()))
+	}
+	if src.RotationSchedule != "" {
+		schedule, err := cron.Parse(src.RotationSchedule, src.Location())
+		if err != nil {
+			return nil, err
+		}
+		logRotate.UseSchedule(schedule)
+	}
+	if maxSize := src.MaxSize(); maxSize > 0 {
+		logRotate.RotateAtSize(maxSize)
+	}
+	logMetrics, err := logmetrics.NewLogMetrics(cfg, src, logger)
+	if err != nil {
+		return nil, err
+	}
+	if src.Archive.Enabled {
+		logMetrics.ArchiveWith(archive.New(src))
+	}
+	if src.Mode == config.ModeStream {
+		lines := make(chan []byte, streamBufferSize)
+		logTail.StreamTo(lines, src.KeepFiles)
+		logMetrics.Stream(lines)
+		if src.CheckpointFile != "" {
+			logTail.CheckpointPublished()
+			logMetrics.CommitTo(logTail)
+		}
+		if !src.KeepFiles {
+			logRotate.WindowOnly()
+		}
+	}
+	return &Pipeline{
+		Name:            src.Name,
+		File:            src.Labels[config.FileLabel],
 		LogRotate:       logRotate,
 		TailAndRedirect: logTail,
 		LogMetrics:      logMetrics,
 		logger:          logger,
+		ownFiles:        ownFiles(src),
 	}, nil
 }
 
-func (app *App) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
-	rotateChan := make(chan bool)
-	processMetricsNotifyCh := make(chan bool)
-	errChan := make(chan error, 3)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := app.LogRotate.Start(rotateChan, processMetricsNotifyCh); err != nil {
-			errChan <- fmt.Errorf("logRotate failed %w", err)
+// ownFiles returns the redirect, rotated and checkpoint files of a source
+// narrowed to one file by ForFile.
+func ownFiles(src config.LogSource) []string {
+	if _, ok := src.Labels[config.FileLabel]; !ok {
+		return nil
+	}
+	var files []string
+	for _, f := range []string{src.RedirectLogFile, src.RotatedLogFile, src.CheckpointFile} {
+		if f != "" {
+			files = append(files, f)
 		}
-	}()
+	}
+	return files
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := app.TailAndRedirect.Start(rotateChan); err != nil {
-			errChan <- fmt.Errorf("tailing failed %w", err)
+// SetInput makes the configs loaded on reload read from path, as
+// config.LoadCfgWithInput did for the config the app was created with.
+func (app *App) SetInput(path string) {
+	app.input = path
+}
+
+func (app *App) Run(ctx context.Context) error {
+	ctx, endOfInput := context.WithCancel(ctx)
+	defer endOfInput()
+	discoverCtx, stopDiscovery := context.WithCancel(ctx)
+	defer stopDiscovery()
+
+	app.mu.Lock()
+	app.running = true
+	app.endOfInput = endOfInput
+	app.discoverCtx = discoverCtx
+	for _, p := range app.pipelines {
+		p.start(&app.wg, app.reportErr, endOfInput)
+	}
+	for _, src := range app.cfg.LogSources {
+		if src.FileLabel {
+			app.startDiscovery(src.Name)
 		}
-	}()
+	}
+	app.mu.Unlock()
 
-	wg.Add(1)
+	app.wg.Add(1)
 	go func() {
-		defer wg.Done()
-		if err := app.LogMetrics.Start(processMetricsNotifyCh); err != nil {
-			errChan <- fmt.Errorf("metrics failed %w", err)
+		defer app.wg.Done()
+		if err := app.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.reportErr(fmt.Errorf("metrics server failed %w", err))
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
 		app.logger.Info("context cancelled, shutting down...")
-	case err := <-errChan:
+	case err := <-app.errChan:
 		app.logger.Error("application error", zap.Error(err))
 		return err
 	}
 
 	app.logger.Info("shutting down components")
+	stopDiscovery()
 	app.Stop()
 
+	app.wg.Wait()
+
+	return nil
+}
+
+// reportErr hands the first component error to Run. Errors reported while
+// shutting down are dropped.
+func (app *App) reportErr(err error) {
+	select {
+	case app.errChan <- err:
+	default:
+	}
+}
+
+// startDiscovery starts the file discovery of the named source. app.mu
+// must be held.
+func (app *App) startDiscovery(name string) {
+	ctx, cancel := context.WithCancel(app.discoverCtx)
+	app.discoveries[name] = cancel
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		app.discoverFiles(ctx, name)
+	}()
+}
+
+// discoverFiles starts a pipeline for every file matching the glob of a
+// source split by file that appears after startup, and removes the
+// pipelines of files gone for fileGracePeriod.
+func (app *App) discoverFiles(ctx context.Context, name string) {
+	seen := make(map[string]bool)
+	missingSince := make(map[string]time.Time)
+	app.mu.Lock()
+	for _, p := range app.pipelines {
+		if p.Name == name {
+			seen[p.File] = true
+		}
+	}
+	app.mu.Unlock()
+
+	ticker := time.NewTicker(discoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.mu.Lock()
+			cfg := app.cfg
+			app.mu.Unlock()
+			src, ok := sourceByName(cfg, name)
+			if !ok {
+				return
+			}
+			app.removeMissingFiles(name, seen, missingSince, fileGracePeriod)
+			srcs, err := matchFiles(src, seen)
+			if err != nil {
+				app.logger.Warn("file discovery failed", zap.String("source", name), zap.Error(err))
+				continue
+			}
+			for _, s := range srcs {
+				seen[s.SourceLogFile] = true
+				p, err := newPipeline(cfg, s, app.logger)
+				if err == nil {
+					err = registerPipelines([]*Pipeline{p})
+				}
+				if err != nil {
+					app.logger.Error("failed to create pipeline", zap.String("source", name), zap.Error(err))
+					continue
+				}
+				p.TailAndRedirect.ReadFromBeginning()
+				app.logger.Info("new source file discovered", zap.String("source", p.Name), zap.String("file", p.File))
+				app.addPipeline(p)
+			}
+		}
+	}
+}
+
+// removeMissingFiles removes the pipelines of the files in seen that have
+// been missing for grace, along with the files written for them, so that
+// sources whose files churn, such as the logs of pods, do not grow without
+// bound. missingSince records when each file was first found missing.
+func (app *App) removeMissingFiles(name string, seen map[string]bool, missingSince map[string]time.Time, grace time.Duration) {
+	now := time.Now()
+	gone := make(map[string]bool)
+	for path := range seen {
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			delete(missingSince, path)
+			continue
+		}
+		since, ok := missingSince[path]
+		if !ok {
+			missingSince[path] = now
+			continue
+		}
+		if now.Sub(since) >= grace {
+			gone[path] = true
+			delete(seen, path)
+			delete(missingSince, path)
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+	removed := app.removePipelines(func(p *Pipeline) bool {
+		return p.Name == name && gone[p.File]
+	})
+	for _, p := range removed {
+		app.logger.Info("source file gone, removing its pipeline", zap.String("source", p.Name), zap.String("file", p.File))
+		for _, f := range p.ownFiles {
+			if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				app.logger.Warn("failed to remove file", zap.String("file", f), zap.Error(err))
+			}
+		}
+	}
+}
+
+func sourceByName(cfg *config.Cfg, name string) (config.LogSource, bool) {
+	for _, src := range cfg.LogSources {
+		if src.Name == name {
+			return src, true
+		}
+	}
+	return config.LogSource{}, false
+}
+
+func (app *App) addPipeline(p *Pipeline) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if !app.running {
+		return
+	}
+	app.pipelines = append(app.pipelines, p)
+	p.start(&app.wg, app.reportErr, app.endOfInput)
+}
+
+// Reload reads the config file again and applies it without restarting
+// the sources it leaves unchanged. Sources whose KPIs changed only update
+// their collectors, sources whose log config changed are restarted. An
+// invalid config is logged and the running one is kept. A source that
+// cannot be restarted keeps running with its previous config, and one that
+// cannot be added is left out, so that the next reload tries it again.
+func (app *App) Reload() error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	cfg, err := loadCfg(app.cfgPath, app.input)
+	if err != nil {
+		app.logger.Error("config reload failed, keeping the running config", zap.Error(err))
+		return err
+	}
+
+	app.mu.Lock()
+	running := app.running
+	prev := app.cfg
+	app.mu.Unlock()
+	if !running {
+		return errors.New("application is not running")
+	}
+	if cfg.Server != prev.Server {
+		app.logger.Warn("server configuration changes are only applied on restart")
+		cfg.Server = prev.Server
+	}
+
+	var errs []error
+	applied := *cfg
+	applied.LogSources = nil
+	for _, src := range prev.LogSources {
+		if _, ok := sourceByName(cfg, src.Name); !ok {
+			app.logger.Info("removing log source", zap.String("source", src.Name))
+			app.removeSource(src.Name)
+		}
+	}
+	for _, src := range cfg.LogSources {
+		old, ok := sourceByName(prev, src.Name)
+		switch {
+		case !ok:
+			app.logger.Info("adding log source", zap.String("source", src.Name))
+			if err := app.addSource(cfg, src); err != nil {
+				errs = append(errs, fmt.Errorf("log source %q: %w", src.Name, err))
+				continue
+			}
+		case old.LogCfg != src.LogCfg:
+			app.logger.Info("restarting log source", zap.String("source", src.Name))
+			app.removeSource(src.Name)
+			err = app.addSource(cfg, src)
+			if err != nil {
+				// Bring the source back as it ran before, so that it keeps
+				// running and a later reload restarts it again.
+				if rerr := app.addSource(prev, old); rerr != nil {
+					errs = append(errs, fmt.Errorf("log source %q: %w, and restoring it failed: %w", src.Name, err, rerr))
+					err = nil
+					continue
+				}
+				src = old
+			}
+		case !reflect.DeepEqual(old.KPIs, src.KPIs):
+			app.logger.Info("updating KPIs of log source", zap.String("source", src.Name))
+			err = app.updateKPIs(src)
+			if err != nil {
+				src = old
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("log source %q: %w", src.Name, err))
+			err = nil
+		}
+		applied.LogSources = append(applied.LogSources, src)
+	}
+
+	app.mu.Lock()
+	app.cfg = &applied
+	app.mu.Unlock()
+	if err := errors.Join(errs...); err != nil {
+		app.logger.Error("config reload partially failed", zap.Error(err))
+		return err
+	}
+	app.logger.Info("config reloaded")
+	return nil
+}
+
+// LoadCfg loads and validates the config file, including the KPI regexes,
+// their capture groups and the metrics the sources register together.
+func LoadCfg(cfgPath string) (*config.Cfg, error) {
+	return loadCfg(cfgPath, "")
+}
+
+func loadCfg(cfgPath, input string) (*config.Cfg, error) {
+	cfg, err := config.LoadCfgWithInput(cfgPath, input)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range cfg.LogSources {
+		if err := logmetrics.ValidateKPIs(src.KPIs); err != nil {
+			return nil, fmt.Errorf("log source %q: %w", src.Name, err)
+		}
+	}
+	if err := logmetrics.ValidateSources(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (app *App) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := app.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// addSource starts the pipelines of src. Their collectors are registered
+// first, so that a conflict with the metrics of the running sources is
+// returned rather than reported to Run, which would stop the app.
+func (app *App) addSource(cfg *config.Cfg, src config.LogSource) error {
+	pipelines, err := newPipelines(cfg, src, app.logger)
+	if err != nil {
+		return err
+	}
+	if err := registerPipelines(pipelines); err != nil {
+		return err
+	}
+	for _, p := range pipelines {
+		app.addPipeline(p)
+	}
+	if src.FileLabel {
+		app.mu.Lock()
+		if app.running {
+			app.startDiscovery(src.Name)
+		}
+		app.mu.Unlock()
+	}
+	return nil
+}
+
+// registerPipelines registers the collectors of pipelines that have not
+// started yet. On error none of them is left registered and their metrics
+// are stopped.
+func registerPipelines(pipelines []*Pipeline) error {
+	for i, p := range pipelines {
+		if err := p.LogMetrics.Register(); err != nil {
+			for _, p := range pipelines[:i] {
+				p.LogMetrics.Unregister()
+			}
+			for _, p := range pipelines {
+				p.LogMetrics.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSource stops every pipeline of the named source and waits for them
+// to return, so that their collectors and files can be reused.
+func (app *App) removeSource(name string) {
+	app.mu.Lock()
+	if cancel, ok := app.discoveries[name]; ok {
+		cancel()
+		delete(app.discoveries, name)
+	}
+	app.mu.Unlock()
+	app.removePipelines(func(p *Pipeline) bool { return p.Name == name })
+}
+
+// removePipelines stops the pipelines remove returns true for, waits for
+// them to return and unregisters their collectors. It returns the removed
+// pipelines.
+func (app *App) removePipelines(remove func(*Pipeline) bool) []*Pipeline {
+	var removed, kept []*Pipeline
+	app.mu.Lock()
+	for _, p := range app.pipelines {
+		if remove(p) {
+			removed = append(removed, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	app.pipelines = kept
+	app.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range removed {
+		p.stop(&wg)
+	}
 	wg.Wait()
+	for _, p := range removed {
+		p.done.Wait()
+		p.LogMetrics.Unregister()
+	}
+	return removed
+}
 
+func (app *App) updateKPIs(src config.LogSource) error {
+	app.mu.Lock()
+	var pipelines []*Pipeline
+	for _, p := range app.pipelines {
+		if p.Name == src.Name {
+			pipelines = append(pipelines, p)
+		}
+	}
+	app.mu.Unlock()
+	for _, p := range pipelines {
+		if err := p.LogMetrics.UpdateKPIs(src.KPIs); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// start runs the components of the pipeline. endOfInput is called when the
+// input of the source has ended and its last window has been published,
+// which stops the app.
+func (p *Pipeline) start(wg *sync.WaitGroup, reportErr func(error), endOfInput func()) {
+	rotateChan := make(chan bool)
+	processMetricsNotifyCh := make(chan logrotate.Window)
+	metricsDone := make(chan struct{})
+	report := func(err error) {
+		if !p.stopped.Load() {
+			reportErr(err)
+		}
+	}
+
+	p.done.Add(3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.done.Wait()
+	}()
+
+	go func() {
+		defer p.done.Done()
+		if err := p.LogRotate.Start(rotateChan, processMetricsNotifyCh); err != nil {
+			report(fmt.Errorf("%s: logRotate failed %w", p.Name, err))
+		}
+	}()
+
+	go func() {
+		defer p.done.Done()
+		err := p.TailAndRedirect.Start(rotateChan)
+		switch {
+		case errors.Is(err, logtail.ErrEndOfInput):
+			p.logger.Info("end of input, publishing the last window")
+			p.LogRotate.Finish()
+			<-metricsDone
+			p.logger.Info("end of input, shutting down")
+			endOfInput()
+		case err != nil:
+			report(fmt.Errorf("%s: tailing failed %w", p.Name, err))
+		}
+	}()
+
+	go func() {
+		defer p.done.Done()
+		defer close(metricsDone)
+		if err := p.LogMetrics.Start(processMetricsNotifyCh); err != nil {
+			report(fmt.Errorf("%s: metrics failed %w", p.Name, err))
+		}
+	}()
+}
+
 func (app *App) Stop() {
 	var wg sync.WaitGroup
+	app.mu.Lock()
+	app.running = false
+	pipelines := app.pipelines
+	app.mu.Unlock()
+	for _, p := range pipelines {
+		p.stop(&wg)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := app.server.Shutdown(ctx); err != nil {
+			app.logger.Warn("metrics server shutdown failed", zap.Error(err))
+		}
+	}()
+	wg.Wait()
+}
+
+func (p *Pipeline) stop(wg *sync.WaitGroup) {
+	p.stopped.Store(true)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		app.LogRotate.Stop()
+		p.LogRotate.Stop()
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		app.TailAndRedirect.Stop()
+		p.TailAndRedirect.Stop()
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		app.LogMetrics.Stop()
+		p.LogMetrics.Stop()
 	}()
-	wg.Wait()
 }
@@ -0,0 +1,369 @@
+package app
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logmetrics"
+	"github.com/akmanon/kpi-metricsd/internal/logrotate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// loadTestCfg writes a config of one log source, with the given log config
+// lines, into dir and loads it. The metrics server gets a free port.
+func loadTestCfg(t *testing.T, dir, logCfg string) (*config.Cfg, string) {
+	path := filepath.Join(dir, "config.yaml")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	content := "server:\n  port: " + strconv.Itoa(port) + "\n  metrics_path: /metrics\n" +
+		"log_sources:\n  - name: app\n" + logCfg +
+		"    kpis:\n      - name: errors\n        regex: ERROR\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	cfg, err := LoadCfg(path)
+	assert.NoError(t, err)
+	return cfg, path
+}
+
+func TestRemoveMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	assert.NoError(t, os.WriteFile(a, nil, 0644))
+	assert.NoError(t, os.WriteFile(b, nil, 0644))
+	cfg, cfgPath := loadTestCfg(t, dir, "    source_log_file: "+filepath.Join(dir, "*.log")+"\n"+
+		"    redirect_log_file: "+filepath.Join(dir, "out", "redirect.log")+"\n"+
+		"    rotated_log_file: "+filepath.Join(dir, "out", "rotated.log")+"\n"+
+		"    rotation_interval: 1m\n"+
+		"    file_label: true\n")
+	app, err := New(cfg, cfgPath, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Len(t, app.pipelines, 2)
+	removedFile := app.pipelines[0].ownFiles[0]
+	assert.NoError(t, os.MkdirAll(filepath.Dir(removedFile), 0755))
+	assert.NoError(t, os.WriteFile(removedFile, []byte("ERROR\n"), 0644))
+
+	seen := map[string]bool{a: true, b: true}
+	missingSince := make(map[string]time.Time)
+	assert.NoError(t, os.Remove(a))
+	app.removeMissingFiles("app", seen, missingSince, time.Hour)
+	assert.Len(t, app.pipelines, 2, "a missing file is kept for the grace period")
+	assert.Contains(t, missingSince, a)
+
+	app.removeMissingFiles("app", seen, missingSince, 0)
+	assert.Len(t, app.pipelines, 1)
+	assert.Equal(t, b, app.pipelines[0].File)
+	assert.Equal(t, map[string]bool{b: true}, seen, "a file created again is discovered again")
+	assert.Empty(t, missingSince)
+	assert.NoFileExists(t, removedFile)
+}
+
+// TestRunEndOfStdin replaces stdin, which is only read once per process,
+// and so does not pass with -count above 1.
+func TestRunEndOfStdin(t *testing.T) {
+	dir := t.TempDir()
+	cfg, cfgPath := loadTestCfg(t, dir, "    input: stdin\n"+
+		"    redirect_log_file: "+filepath.Join(dir, "redirect.log")+"\n"+
+		"    rotated_log_file: "+filepath.Join(dir, "rotated.log")+"\n"+
+		"    rotation_interval: 1h\n")
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	app, err := New(cfg, cfgPath, zap.NewNop())
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		done <- app.Run(context.Background())
+	}()
+	_, err = w.WriteString("ERROR one\nINFO two\nERROR three\n")
+	assert.NoError(t, err)
+	w.Close()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("app did not stop at the end of stdin")
+	}
+
+	// The window was cut short by the end of stdin and still published.
+	values := make(map[string]float64)
+	reasons := make(map[string]string)
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels[config.SourceLabel] != "app" {
+				continue
+			}
+			values[f.GetName()] = m.GetGauge().GetValue()
+			reasons[f.GetName()] = labels["reason"]
+		}
+	}
+	assert.Equal(t, float64(2), values["errors"])
+	assert.Equal(t, logrotate.ReasonEndOfInput, reasons[logmetrics.WindowInfoMetric])
+	assert.Less(t, values[logmetrics.WindowEndMetric]-values[logmetrics.WindowStartMetric], float64(60))
+}
+
+// sourceMetrics returns the names of the registered metric families with a
+// series of the named source.
+func sourceMetrics(t *testing.T, source string) map[string]bool {
+	names := make(map[string]bool)
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == config.SourceLabel && l.GetValue() == source {
+					names[f.GetName()] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfgPath := filepath.Join(dir, "config.yaml")
+	source := func(name, interval string, kpis ...string) string {
+		s := "  - name: " + name + "\n" +
+			"    source_log_file: " + filepath.Join(dir, name+".log") + "\n" +
+			"    redirect_log_file: " + filepath.Join(dir, "out", name+"_redirect.log") + "\n" +
+			"    rotated_log_file: " + filepath.Join(dir, "out", name+"_rotated.log") + "\n" +
+			"    rotation_interval: " + interval + "\n" +
+			"    kpis:\n"
+		for _, kpi := range kpis {
+			s += "      - name: " + kpi + "\n        regex: " + kpi + "\n"
+		}
+		return s
+	}
+	writeCfg := func(sources ...string) {
+		content := "server:\n  port: " + strconv.Itoa(port) + "\n  metrics_path: /metrics\nlog_sources:\n"
+		for _, s := range sources {
+			content += s
+		}
+		assert.NoError(t, os.WriteFile(cfgPath, []byte(content), 0644))
+	}
+	pipelineOf := func(app *App, name string) *Pipeline {
+		app.mu.Lock()
+		defer app.mu.Unlock()
+		for _, p := range app.pipelines {
+			if p.Name == name {
+				return p
+			}
+		}
+		return nil
+	}
+	waitForMetric := func(source, metric string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !sourceMetrics(t, source)[metric] {
+			if time.Now().After(deadline) {
+				t.Fatalf("metric %s of source %s was not registered", metric, source)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	writeCfg(source("reload_kpis", "1h", "reload_errors"),
+		source("reload_changed", "1h", "reload_errors"),
+		source("reload_removed", "1h", "reload_errors"))
+	cfg, err := LoadCfg(cfgPath)
+	assert.NoError(t, err)
+	app, err := New(cfg, cfgPath, zap.NewNop())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+		for _, p := range app.pipelines {
+			p.LogMetrics.Unregister()
+		}
+	}()
+	for _, name := range []string{"reload_kpis", "reload_changed", "reload_removed"} {
+		waitForMetric(name, "reload_errors")
+	}
+	kpisPipeline := pipelineOf(app, "reload_kpis")
+	changedPipeline := pipelineOf(app, "reload_changed")
+
+	writeCfg(source("reload_kpis", "1h", "reload_errors", "reload_warnings"),
+		source("reload_changed", "2h", "reload_errors"),
+		source("reload_added", "1h", "reload_errors"))
+	assert.NoError(t, app.Reload())
+
+	// A KPI-only change keeps the pipeline and the collectors of its
+	// unchanged KPIs.
+	assert.Same(t, kpisPipeline, pipelineOf(app, "reload_kpis"))
+	waitForMetric("reload_kpis", "reload_warnings")
+	assert.True(t, sourceMetrics(t, "reload_kpis")["reload_errors"])
+
+	// A changed source is restarted with its new log config.
+	p := pipelineOf(app, "reload_changed")
+	assert.NotNil(t, p)
+	assert.NotSame(t, changedPipeline, p)
+	waitForMetric("reload_changed", "reload_errors")
+
+	// An added source is started and a removed one is unregistered.
+	waitForMetric("reload_added", "reload_errors")
+	assert.Nil(t, pipelineOf(app, "reload_removed"))
+	assert.Empty(t, sourceMetrics(t, "reload_removed"))
+
+	// An invalid config is rejected and the running pipelines are kept.
+	app.mu.Lock()
+	pipelines := append([]*Pipeline(nil), app.pipelines...)
+	running := app.cfg
+	app.mu.Unlock()
+	assert.NoError(t, os.WriteFile(cfgPath, []byte("log_sources: [\n"), 0644))
+	assert.Error(t, app.Reload())
+	app.mu.Lock()
+	assert.Equal(t, pipelines, app.pipelines)
+	assert.Same(t, running, app.cfg)
+	app.mu.Unlock()
+	for _, name := range []string{"reload_kpis", "reload_changed", "reload_added"} {
+		assert.True(t, sourceMetrics(t, name)["reload_errors"])
+	}
+
+	// A valid config whose collectors conflict with those still running
+	// when a source is added or restarted fails the reload without
+	// stopping the app. The added source is left out, so that the next
+	// reload adds it again, and the restarted one runs with its previous
+	// config.
+	tiered := func(s string) string {
+		return strings.ReplaceAll(s, "regex: reload_errors\n", "regex: reload_errors\n        custom_labels:\n          tier: edge\n")
+	}
+	writeCfg(tiered(source("reload_conflict", "1h", "reload_errors")),
+		tiered(source("reload_changed", "3h", "reload_errors")),
+		tiered(source("reload_kpis", "1h", "reload_errors", "reload_warnings")),
+		tiered(source("reload_added", "1h", "reload_errors")))
+	err = app.Reload()
+	assert.ErrorContains(t, err, `log source "reload_conflict"`)
+	assert.ErrorContains(t, err, `log source "reload_changed"`)
+	select {
+	case err := <-done:
+		done <- err // for the deferred check
+		t.Fatalf("app stopped on a failed reload: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Nil(t, pipelineOf(app, "reload_conflict"))
+	assert.Empty(t, sourceMetrics(t, "reload_conflict"))
+	restored := pipelineOf(app, "reload_changed")
+	assert.NotNil(t, restored)
+	assert.NotSame(t, p, restored)
+	waitForMetric("reload_changed", "reload_errors")
+	app.mu.Lock()
+	_, ok := sourceByName(app.cfg, "reload_conflict")
+	assert.False(t, ok)
+	src, ok := sourceByName(app.cfg, "reload_changed")
+	assert.True(t, ok)
+	assert.Equal(t, "2h", src.RotationInterval)
+	app.mu.Unlock()
+}
+
+// TestRestartStreamMidWindow stops a streaming source before its window is
+// published and checks that the lines it had read are counted after the
+// restart.
+func TestRestartStreamMidWindow(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "stream.log")
+	redirectFile := filepath.Join(dir, "out", "redirect.log")
+	assert.NoError(t, os.WriteFile(srcFile, nil, 0644))
+	run := func(interval string) (*App, context.CancelFunc, chan error) {
+		cfg, cfgPath := loadTestCfg(t, dir, "    source_log_file: "+srcFile+"\n"+
+			"    redirect_log_file: "+redirectFile+"\n"+
+			"    rotated_log_file: "+filepath.Join(dir, "out", "rotated.log")+"\n"+
+			"    checkpoint_file: "+filepath.Join(dir, "checkpoint.json")+"\n"+
+			"    rotation_interval: 1h\n"+
+			"    mode: stream\n"+
+			"    keep_files: true\n")
+		// Windows shorter than the config allows end the restarted one soon.
+		cfg.LogSources[0].Name = "stream_restart"
+		cfg.LogSources[0].RotationInterval = interval
+		app, err := New(cfg, cfgPath, zap.NewNop())
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- app.Run(ctx)
+		}()
+		return app, cancel, done
+	}
+	stop := func(app *App, cancel context.CancelFunc, done chan error) {
+		cancel()
+		assert.NoError(t, <-done)
+		for _, p := range app.pipelines {
+			p.LogMetrics.Unregister()
+		}
+	}
+
+	app, cancel, done := run("1h")
+	time.Sleep(300 * time.Millisecond)
+	f, err := os.OpenFile(srcFile, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString("ERROR one\nINFO two\nERROR three\n")
+	assert.NoError(t, err)
+	f.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(redirectFile)
+		if strings.Contains(string(b), "ERROR three\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lines were not read")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stop(app, cancel, done)
+
+	app, cancel, done = run("1s")
+	defer stop(app, cancel, done)
+	errorCount := func() float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() != "errors" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == config.SourceLabel && l.GetValue() == "stream_restart" {
+						return m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for errorCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("errors = %v after the restart, want 2", errorCount())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+// Package archive keeps timestamped, optionally compressed copies of rotated
+// log files and removes old copies according to a retention policy.
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/units"
+	"github.com/klauspost/compress/zstd"
+)
+
+// timeFormat names archives so that they sort in the order they were made.
+const timeFormat = "20060102T150405.000Z"
+
+// Archiver copies a rotated file to dir as <name>-<time><ext>, with a
+// .gz or .zst suffix when compressed.
+type Archiver struct {
+	dir         string
+	prefix      string
+	ext         string
+	compression string
+
+	maxAge       time.Duration
+	maxFiles     int
+	maxTotalSize int64
+}
+
+// File is an archived copy of a rotated file.
+type File struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// New returns an Archiver for the rotated files of src.
+func New(src config.LogSource) *Archiver {
+	base := filepath.Base(src.RotatedLogFile)
+	ext := filepath.Ext(base)
+	a := &Archiver{
+		dir:         src.ArchiveDir(),
+		prefix:      strings.TrimSuffix(base, ext) + "-",
+		ext:         ext,
+		compression: src.Archive.Compression,
+		maxFiles:    src.Archive.MaxFiles,
+	}
+	a.maxAge, _ = time.ParseDuration(src.Archive.MaxAge)
+	a.maxTotalSize, _ = units.ParseBytes(src.Archive.MaxTotalSize)
+	return a
+}
+
+// Archive copies the file at path into the archive, named after t, and then
+// applies the retention policy. It returns the path of the new archive.
+func (a *Archiver) Archive(path string, t time.Time) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return a.ArchiveFile(src, t)
+}
+
+// ArchiveFile is Archive for a file already open, which can then be
+// replaced at its path while it is archived.
+func (a *Archiver) ArchiveFile(src *os.File, t time.Time) (string, error) {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := a.prefix + t.UTC().Format(timeFormat) + a.ext
+	switch a.compression {
+	case config.CompressionGzip:
+		name += ".gz"
+	case config.CompressionZstd:
+		name += ".zst"
+	}
+	dst := filepath.Join(a.dir, name)
+
+	// Write to a temporary file first so that a partial archive is never
+	// taken for a complete one.
+	tmp, err := os.CreateTemp(a.dir, "."+name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := a.copy(tmp, src); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to archive %s %w", src.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+
+	if _, err := a.Prune(time.Now()); err != nil {
+		return dst, fmt.Errorf("failed to apply archive retention %w", err)
+	}
+	return dst, nil
+}
+
+func (a *Archiver) copy(dst io.Writer, src io.Reader) error {
+	var w io.WriteCloser
+	switch a.compression {
+	case config.CompressionGzip:
+		w = gzip.NewWriter(dst)
+	case config.CompressionZstd:
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		w = zw
+	default:
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Files returns the archives of the rotated file, oldest first.
+func (a *Archiver) Files() ([]File, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []File
+	for _, e := range entries {
+		if e.IsDir() || !a.owns(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, File{
+			Path:    filepath.Join(a.dir, e.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// owns reports whether name is an archive of the rotated file.
+func (a *Archiver) owns(name string) bool {
+	rest, ok := strings.CutPrefix(name, a.prefix)
+	if !ok || len(rest) < len(timeFormat) {
+		return false
+	}
+	if _, err := time.Parse(timeFormat, rest[:len(timeFormat)]); err != nil {
+		return false
+	}
+	switch rest[len(timeFormat):] {
+	case a.ext, a.ext + ".gz", a.ext + ".zst":
+		return true
+	}
+	return false
+}
+
+// Prune removes archives older than max_age, then the oldest ones beyond
+// max_files and max_total_size. The newest archive is always kept. It
+// returns the removed archives.
+func (a *Archiver) Prune(now time.Time) ([]string, error) {
+	files, err := a.Files()
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+
+	var removed []string
+	for len(files) > 1 {
+		oldest := files[0]
+		expired := a.maxAge > 0 && now.Sub(oldest.ModTime) > a.maxAge
+		tooMany := a.maxFiles > 0 && len(files) > a.maxFiles
+		tooLarge := a.maxTotalSize > 0 && total > a.maxTotalSize
+		if !expired && !tooMany && !tooLarge {
+			break
+		}
+		if err := os.Remove(oldest.Path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, oldest.Path)
+		total -= oldest.Size
+		files = files[1:]
+	}
+	return removed, nil
+}
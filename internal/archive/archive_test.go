@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSource(dir string, archive config.Archive) config.LogSource {
+	archive.Enabled = true
+	return config.LogSource{
+		Name: "app",
+		LogCfg: config.LogCfg{
+			RotatedLogFile: filepath.Join(dir, "app_rotated.log"),
+			Archive:        archive,
+		},
+	}
+}
+
+func TestArchive(t *testing.T) {
+	at := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		compression string
+		name        string
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{"", "app_rotated-20261016T123000.000Z.log", func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{config.CompressionGzip, "app_rotated-20261016T123000.000Z.log.gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{config.CompressionZstd, "app_rotated-20261016T123000.000Z.log.zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	} {
+		t.Run("compression "+tt.compression, func(t *testing.T) {
+			dir := t.TempDir()
+			src := newSource(dir, config.Archive{Compression: tt.compression, Dir: filepath.Join(dir, "archive")})
+			assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte("ERROR one\nERROR two\n"), 0644))
+
+			path, err := New(src).Archive(src.RotatedLogFile, at)
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(dir, "archive", tt.name), path)
+
+			f, err := os.Open(path)
+			assert.NoError(t, err)
+			defer f.Close()
+			r, err := tt.decompress(f)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "ERROR one\nERROR two\n", string(content))
+
+			rotated, _ := os.ReadFile(src.RotatedLogFile)
+			assert.Equal(t, "ERROR one\nERROR two\n", string(rotated), "rotated file should be left in place")
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	setup := func(t *testing.T, archive config.Archive) *Archiver {
+		dir := t.TempDir()
+		a := New(newSource(dir, archive))
+		for i := 5; i > 0; i-- {
+			at := now.Add(-time.Duration(i) * time.Hour)
+			path := filepath.Join(dir, a.prefix+at.Format(timeFormat)+a.ext)
+			assert.NoError(t, os.WriteFile(path, make([]byte, 100), 0644))
+			assert.NoError(t, os.Chtimes(path, at, at))
+		}
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "app_rotated.log"), nil, 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "other-20261016T100000.000Z.log"), nil, 0644))
+		return a
+	}
+	remaining := func(t *testing.T, a *Archiver) int {
+		files, err := a.Files()
+		assert.NoError(t, err)
+		return len(files)
+	}
+
+	t.Run("max age", func(t *testing.T) {
+		a := setup(t, config.Archive{MaxAge: "150m"})
+		removed, err := a.Prune(now)
+		assert.NoError(t, err)
+		assert.Len(t, removed, 3)
+		assert.Equal(t, 2, remaining(t, a))
+	})
+
+	t.Run("max files", func(t *testing.T) {
+		a := setup(t, config.Archive{MaxFiles: 4})
+		removed, err := a.Prune(now)
+		assert.NoError(t, err)
+		assert.Len(t, removed, 1)
+		assert.Contains(t, removed[0], now.Add(-5*time.Hour).Format(timeFormat))
+	})
+
+	t.Run("max total size", func(t *testing.T) {
+		a := setup(t, config.Archive{MaxTotalSize: "250B"})
+		_, err := a.Prune(now)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, remaining(t, a))
+	})
+
+	t.Run("newest archive is kept", func(t *testing.T) {
+		a := setup(t, config.Archive{MaxAge: "1m"})
+		_, err := a.Prune(now)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, remaining(t, a))
+	})
+
+	t.Run("files of other sources are ignored", func(t *testing.T) {
+		a := setup(t, config.Archive{})
+		removed, err := a.Prune(now)
+		assert.NoError(t, err)
+		assert.Empty(t, removed)
+		assert.Equal(t, 5, remaining(t, a))
+	})
+}
@@ -0,0 +1,98 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Entry is the position reached in one source file. Dev and Inode identify
+// the file so that a rotated or recreated file at the same path is not
+// resumed at a stale offset.
+type Entry struct {
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	// Position is the position reached in an input other than a file,
+	// such as a journal cursor.
+	Position string `json:"position,omitempty"`
+}
+
+// Matches reports whether info describes the file the entry was recorded for.
+func (e Entry) Matches(info os.FileInfo) bool {
+	dev, ino, ok := FileID(info)
+	return ok && dev == e.Dev && ino == e.Inode
+}
+
+// NewEntry records offset for the file described by info.
+func NewEntry(info os.FileInfo, offset int64) Entry {
+	dev, ino, _ := FileID(info)
+	return Entry{Dev: dev, Inode: ino, Offset: offset}
+}
+
+// Store keeps the entries of one checkpoint file, keyed by source path.
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the checkpoint file at path. A missing file is not an error
+// and yields an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: make(map[string]Entry),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint file %w", err)
+	}
+	if err := json.Unmarshal(b, &s.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file %w", err)
+	}
+	return s, nil
+}
+
+func (s *Store) Get(key string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return e, ok
+}
+
+// Replace swaps all entries, dropping files that are no longer followed.
+func (s *Store) Replace(entries map[string]Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = maps.Clone(entries)
+}
+
+// Save writes the entries to a temporary file and renames it over the
+// checkpoint file so a crash never leaves a partially written checkpoint.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	b, err := json.MarshalIndent(s.entries, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("mkdir failed: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint file %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace checkpoint file %w", err)
+	}
+	return nil
+}
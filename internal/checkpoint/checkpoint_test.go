@@ -0,0 +1,59 @@
+package checkpoint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+
+	t.Run("missing checkpoint file yields an empty store", func(t *testing.T) {
+		s, err := Open(filepath.Join(t.TempDir(), "missing.json"))
+		assert.NoError(t, err)
+		_, ok := s.Get("app.log")
+		assert.False(t, ok)
+	})
+
+	t.Run("entries survive a save and reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state", "checkpoint.json")
+		s, err := Open(path)
+		assert.NoError(t, err)
+
+		e := Entry{Dev: 1, Inode: 2, Offset: 42}
+		s.Replace(map[string]Entry{"app.log": e})
+		assert.NoError(t, s.Save())
+
+		reloaded, err := Open(path)
+		assert.NoError(t, err)
+		got, ok := reloaded.Get("app.log")
+		assert.True(t, ok)
+		assert.Equal(t, e, got)
+		_, err = os.Stat(path + ".tmp")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("corrupt checkpoint file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkpoint.json")
+		assert.NoError(t, os.WriteFile(path, []byte("{not json"), 0644))
+		_, err := Open(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("entry matches only the same file", func(t *testing.T) {
+		dir := t.TempDir()
+		a := filepath.Join(dir, "a.log")
+		b := filepath.Join(dir, "b.log")
+		assert.NoError(t, os.WriteFile(a, nil, 0644))
+		assert.NoError(t, os.WriteFile(b, nil, 0644))
+		infoA, _ := os.Stat(a)
+		infoB, _ := os.Stat(b)
+
+		e := NewEntry(infoA, 10)
+		assert.Equal(t, int64(10), e.Offset)
+		assert.True(t, e.Matches(infoA))
+		assert.False(t, e.Matches(infoB))
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package checkpoint
+
+import "os"
+
+// FileID is not supported on this platform, so checkpoints never match and
+// sources always start from the configured start_position.
+func FileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package checkpoint
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID returns the device and inode number of the file described by info.
+func FileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
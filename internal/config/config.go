@@ -2,16 +2,32 @@ package config
 
 import (
 	"fmt"
+	"hash/fnv"
+	"maps"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/akmanon/kpi-metricsd/internal/cron"
+	"github.com/akmanon/kpi-metricsd/internal/grok"
+	"github.com/akmanon/kpi-metricsd/internal/units"
 	"gopkg.in/yaml.v3"
 )
 
 type Cfg struct {
-	Server ServerConfig `yaml:"server"`
-	LogCfg LogCfg       `yaml:"log_config"`
-	KPIs   []KPI        `yaml:"kpis"`
+	Server     ServerConfig `yaml:"server"`
+	LogCfg     LogCfg       `yaml:"log_config"`
+	KPIs       []KPI        `yaml:"kpis"`
+	LogSources []LogSource  `yaml:"log_sources"`
+
+	// GrokPatternFiles extend the built-in grok patterns, later files
+	// overriding earlier ones.
+	GrokPatternFiles []string `yaml:"grok_pattern_files"`
 }
 
 type ServerConfig struct {
@@ -28,19 +44,543 @@ type PushGateway struct {
 }
 
 type LogCfg struct {
-	SourceLogFile    string `yaml:"source_log_file"`
-	RedirectLogFile  string `yaml:"redirect_log_file"`
-	RotatedLogFile   string `yaml:"rotated_log_file"`
-	RotationInterval string `yaml:"rotation_interval"`
+	Input             string    `yaml:"input"`
+	SourceLogFile     string    `yaml:"source_log_file"`
+	Format            string    `yaml:"format"`
+	RedirectLogFile   string    `yaml:"redirect_log_file"`
+	RotatedLogFile    string    `yaml:"rotated_log_file"`
+	RotationInterval  string    `yaml:"rotation_interval"`
+	RotationSchedule  string    `yaml:"rotation_schedule"`
+	RotationMaxSize   string    `yaml:"rotation_max_size"`
+	AlignToWallClock  bool      `yaml:"align_to_wall_clock"`
+	Timezone          string    `yaml:"timezone"`
+	WindowTimestamps  bool      `yaml:"window_timestamps"`
+	FileLabel         bool      `yaml:"file_label"`
+	CheckpointFile    string    `yaml:"checkpoint_file"`
+	StartPosition     string    `yaml:"start_position"`
+	Mode              string    `yaml:"mode"`
+	KeepFiles         bool      `yaml:"keep_files"`
+	EvaluationWorkers int       `yaml:"evaluation_workers"`
+	Multiline         Multiline `yaml:"multiline"`
+	Syslog            Syslog    `yaml:"syslog"`
+	Journal           Journal   `yaml:"journal"`
+	Archive           Archive   `yaml:"archive"`
+}
+
+// Inputs a source reads its lines from. The default, file, tails
+// source_log_file, and fifo reads the named pipe at source_log_file.
+const (
+	InputFile   = "file"
+	InputSyslog = "syslog"
+	InputStdin  = "stdin"
+	InputFIFO   = "fifo"
+	// InputJournal reads systemd journal entries in the export format.
+	InputJournal = "journal"
+)
+
+// Formats of the lines of a source, written by container runtimes. Their
+// lines are unwrapped into the messages logged by the container before
+// KPIs are matched.
+const (
+	FormatCRI    = "cri"
+	FormatDocker = "docker"
+)
+
+// Labels of the files of a container source split by file, derived from
+// the paths the kubelet writes container logs to.
+const (
+	NamespaceLabel = "namespace"
+	PodLabel       = "pod"
+	ContainerLabel = "container"
+)
+
+// ContainerFormat reports whether the lines of the source are written by a
+// container runtime.
+func (l LogCfg) ContainerFormat() bool {
+	return l.Format == FormatCRI || l.Format == FormatDocker
+}
+
+// reservedLabels returns the labels the daemon sets on the series of the
+// source, which KPIs cannot set.
+func (l LogCfg) reservedLabels() []string {
+	if l.ContainerFormat() && l.FileLabel {
+		return []string{SourceLabel, FileLabel, NamespaceLabel, PodLabel, ContainerLabel}
+	}
+	return []string{SourceLabel, FileLabel}
+}
+
+// Syslog sets the sockets a syslog input listens on, at least one of
+// them. Unix is a stream socket and Unixgram a datagram socket like
+// /dev/log.
+type Syslog struct {
+	UDP            string `yaml:"udp"`
+	TCP            string `yaml:"tcp"`
+	Unix           string `yaml:"unix"`
+	Unixgram       string `yaml:"unixgram"`
+	MaxMessageSize string `yaml:"max_message_size"`
+}
+
+// DefaultSyslogMaxMessageSize bounds the size of a syslog message when
+// max_message_size is not set.
+const DefaultSyslogMaxMessageSize = 64 << 10
+
+// MaxSize returns the size in bytes of the largest message accepted.
+func (s Syslog) MaxSize() int {
+	size, err := units.ParseBytes(s.MaxMessageSize)
+	if err != nil || size <= 0 {
+		return DefaultSyslogMaxMessageSize
+	}
+	return int(size)
+}
+
+func (s Syslog) validate() error {
+	if s.UDP == "" && s.TCP == "" && s.Unix == "" && s.Unixgram == "" {
+		return fmt.Errorf("udp, tcp, unix or unixgram is required")
+	}
+	if s.MaxMessageSize != "" {
+		if size, err := units.ParseBytes(s.MaxMessageSize); err != nil || size <= 0 || size > 1<<30 {
+			return fmt.Errorf("max_message_size must be a positive size of at most 1GiB")
+		}
+	}
+	return nil
+}
+
+// Journal sets where a journal input reads entries from: File, a journal
+// exported with journalctl -o export, or else journalctl following the
+// local journal, or the journal files in Directory, restricted to the
+// units matching Unit when it is set.
+type Journal struct {
+	File      string `yaml:"file"`
+	Directory string `yaml:"directory"`
+	Unit      string `yaml:"unit"`
+}
+
+func (j Journal) validate() error {
+	if j.File != "" && (j.Directory != "" || j.Unit != "") {
+		return fmt.Errorf("file cannot be combined with directory or unit")
+	}
+	return nil
+}
+
+// Multiline groups consecutive lines, such as a stack trace and the line
+// that logged it, into one event before KPIs are matched. A line matching
+// Start begins a new event and, when Continuation is set, only lines
+// matching it are appended to the current event; any other line is an
+// event of its own.
+type Multiline struct {
+	Start        string `yaml:"start"`
+	Continuation string `yaml:"continuation"`
+	MaxLines     int    `yaml:"max_lines"`
+	FlushTimeout string `yaml:"flush_timeout"`
+}
+
+// Defaults of the multiline settings.
+const (
+	DefaultMultilineMaxLines     = 500
+	DefaultMultilineFlushTimeout = 5 * time.Second
+)
+
+// Enabled reports whether lines are grouped into events.
+func (m Multiline) Enabled() bool {
+	return m != Multiline{}
+}
+
+// Lines returns the number of lines after which an event is cut.
+func (m Multiline) Lines() int {
+	if m.MaxLines > 0 {
+		return m.MaxLines
+	}
+	return DefaultMultilineMaxLines
+}
+
+// Timeout returns how long an event waits for more lines in stream mode
+// before it is matched.
+func (m Multiline) Timeout() time.Duration {
+	d, err := time.ParseDuration(m.FlushTimeout)
+	if err != nil || d <= 0 {
+		return DefaultMultilineFlushTimeout
+	}
+	return d
+}
+
+func (m Multiline) validate() error {
+	if m.Start == "" && m.Continuation == "" {
+		return fmt.Errorf("start or continuation is required")
+	}
+	for _, re := range []string{m.Start, m.Continuation} {
+		if _, err := regexp.Compile(re); err != nil {
+			return err
+		}
+	}
+	if m.MaxLines < 0 {
+		return fmt.Errorf("max_lines must not be negative")
+	}
+	if m.FlushTimeout != "" {
+		if d, err := time.ParseDuration(m.FlushTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("flush_timeout must be a positive duration")
+		}
+	}
+	return nil
+}
+
+// Archive keeps a timestamped copy of every rotated file once its metrics
+// have been computed, removing old copies by age, count and total size.
+type Archive struct {
+	Enabled      bool   `yaml:"enabled"`
+	Dir          string `yaml:"dir"`
+	Compression  string `yaml:"compression"`
+	MaxAge       string `yaml:"max_age"`
+	MaxFiles     int    `yaml:"max_files"`
+	MaxTotalSize string `yaml:"max_total_size"`
+}
+
+// Archive compression formats.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ArchiveDir returns the directory archives are written to, by default the
+// directory of the rotated file.
+func (l LogCfg) ArchiveDir() string {
+	if l.Archive.Dir != "" {
+		return l.Archive.Dir
+	}
+	return filepath.Dir(l.RotatedLogFile)
+}
+
+func (a Archive) validate() error {
+	switch a.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("compression must be %q, %q or %q", CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	if a.MaxAge != "" {
+		if d, err := time.ParseDuration(a.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("max_age must be a positive duration")
+		}
+	}
+	if a.MaxFiles < 0 {
+		return fmt.Errorf("max_files must not be negative")
+	}
+	if a.MaxTotalSize != "" {
+		if size, err := units.ParseBytes(a.MaxTotalSize); err != nil || size <= 0 {
+			return fmt.Errorf("max_total_size must be a positive size")
+		}
+	}
+	return nil
+}
+
+// Processing modes of a log source. In file mode lines are redirected to a
+// file that is rotated and scanned every window; in stream mode they are
+// matched in memory as they are read.
+const (
+	ModeFile   = "file"
+	ModeStream = "stream"
+)
+
+// UsesFiles reports whether the redirect and rotated files are written.
+func (l LogCfg) UsesFiles() bool {
+	return l.Mode != ModeStream || l.KeepFiles
+}
+
+// Location returns the timezone windows are aligned and reported in, the
+// local timezone by default.
+func (l LogCfg) Location() *time.Location {
+	if l.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(l.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// MaxSize returns the redirect file size in bytes that triggers a rotation
+// before the interval elapses, or 0 if only the interval applies.
+func (l LogCfg) MaxSize() int64 {
+	size, _ := units.ParseBytes(l.RotationMaxSize)
+	return size
+}
+
+// Workers returns the number of goroutines evaluating a rotated file, by
+// default one per CPU.
+func (l LogCfg) Workers() int {
+	if l.EvaluationWorkers > 0 {
+		return l.EvaluationWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Start positions used when a source file has no matching checkpoint.
+const (
+	StartPositionEnd       = "end"
+	StartPositionBeginning = "beginning"
+)
+
+// LogSource is one independent tail/rotate/metrics pipeline. The legacy
+// top-level log_config and kpis sections are loaded as a single source
+// named DefaultSourceName.
+type LogSource struct {
+	Name   string `yaml:"name"`
+	LogCfg `yaml:",inline"`
+	KPIs   []KPI `yaml:"kpis"`
+
+	// Labels are set by the daemon, not the config file, and are added to
+	// every series of the source next to SourceLabel.
+	Labels map[string]string `yaml:"-"`
+}
+
+const DefaultSourceName = "default"
+
+// SourceLabel is added to every series exported for a log source.
+const SourceLabel = "source"
+
+// FileLabel holds the matched path when a source splits its KPIs by file.
+const FileLabel = "file"
+
+// ForFile returns the source narrowed to a single file matched by its
+// source_log_file glob. The redirect and rotated files get a suffix derived
+// from the path so that every file has its own pipeline.
+func (s LogSource) ForFile(path string) LogSource {
+	suffix := fileSuffix(path)
+	s.SourceLogFile = path
+	s.RedirectLogFile = insertSuffix(s.RedirectLogFile, suffix)
+	s.RotatedLogFile = insertSuffix(s.RotatedLogFile, suffix)
+	s.CheckpointFile = insertSuffix(s.CheckpointFile, suffix)
+	labels := make(map[string]string, len(s.Labels)+4)
+	maps.Copy(labels, s.Labels)
+	labels[FileLabel] = path
+	if s.ContainerFormat() {
+		labels[NamespaceLabel], labels[PodLabel], labels[ContainerLabel] = containerLabels(path)
+	}
+	s.Labels = labels
+	return s
+}
+
+// containerLabels returns the namespace, pod and container of a log file
+// at <namespace>_<pod>_<uid>/<container>/<restarts>.log under /var/log/pods
+// or at <pod>_<namespace>_<container>-<id>.log under /var/log/containers,
+// or empty values for other paths.
+func containerLabels(path string) (namespace, pod, container string) {
+	dir, file := filepath.Split(filepath.Clean(path))
+	dir = filepath.Clean(dir)
+	if filepath.Base(dir) == "containers" {
+		parts := strings.SplitN(strings.TrimSuffix(file, ".log"), "_", 3)
+		if len(parts) == 3 {
+			if i := strings.LastIndexByte(parts[2], '-'); i > 0 {
+				return parts[1], parts[0], parts[2][:i]
+			}
+		}
+		return "", "", ""
+	}
+	podDir := filepath.Dir(dir)
+	if filepath.Base(filepath.Dir(podDir)) == "pods" {
+		if parts := strings.Split(filepath.Base(podDir), "_"); len(parts) == 3 {
+			return parts[0], parts[1], filepath.Base(dir)
+		}
+	}
+	return "", "", ""
+}
+
+func fileSuffix(path string) string {
+	readable := strings.Trim(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return r
+		}
+		return '_'
+	}, path), "_")
+	// Paths such as a.b.log and a_b.log read the same, so a hash of the
+	// path tells their files apart.
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return fmt.Sprintf("%s-%08x", readable, h.Sum32())
+}
+
+func insertSuffix(path, suffix string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ext
 }
 
 type KPI struct {
 	Name         string            `yaml:"name"`
 	Regex        string            `yaml:"regex"`
 	CustomLabels map[string]string `yaml:"custom_labels"`
+	Type         string            `yaml:"type"`
+
+	// Grok replaces Regex and is expanded into it when the config is
+	// validated. Only FieldLabels become labels, so the many fields of a
+	// pattern such as %{COMBINEDAPACHELOG} do not blow up cardinality.
+	Grok string `yaml:"grok"`
+
+	// Exclude and the matcher tree restrict the lines matched by Regex: a
+	// line is counted only if it matches no exclude regex and the tree.
+	// Without Regex, the tree alone selects the lines.
+	Exclude []string  `yaml:"exclude"`
+	AllOf   []Matcher `yaml:"all_of"`
+	AnyOf   []Matcher `yaml:"any_of"`
+	NoneOf  []Matcher `yaml:"none_of"`
+
+	// Format json or logfmt matches fields of structured lines instead of
+	// Regex: a line is counted if it meets every Where condition. FieldLabels maps
+	// label names to the dotted paths of their fields, and ValueField
+	// replaces ValueGroup.
+	Format      string            `yaml:"format"`
+	Where       []string          `yaml:"where"`
+	FieldLabels map[string]string `yaml:"field_labels"`
+	ValueField  string            `yaml:"value_field"`
+
+	MaxLabelCardinality int `yaml:"max_label_cardinality"`
+
+	// ValueGroup names the capture group holding the number a histogram
+	// observes or an aggregation combines. A unit suffix in the captured
+	// text, or Unit when there is none, converts it to seconds or bytes.
+	ValueGroup                  string    `yaml:"value_group"`
+	Aggregation                 string    `yaml:"aggregation"`
+	Unit                        string    `yaml:"unit"`
+	Buckets                     []float64 `yaml:"buckets"`
+	NativeHistogramBucketFactor float64   `yaml:"native_histogram_bucket_factor"`
+
+	grokRegex string
+}
+
+// DefaultMaxLabelCardinality bounds the series a KPI with named capture
+// groups can create when max_label_cardinality is not set.
+const DefaultMaxLabelCardinality = 100
+
+func (k KPI) MaxCardinality() int {
+	if k.MaxLabelCardinality > 0 {
+		return k.MaxLabelCardinality
+	}
+	return DefaultMaxLabelCardinality
+}
+
+// Matcher is a node of a KPI matcher tree. A line matches it if it matches
+// Regex, every matcher of AllOf, at least one of AnyOf and none of NoneOf,
+// ignoring the parts that are not set.
+type Matcher struct {
+	Regex  string    `yaml:"regex"`
+	AllOf  []Matcher `yaml:"all_of"`
+	AnyOf  []Matcher `yaml:"any_of"`
+	NoneOf []Matcher `yaml:"none_of"`
+}
+
+func (m Matcher) validate() error {
+	if m.Regex == "" && len(m.AllOf) == 0 && len(m.AnyOf) == 0 && len(m.NoneOf) == 0 {
+		return fmt.Errorf("empty matcher, set regex, all_of, any_of or none_of")
+	}
+	for _, children := range [][]Matcher{m.AllOf, m.AnyOf, m.NoneOf} {
+		for _, c := range children {
+			if err := c.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// KPI formats. Regex KPIs match the raw line, the others its fields.
+const (
+	FormatRegex  = "regex"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+	// FormatSyslog matches the header fields of syslog messages, and their
+	// body as the message field.
+	FormatSyslog = "syslog"
+	// FormatJournal matches the fields of journal entries, such as
+	// _SYSTEMD_UNIT, PRIORITY, _HOSTNAME and MESSAGE.
+	FormatJournal = "journal"
+)
+
+// HasMatcherTree reports whether the KPI sets all_of, any_of or none_of.
+func (k KPI) HasMatcherTree() bool {
+	return len(k.AllOf) > 0 || len(k.AnyOf) > 0 || len(k.NoneOf) > 0
+}
+
+// Structured reports whether the KPI matches fields instead of a regex.
+func (k KPI) Structured() bool {
+	return k.Format != "" && k.Format != FormatRegex
+}
+
+// Pattern returns the regex lines are matched with: Regex, or the expansion
+// of Grok once the config is validated.
+func (k KPI) Pattern() string {
+	if k.Grok != "" {
+		return k.grokRegex
+	}
+	return k.Regex
+}
+
+// HasFields reports whether the KPI takes its labels and value from named
+// fields rather than capture groups.
+func (k KPI) HasFields() bool {
+	return k.Structured() || k.Grok != ""
+}
+
+// valueSource names the setting holding the value of the KPI.
+func (k KPI) valueSource() (name, value string) {
+	if k.HasFields() {
+		return "value_field", k.ValueField
+	}
+	return "value_group", k.ValueGroup
+}
+
+// KPI types. A gauge holds the count of the last window, a counter named
+// <name>_total is incremented by every window's count.
+const (
+	KPITypeGauge   = "gauge"
+	KPITypeCounter = "counter"
+	KPITypeBoth    = "both"
+
+	// KPITypeHistogram observes the number captured by value_group.
+	KPITypeHistogram = "histogram"
+)
+
+// KPI aggregations, computed over the matches of each window. Every one
+// but count combines the number captured by value_group.
+const (
+	AggregationCount = "count"
+	AggregationSum   = "sum"
+	AggregationMin   = "min"
+	AggregationMax   = "max"
+	AggregationLast  = "last"
+)
+
+// Aggregate returns the aggregation of the KPI, count by default.
+func (k KPI) Aggregate() string {
+	if k.Aggregation == "" {
+		return AggregationCount
+	}
+	return k.Aggregation
+}
+
+// Additive reports whether window values of the KPI add up, which a
+// counter requires. Windows without matches then contribute zero.
+func (k KPI) Additive() bool {
+	return k.Aggregate() == AggregationCount || k.Aggregate() == AggregationSum
+}
+
+func (k KPI) HasGauge() bool {
+	return k.Type == "" || k.Type == KPITypeGauge || k.Type == KPITypeBoth
+}
+
+func (k KPI) HasCounter() bool {
+	return k.Type == KPITypeCounter || k.Type == KPITypeBoth
 }
 
 func LoadCfg(cfgPath string) (*Cfg, error) {
+	return LoadCfgWithInput(cfgPath, "")
+}
+
+// LoadCfgWithInput loads the config file like LoadCfg. When input is set,
+// the only log source of the config reads its lines from stdin, for "-",
+// or from the named pipe at input, instead of its configured input.
+func LoadCfgWithInput(cfgPath, input string) (*Cfg, error) {
 
 	cfgFile, err := os.ReadFile(cfgPath)
 	if err != nil {
@@ -52,6 +592,15 @@ func LoadCfg(cfgPath string) (*Cfg, error) {
 		return nil, fmt.Errorf("failed to parse config file %w", err)
 	}
 
+	if err := cfg.normalize(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	if input != "" {
+		if err := cfg.setInput(input); err != nil {
+			return nil, fmt.Errorf("config validation failed: %w", err)
+		}
+	}
+
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
@@ -60,19 +609,51 @@ func LoadCfg(cfgPath string) (*Cfg, error) {
 
 }
 
+func (c *Cfg) setInput(path string) error {
+	if len(c.LogSources) != 1 {
+		return fmt.Errorf("the input can only be set for a config with one log source, found %d", len(c.LogSources))
+	}
+	src := &c.LogSources[0]
+	src.Input, src.SourceLogFile, src.Syslog, src.Journal = InputStdin, "", Syslog{}, Journal{}
+	if path != "-" {
+		src.Input, src.SourceLogFile = InputFIFO, path
+	}
+	return nil
+}
+
+// normalize turns a legacy single-source config into a one element
+// LogSources list so the rest of the daemon only deals with sources.
+func (c *Cfg) normalize() error {
+	legacy := c.LogCfg != (LogCfg{}) || len(c.KPIs) > 0
+	if len(c.LogSources) > 0 {
+		if legacy {
+			return fmt.Errorf("log_config and kpis cannot be combined with log_sources")
+		}
+		return nil
+	}
+	if legacy {
+		c.LogSources = []LogSource{{
+			Name:   DefaultSourceName,
+			LogCfg: c.LogCfg,
+			KPIs:   c.KPIs,
+		}}
+	}
+	return nil
+}
+
 func (c *Cfg) Validate() error {
 	if c == nil {
 		return fmt.Errorf("config is nil")
 	}
 
-	if len(c.KPIs) == 0 {
-		return fmt.Errorf("no KPIs defined in config")
+	if len(c.LogSources) == 0 {
+		return fmt.Errorf("no log sources defined in config")
 	}
 
-	if err := c.validateLogCfg(); err != nil {
+	if err := c.expandGrok(); err != nil {
 		return err
 	}
-	if err := c.validateKPICfg(); err != nil {
+	if err := c.validateSources(); err != nil {
 		return err
 	}
 	if err := c.validateServerCfg(); err != nil {
@@ -82,6 +663,152 @@ func (c *Cfg) Validate() error {
 	return nil
 }
 
+// expandGrok expands the grok pattern of every KPI that has one.
+func (c *Cfg) expandGrok() error {
+	var lib *grok.Library
+	for i := range c.LogSources {
+		src := &c.LogSources[i]
+		for j := range src.KPIs {
+			kpi := &src.KPIs[j]
+			if kpi.Grok == "" {
+				continue
+			}
+			if lib == nil {
+				lib = grok.New()
+				for _, path := range c.GrokPatternFiles {
+					if err := lib.AddFile(path); err != nil {
+						return fmt.Errorf("grok_pattern_files: %w", err)
+					}
+				}
+			}
+			re, err := lib.Expand(kpi.Grok)
+			if err != nil {
+				return fmt.Errorf("log source %q: KPI %s: grok: %w", src.Name, kpi.Name, err)
+			}
+			kpi.grokRegex = re
+		}
+	}
+	return nil
+}
+
+func (c *Cfg) validateSources() error {
+	names := make(map[string]bool)
+	paths := make(map[string]string)
+	for _, src := range c.LogSources {
+		if src.Name == "" {
+			return fmt.Errorf("log source name is not defined in config")
+		}
+		if names[src.Name] {
+			return fmt.Errorf("log source %q is defined more than once", src.Name)
+		}
+		names[src.Name] = true
+
+		if err := src.validateLogCfg(); err != nil {
+			return fmt.Errorf("log source %q: %w", src.Name, err)
+		}
+		if err := src.validateKPICfg(); err != nil {
+			return fmt.Errorf("log source %q: %w", src.Name, err)
+		}
+
+		// The daemon stops at the end of stdin or of an exported journal
+		// file, which would also stop the other sources.
+		if len(c.LogSources) > 1 {
+			switch {
+			case src.Input == InputStdin:
+				return fmt.Errorf("log source %q: stdin must be read by the only log source", src.Name)
+			case src.Input == InputJournal && src.Journal.File != "":
+				return fmt.Errorf("log source %q: journal.file must be read by the only log source", src.Name)
+			}
+		}
+		files := []string{src.CheckpointFile, src.Syslog.Unix, src.Syslog.Unixgram}
+		if src.Input == InputFIFO {
+			files = append(files, src.SourceLogFile)
+		}
+		if src.UsesFiles() {
+			files = append(files, src.RedirectLogFile, src.RotatedLogFile)
+		}
+		if src.Archive.Enabled {
+			// Archives are named after the rotated file, so two sources
+			// archiving to one directory need rotated files of different names.
+			files = append(files, filepath.Join(src.ArchiveDir(), filepath.Base(src.RotatedLogFile))+" archives")
+		}
+		for _, p := range files {
+			if p == "" {
+				continue
+			}
+			if owner, ok := paths[p]; ok {
+				return fmt.Errorf("log source %q: file %s is already used by log source %q", src.Name, p, owner)
+			}
+			paths[p] = src.Name
+		}
+	}
+	return c.validateKPIMetrics()
+}
+
+// validateKPIMetrics checks that the metrics of KPIs sharing a name, in
+// different sources, can be registered together: Prometheus requires every
+// series of a metric to have the same type, help text and label names.
+func (c *Cfg) validateKPIMetrics() error {
+	type owner struct {
+		source, kpi, desc string
+	}
+	owners := make(map[string]owner)
+	for _, src := range c.LogSources {
+		for _, kpi := range src.KPIs {
+			for name, desc := range src.kpiMetrics(kpi) {
+				prev, ok := owners[name]
+				if !ok {
+					owners[name] = owner{src.Name, kpi.Name, desc}
+					continue
+				}
+				if prev.desc != desc {
+					return fmt.Errorf("log source %q: KPI %s exports metric %s as %s, but KPI %s of log source %q exports it as %s",
+						src.Name, kpi.Name, name, desc, prev.kpi, prev.source, prev.desc)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// kpiMetrics returns the names of the metrics the KPI exports for the
+// source, with a description of their type, help text and label names.
+func (s LogSource) kpiMetrics(k KPI) map[string]string {
+	labels := []string{SourceLabel}
+	if s.FileLabel {
+		labels = s.reservedLabels()
+	}
+	labels = append(labels, slices.Collect(maps.Keys(k.CustomLabels))...)
+	switch {
+	case k.Structured() || k.Grok != "":
+		labels = append(labels, slices.Collect(maps.Keys(k.FieldLabels))...)
+	default:
+		// Invalid regexes are reported when the KPIs are compiled.
+		if re, err := regexp.Compile(k.Regex); err == nil {
+			for _, name := range re.SubexpNames() {
+				if name != "" && name != k.ValueGroup {
+					labels = append(labels, name)
+				}
+			}
+		}
+	}
+	slices.Sort(labels)
+	labelSet := "{" + strings.Join(slices.Compact(labels), ", ") + "}"
+
+	metrics := make(map[string]string)
+	if k.Type == KPITypeHistogram {
+		metrics[k.Name] = "histogram" + labelSet
+		return metrics
+	}
+	if k.HasGauge() {
+		metrics[k.Name] = "gauge of the " + k.Aggregate() + labelSet
+	}
+	if k.HasCounter() {
+		metrics[k.Name+"_total"] = "counter of the " + k.Aggregate() + labelSet
+	}
+	return metrics
+}
+
 func (c *Cfg) validateServerCfg() error {
 	if c.Server.Port <= 0 || c.Server.Port > 65535 {
 		return fmt.Errorf("server invalid port number")
@@ -104,34 +831,332 @@ func (c *Cfg) validateServerCfg() error {
 	return nil
 }
 
-func (c *Cfg) validateLogCfg() error {
-	if c.LogCfg.RedirectLogFile == "" {
-		return fmt.Errorf("redirect_log_file is not defined in config")
-	}
-	if c.LogCfg.SourceLogFile == "" {
-		return fmt.Errorf("source_log_file is not defined in config")
-	}
-	if c.LogCfg.RotatedLogFile == "" {
-		return fmt.Errorf("rotated_log_file is not defined in config")
+// validateRotationSchedule checks that exactly one of rotation_interval
+// and rotation_schedule is set, and that neither makes windows shorter than
+// a minute.
+func (s *LogSource) validateRotationSchedule() error {
+	if s.RotationSchedule != "" {
+		if s.RotationInterval != "" {
+			return fmt.Errorf("rotation_interval and rotation_schedule cannot both be set")
+		}
+		if s.AlignToWallClock {
+			return fmt.Errorf("align_to_wall_clock only applies to rotation_interval")
+		}
+		schedule, err := cron.Parse(s.RotationSchedule, s.Location())
+		if err != nil {
+			return fmt.Errorf("invalid rotation_schedule %w", err)
+		}
+		if schedule.MinInterval(time.Now(), 1000) < 60*time.Second {
+			return fmt.Errorf("rotation_schedule windows should be > 60 seconds")
+		}
+		return nil
 	}
-	if c.LogCfg.RotationInterval == "" {
+
+	if s.RotationInterval == "" {
 		return fmt.Errorf("rotation_interval is not defined in config")
 	}
-	rotationInterval, err := time.ParseDuration(c.LogCfg.RotationInterval)
+	rotationInterval, err := time.ParseDuration(s.RotationInterval)
 	if err != nil {
 		return fmt.Errorf("failed to parse rotation_interval in config file %w", err)
 	}
 	if rotationInterval < 60*time.Second {
 		return fmt.Errorf("rotation interval should be > 60 seconds ")
 	}
+	if s.AlignToWallClock && rotationInterval > 24*time.Hour {
+		return fmt.Errorf("align_to_wall_clock requires a rotation_interval of at most 24h")
+	}
+	return nil
+}
+
+func (s *LogSource) validateLogCfg() error {
+	switch s.Mode {
+	case "", ModeFile, ModeStream:
+	default:
+		return fmt.Errorf("mode must be %q or %q", ModeFile, ModeStream)
+	}
+	if s.UsesFiles() {
+		if s.RedirectLogFile == "" {
+			return fmt.Errorf("redirect_log_file is not defined in config")
+		}
+		if s.RotatedLogFile == "" {
+			return fmt.Errorf("rotated_log_file is not defined in config")
+		}
+		if s.RedirectLogFile == s.RotatedLogFile {
+			return fmt.Errorf("redirect_log_file and rotated_log_file must differ")
+		}
+	}
+	if err := s.validateInput(); err != nil {
+		return err
+	}
+	switch s.Format {
+	case "":
+	case FormatCRI, FormatDocker:
+		if s.Input == InputSyslog || s.Input == InputJournal {
+			return fmt.Errorf("format %s is not supported by input %s", s.Format, s.Input)
+		}
+	default:
+		return fmt.Errorf("format must be %q or %q", FormatCRI, FormatDocker)
+	}
+	switch s.StartPosition {
+	case "", StartPositionEnd, StartPositionBeginning:
+	default:
+		return fmt.Errorf("start_position must be %q or %q", StartPositionEnd, StartPositionBeginning)
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %w", err)
+		}
+	}
+	if err := s.validateRotationSchedule(); err != nil {
+		return err
+	}
+	if s.RotationMaxSize != "" {
+		size, err := units.ParseBytes(s.RotationMaxSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse rotation_max_size in config file %w", err)
+		}
+		if size <= 0 {
+			return fmt.Errorf("rotation_max_size must be positive")
+		}
+		if !s.UsesFiles() {
+			return fmt.Errorf("rotation_max_size requires the redirect file, set keep_files in stream mode")
+		}
+	}
+	if s.EvaluationWorkers < 0 {
+		return fmt.Errorf("evaluation_workers must not be negative")
+	}
+	if s.EvaluationWorkers > 0 && s.Mode == ModeStream {
+		return fmt.Errorf("evaluation_workers only applies to mode %q", ModeFile)
+	}
+	if s.Multiline.Enabled() {
+		if err := s.Multiline.validate(); err != nil {
+			return fmt.Errorf("multiline: %w", err)
+		}
+	}
+	if s.Archive.Enabled {
+		if !s.UsesFiles() {
+			return fmt.Errorf("archive requires the rotated file, set keep_files in stream mode")
+		}
+		if err := s.Archive.validate(); err != nil {
+			return fmt.Errorf("archive: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *LogSource) validateInput() error {
+	switch s.Input {
+	case "", InputFile:
+		if s.SourceLogFile == "" {
+			return fmt.Errorf("source_log_file is not defined in config")
+		}
+		if _, err := filepath.Match(s.SourceLogFile, ""); err != nil {
+			return fmt.Errorf("invalid source_log_file pattern %w", err)
+		}
+		if s.Syslog != (Syslog{}) {
+			return fmt.Errorf("syslog requires input %q", InputSyslog)
+		}
+		if s.Journal != (Journal{}) {
+			return fmt.Errorf("journal requires input %q", InputJournal)
+		}
+		return nil
+	case InputSyslog:
+		if err := s.Syslog.validate(); err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		if s.Multiline.Enabled() {
+			return fmt.Errorf("multiline is not supported by input %s", s.Input)
+		}
+	case InputFIFO:
+		if s.SourceLogFile == "" {
+			return fmt.Errorf("source_log_file is not defined in config")
+		}
+	case InputStdin:
+	case InputJournal:
+		if err := s.Journal.validate(); err != nil {
+			return fmt.Errorf("journal: %w", err)
+		}
+		if s.Multiline.Enabled() {
+			return fmt.Errorf("multiline is not supported by input %s", s.Input)
+		}
+	default:
+		return fmt.Errorf("input must be %q, %q, %q, %q or %q", InputFile, InputSyslog, InputStdin, InputFIFO, InputJournal)
+	}
+	if s.Input != InputSyslog && s.Syslog != (Syslog{}) {
+		return fmt.Errorf("syslog requires input %q", InputSyslog)
+	}
+	if s.Input != InputJournal && s.Journal != (Journal{}) {
+		return fmt.Errorf("journal requires input %q", InputJournal)
+	}
+
+	// Settings of tailed files.
+	switch {
+	case s.SourceLogFile != "" && s.Input != InputFIFO:
+		return fmt.Errorf("source_log_file only applies to inputs %q and %q", InputFile, InputFIFO)
+	case s.FileLabel:
+		return fmt.Errorf("file_label only applies to input %q", InputFile)
+	case s.Input == InputJournal:
+		// A journal input resumes at the cursor in checkpoint_file and
+		// starts journalctl at start_position.
+		if s.StartPosition != "" && s.Journal.File != "" {
+			return fmt.Errorf("start_position does not apply to journal.file")
+		}
+	case s.CheckpointFile != "":
+		return fmt.Errorf("checkpoint_file only applies to inputs %q and %q", InputFile, InputJournal)
+	case s.StartPosition != "":
+		return fmt.Errorf("start_position only applies to inputs %q and %q", InputFile, InputJournal)
+	}
 	return nil
 }
 
-func (c *Cfg) validateKPICfg() error {
-	for _, kpi := range c.KPIs {
-		if kpi.Name == "" || kpi.Regex == "" {
+// InputFormat returns the format of the fields the input of the source provides
+// with every line, or "" if it provides none.
+func (l LogCfg) InputFormat() string {
+	switch l.Input {
+	case InputSyslog:
+		return FormatSyslog
+	case InputJournal:
+		return FormatJournal
+	}
+	return ""
+}
+
+func (s *LogSource) validateKPICfg() error {
+	if len(s.KPIs) == 0 {
+		return fmt.Errorf("no KPIs defined in config")
+	}
+	for _, kpi := range s.KPIs {
+		if kpi.Name == "" || (kpi.Regex == "" && kpi.Grok == "" && !kpi.Structured() && !kpi.HasMatcherTree()) {
 			return fmt.Errorf("KPI name or regex is not defined in config")
 		}
+		if err := kpi.validateFormat(); err != nil {
+			return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+		}
+		if kpi.Format == FormatSyslog && s.InputFormat() != FormatSyslog {
+			return fmt.Errorf("KPI %s: format %s requires input %q", kpi.Name, kpi.Format, InputSyslog)
+		}
+		if kpi.Format == FormatJournal && s.InputFormat() != FormatJournal {
+			return fmt.Errorf("KPI %s: format %s requires input %q", kpi.Name, kpi.Format, InputJournal)
+		}
+		if kpi.MaxLabelCardinality < 0 {
+			return fmt.Errorf("KPI %s: max_label_cardinality must not be negative", kpi.Name)
+		}
+		switch kpi.Type {
+		case "", KPITypeGauge, KPITypeCounter, KPITypeBoth:
+		case KPITypeHistogram:
+			if err := kpi.validateHistogram(); err != nil {
+				return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+			}
+		default:
+			return fmt.Errorf("KPI %s: type must be %q, %q, %q or %q", kpi.Name,
+				KPITypeGauge, KPITypeCounter, KPITypeBoth, KPITypeHistogram)
+		}
+		if kpi.Type != KPITypeHistogram {
+			if err := kpi.validateAggregation(); err != nil {
+				return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+			}
+		}
+		for _, exclude := range kpi.Exclude {
+			if exclude == "" {
+				return fmt.Errorf("KPI %s: empty exclude regex", kpi.Name)
+			}
+		}
+		tree := Matcher{Regex: kpi.Regex, AllOf: kpi.AllOf, AnyOf: kpi.AnyOf, NoneOf: kpi.NoneOf}
+		if kpi.Regex != "" || kpi.HasMatcherTree() {
+			if err := tree.validate(); err != nil {
+				return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+			}
+		}
+		for _, reserved := range s.reservedLabels() {
+			if _, ok := kpi.CustomLabels[reserved]; ok {
+				return fmt.Errorf("KPI %s: custom label %q is reserved", kpi.Name, reserved)
+			}
+			if _, ok := kpi.FieldLabels[reserved]; ok {
+				return fmt.Errorf("KPI %s: field label %q is reserved", kpi.Name, reserved)
+			}
+		}
+	}
+	return nil
+}
+
+func (k KPI) validateFormat() error {
+	switch k.Format {
+	case "", FormatRegex:
+		if k.Grok != "" {
+			if k.Regex != "" || k.ValueGroup != "" {
+				return fmt.Errorf("regex and value_group cannot be set with grok, use field_labels and value_field")
+			}
+			if len(k.Where) > 0 {
+				return fmt.Errorf("where requires a structured format")
+			}
+			return k.validateFieldLabels()
+		}
+		if len(k.Where) > 0 || len(k.FieldLabels) > 0 || k.ValueField != "" {
+			return fmt.Errorf("where, field_labels and value_field require a structured format or grok")
+		}
+		return nil
+	case FormatJSON, FormatLogfmt, FormatSyslog, FormatJournal:
+	default:
+		return fmt.Errorf("format must be %q, %q, %q, %q or %q", FormatRegex, FormatJSON, FormatLogfmt, FormatSyslog, FormatJournal)
+	}
+	if k.Regex != "" || k.Grok != "" || k.ValueGroup != "" {
+		return fmt.Errorf("regex, grok and value_group cannot be set with format %s, use where and value_field", k.Format)
+	}
+	for _, cond := range k.Where {
+		if strings.TrimSpace(cond) == "" {
+			return fmt.Errorf("empty where condition")
+		}
+	}
+	return k.validateFieldLabels()
+}
+
+func (k KPI) validateFieldLabels() error {
+	for label, path := range k.FieldLabels {
+		if path == "" {
+			return fmt.Errorf("field label %q has no field path", label)
+		}
+	}
+	return nil
+}
+
+func (k KPI) validateAggregation() error {
+	switch k.Aggregate() {
+	case AggregationCount:
+		return nil
+	case AggregationSum, AggregationMin, AggregationMax, AggregationLast:
+	default:
+		return fmt.Errorf("aggregation must be %q, %q, %q, %q or %q",
+			AggregationCount, AggregationSum, AggregationMin, AggregationMax, AggregationLast)
+	}
+	if name, value := k.valueSource(); value == "" {
+		return fmt.Errorf("%s is required for the %s aggregation", name, k.Aggregation)
+	}
+	if !units.Valid(k.Unit) {
+		return fmt.Errorf("unknown unit %q", k.Unit)
+	}
+	if k.HasCounter() && !k.Additive() {
+		return fmt.Errorf("the %s aggregation cannot be exported as a counter", k.Aggregation)
+	}
+	return nil
+}
+
+func (k KPI) validateHistogram() error {
+	if name, value := k.valueSource(); value == "" {
+		return fmt.Errorf("%s is required for histograms", name)
+	}
+	if k.Aggregation != "" {
+		return fmt.Errorf("aggregation cannot be set for histograms")
+	}
+	if !units.Valid(k.Unit) {
+		return fmt.Errorf("unknown unit %q", k.Unit)
+	}
+	for i := 1; i < len(k.Buckets); i++ {
+		if k.Buckets[i] <= k.Buckets[i-1] {
+			return fmt.Errorf("buckets must be in strictly increasing order")
+		}
+	}
+	if k.NativeHistogramBucketFactor != 0 && k.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("native_histogram_bucket_factor must be greater than 1")
 	}
 	return nil
 }
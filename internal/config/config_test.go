@@ -1,7 +1,10 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,4 +28,602 @@ func TestLoadCfg(t *testing.T) {
 
 	})
 
+	t.Run("legacy config is loaded as the default source", func(t *testing.T) {
+		cfg, err := LoadCfg("../testdata/valid_config.yaml")
+		assert.NoError(t, err)
+		assert.Len(t, cfg.LogSources, 1)
+		assert.Equal(t, DefaultSourceName, cfg.LogSources[0].Name)
+		assert.Equal(t, "testdata/app.log", cfg.LogSources[0].SourceLogFile)
+		assert.Len(t, cfg.LogSources[0].KPIs, 3)
+	})
+
+	t.Run("test with multiple log sources", func(t *testing.T) {
+		cfg, err := LoadCfg("../testdata/multi_source_config.yaml")
+		assert.NoError(t, err)
+		assert.Len(t, cfg.LogSources, 2)
+		assert.Equal(t, "nginx", cfg.LogSources[1].Name)
+		assert.Equal(t, "testdata/nginx_rotated.log", cfg.LogSources[1].RotatedLogFile)
+		assert.Equal(t, "5m", cfg.LogSources[1].RotationInterval)
+		assert.Len(t, cfg.LogSources[1].KPIs, 1)
+	})
+
+}
+
+func TestValidateSources(t *testing.T) {
+	newCfg := func() *Cfg {
+		cfg, err := LoadCfg("../testdata/multi_source_config.yaml")
+		assert.NoError(t, err)
+		return cfg
+	}
+
+	t.Run("duplicate source names", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[1].Name = cfg.LogSources[0].Name
+		assert.ErrorContains(t, cfg.Validate(), "defined more than once")
+	})
+
+	t.Run("shared rotated file", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[1].RotatedLogFile = cfg.LogSources[0].RotatedLogFile
+		assert.ErrorContains(t, cfg.Validate(), "already used by log source")
+	})
+
+	t.Run("source without KPIs", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[1].KPIs = nil
+		assert.ErrorContains(t, cfg.Validate(), `log source "nginx": no KPIs defined`)
+	})
+
+	t.Run("invalid source glob", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].SourceLogFile = "logs/[a.log"
+		assert.ErrorContains(t, cfg.Validate(), "invalid source_log_file pattern")
+	})
+
+	t.Run("invalid start position", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].StartPosition = "middle"
+		assert.ErrorContains(t, cfg.Validate(), "start_position")
+	})
+
+	t.Run("shared checkpoint file", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].CheckpointFile = "state/checkpoint.json"
+		cfg.LogSources[1].CheckpointFile = "state/checkpoint.json"
+		assert.ErrorContains(t, cfg.Validate(), "already used by log source")
+	})
+
+	t.Run("stream mode without intermediate files", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].Mode = ModeStream
+		cfg.LogSources[0].RedirectLogFile = ""
+		cfg.LogSources[0].RotatedLogFile = ""
+		assert.NoError(t, cfg.Validate())
+		assert.False(t, cfg.LogSources[0].UsesFiles())
+
+		cfg.LogSources[0].KeepFiles = true
+		assert.ErrorContains(t, cfg.Validate(), "redirect_log_file is not defined")
+	})
+
+	t.Run("rotation max size", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].RotationMaxSize = "100MB"
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, int64(100e6), cfg.LogSources[0].MaxSize())
+		assert.Equal(t, int64(0), cfg.LogSources[1].MaxSize())
+
+		cfg.LogSources[0].RotationMaxSize = "10m"
+		assert.ErrorContains(t, cfg.Validate(), "rotation_max_size")
+
+		cfg.LogSources[0].RotationMaxSize = "0"
+		assert.ErrorContains(t, cfg.Validate(), "must be positive")
+	})
+
+	t.Run("JSON KPI", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].KPIs = []KPI{{
+			Name:        "json_errors",
+			Format:      FormatJSON,
+			Where:       []string{`level == "error"`},
+			FieldLabels: map[string]string{"service": "service"},
+			ValueField:  "http.duration",
+			Aggregation: AggregationSum,
+		}}
+		assert.NoError(t, cfg.Validate())
+
+		kpi := &cfg.LogSources[0].KPIs[0]
+		kpi.ValueField = ""
+		assert.ErrorContains(t, cfg.Validate(), "value_field is required")
+
+		kpi.Aggregation = ""
+		kpi.Regex = "ERROR"
+		assert.ErrorContains(t, cfg.Validate(), "cannot be set with format json")
+
+		kpi.Regex = ""
+		kpi.Format = FormatLogfmt
+		assert.NoError(t, cfg.Validate())
+
+		kpi.Format = "xml"
+		assert.ErrorContains(t, cfg.Validate(), "format must be")
+
+		kpi.Format = ""
+		kpi.Regex = "ERROR"
+		assert.ErrorContains(t, cfg.Validate(), "require a structured format")
+	})
+
+	t.Run("grok KPI", func(t *testing.T) {
+		patterns := filepath.Join(t.TempDir(), "patterns")
+		assert.NoError(t, os.WriteFile(patterns, []byte("# custom\nDURATION %{NUMBER}ms\n"), 0o644))
+
+		cfg := newCfg()
+		cfg.GrokPatternFiles = []string{patterns}
+		cfg.LogSources[0].KPIs = []KPI{{
+			Name:        "latency",
+			Grok:        `%{IP:client} took %{DURATION:duration}`,
+			FieldLabels: map[string]string{"client": "client"},
+			ValueField:  "duration",
+			Aggregation: AggregationMax,
+		}}
+		assert.NoError(t, cfg.Validate())
+		kpi := &cfg.LogSources[0].KPIs[0]
+		assert.Contains(t, kpi.Pattern(), "(?P<duration>")
+		assert.Empty(t, kpi.Regex)
+
+		kpi.Grok = `%{NOPE:x}`
+		assert.ErrorContains(t, cfg.Validate(), `log source "app": KPI latency: grok: unknown grok pattern NOPE`)
+
+		kpi.Grok = `%{IP:client}`
+		kpi.Regex = "took"
+		assert.ErrorContains(t, cfg.Validate(), "cannot be set with grok")
+
+		kpi.Regex = ""
+		kpi.Format = FormatJSON
+		assert.ErrorContains(t, cfg.Validate(), "cannot be set with format json")
+
+		cfg.GrokPatternFiles = []string{filepath.Join(t.TempDir(), "missing")}
+		assert.ErrorContains(t, cfg.Validate(), "grok_pattern_files")
+	})
+
+	t.Run("multiline", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].Multiline = Multiline{Start: `^\d{4}-`, FlushTimeout: "2s"}
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, 2*time.Second, cfg.LogSources[0].Multiline.Timeout())
+		assert.Equal(t, DefaultMultilineMaxLines, cfg.LogSources[0].Multiline.Lines())
+		assert.False(t, cfg.LogSources[1].Multiline.Enabled())
+
+		cfg.LogSources[0].Multiline = Multiline{MaxLines: 10}
+		assert.ErrorContains(t, cfg.Validate(), "multiline: start or continuation is required")
+
+		cfg.LogSources[0].Multiline = Multiline{Continuation: "("}
+		assert.ErrorContains(t, cfg.Validate(), "multiline: error parsing regexp")
+
+		cfg.LogSources[0].Multiline = Multiline{Start: "^x", FlushTimeout: "0s"}
+		assert.ErrorContains(t, cfg.Validate(), "flush_timeout must be a positive duration")
+	})
+
+	t.Run("syslog input", func(t *testing.T) {
+		cfg := newCfg()
+		src := &cfg.LogSources[0]
+		src.Input = InputSyslog
+		src.SourceLogFile = ""
+		src.Syslog = Syslog{UDP: ":5514", Unix: filepath.Join(t.TempDir(), "log.sock")}
+		src.KPIs = append(src.KPIs, KPI{Name: "sshd", Format: FormatSyslog, Where: []string{"app_name == sshd"}})
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, FormatSyslog, src.InputFormat())
+		assert.Equal(t, DefaultSyslogMaxMessageSize, src.Syslog.MaxSize())
+
+		src.Syslog.MaxMessageSize = "2GiB"
+		assert.ErrorContains(t, cfg.Validate(), "syslog: max_message_size")
+
+		src.Syslog = Syslog{}
+		assert.ErrorContains(t, cfg.Validate(), "syslog: udp, tcp, unix or unixgram is required")
+
+		src.Syslog = Syslog{TCP: ":5514"}
+		src.SourceLogFile = "app.log"
+		assert.ErrorContains(t, cfg.Validate(), "source_log_file only applies to input")
+
+		src.SourceLogFile = ""
+		src.Multiline = Multiline{Start: "^x"}
+		assert.ErrorContains(t, cfg.Validate(), "multiline is not supported by input syslog")
+
+		src.Multiline = Multiline{}
+		src.Input = "kafka"
+		assert.ErrorContains(t, cfg.Validate(), "input must be")
+
+		cfg = newCfg()
+		cfg.LogSources[0].Syslog = Syslog{UDP: ":5514"}
+		assert.ErrorContains(t, cfg.Validate(), `syslog requires input "syslog"`)
+
+		cfg = newCfg()
+		cfg.LogSources[0].KPIs[0] = KPI{Name: "sshd", Format: FormatSyslog, Where: []string{"app_name == sshd"}}
+		assert.ErrorContains(t, cfg.Validate(), `requires input "syslog"`)
+	})
+
+	t.Run("journal input", func(t *testing.T) {
+		cfg := newCfg()
+		src := &cfg.LogSources[0]
+		src.Input = InputJournal
+		src.SourceLogFile = ""
+		src.Journal = Journal{Unit: "nginx.service"}
+		src.CheckpointFile = filepath.Join(t.TempDir(), "journal.checkpoint")
+		src.StartPosition = StartPositionBeginning
+		src.KPIs = append(src.KPIs, KPI{
+			Name:        "unit_errors",
+			Format:      FormatJournal,
+			Where:       []string{"PRIORITY <= 3"},
+			FieldLabels: map[string]string{"unit": "_SYSTEMD_UNIT", "host": "_HOSTNAME"},
+		})
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, FormatJournal, src.InputFormat())
+
+		src.Journal.File = "/var/log/app.export"
+		assert.ErrorContains(t, cfg.Validate(), "journal: file cannot be combined with directory or unit")
+
+		src.Journal = Journal{File: "/var/log/app.export"}
+		assert.ErrorContains(t, cfg.Validate(), "start_position does not apply to journal.file")
+
+		src.StartPosition = ""
+		src.Multiline = Multiline{Start: "^x"}
+		assert.ErrorContains(t, cfg.Validate(), "multiline is not supported by input journal")
+
+		src.Multiline = Multiline{}
+		src.Format = FormatCRI
+		assert.ErrorContains(t, cfg.Validate(), "format cri is not supported by input journal")
+
+		src.Format = ""
+		assert.ErrorContains(t, cfg.Validate(), `log source "app": journal.file must be read by the only log source`)
+		cfg.LogSources = cfg.LogSources[:1]
+		assert.NoError(t, cfg.Validate())
+
+		cfg = newCfg()
+		cfg.LogSources[0].Journal = Journal{Unit: "nginx.service"}
+		assert.ErrorContains(t, cfg.Validate(), `journal requires input "journal"`)
+
+		cfg = newCfg()
+		cfg.LogSources[0].KPIs[0] = KPI{Name: "units", Format: FormatJournal, Where: []string{"_SYSTEMD_UNIT"}}
+		assert.ErrorContains(t, cfg.Validate(), `requires input "journal"`)
+
+		cfg = newCfg()
+		cfg.LogSources[0].Input = InputStdin
+		cfg.LogSources[0].SourceLogFile = ""
+		cfg.LogSources[0].CheckpointFile = "stdin.checkpoint"
+		assert.ErrorContains(t, cfg.Validate(), "checkpoint_file only applies to inputs")
+	})
+
+	t.Run("stdin and FIFO inputs", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].Input = InputStdin
+		cfg.LogSources[0].SourceLogFile = ""
+		cfg.LogSources[0].Multiline = Multiline{Start: "^x"}
+		cfg.LogSources[1].Input = InputFIFO
+		cfg.LogSources[1].SourceLogFile = "/run/app.pipe"
+		assert.ErrorContains(t, cfg.Validate(), `log source "app": stdin must be read by the only log source`)
+
+		cfg.LogSources = cfg.LogSources[:1]
+		assert.NoError(t, cfg.Validate())
+
+		cfg = newCfg()
+		cfg.LogSources[1].Input = InputStdin
+		cfg.LogSources[1].SourceLogFile = ""
+		assert.ErrorContains(t, cfg.Validate(), `log source "nginx": stdin must be read by the only log source`)
+
+		cfg.LogSources[1].Input = InputFIFO
+		assert.ErrorContains(t, cfg.Validate(), "source_log_file is not defined")
+
+		cfg = newCfg()
+		cfg.LogSources[0].Input = InputStdin
+		assert.ErrorContains(t, cfg.Validate(), "source_log_file only applies to inputs")
+	})
+
+	t.Run("input override", func(t *testing.T) {
+		_, err := LoadCfgWithInput("../testdata/multi_source_config.yaml", "-")
+		assert.ErrorContains(t, err, "one log source, found 2")
+
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(`
+server:
+  port: 9099
+  metrics_path: "/metrics"
+log_config:
+  redirect_log_file: "testdata/app_redirect.log"
+  rotated_log_file: "testdata/app_rotated.log"
+  rotation_interval: "1m"
+kpis:
+  - name: "errors"
+    regex: "ERROR"
+`), 0644))
+		_, err = LoadCfg(path)
+		assert.ErrorContains(t, err, "source_log_file is not defined")
+
+		cfg, err := LoadCfgWithInput(path, "-")
+		assert.NoError(t, err)
+		assert.Equal(t, InputStdin, cfg.LogSources[0].Input)
+
+		cfg, err = LoadCfgWithInput(path, "/run/app.pipe")
+		assert.NoError(t, err)
+		assert.Equal(t, InputFIFO, cfg.LogSources[0].Input)
+		assert.Equal(t, "/run/app.pipe", cfg.LogSources[0].SourceLogFile)
+	})
+
+	t.Run("evaluation workers", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].EvaluationWorkers = 4
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, 4, cfg.LogSources[0].Workers())
+		assert.Positive(t, cfg.LogSources[1].Workers())
+
+		cfg.LogSources[0].EvaluationWorkers = -1
+		assert.ErrorContains(t, cfg.Validate(), "must not be negative")
+
+		cfg.LogSources[0].EvaluationWorkers = 2
+		cfg.LogSources[0].Mode = ModeStream
+		assert.ErrorContains(t, cfg.Validate(), "evaluation_workers only applies")
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].Archive = Archive{Enabled: true, Compression: CompressionZstd, MaxAge: "168h", MaxTotalSize: "1GB"}
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, filepath.Dir(cfg.LogSources[0].RotatedLogFile), cfg.LogSources[0].ArchiveDir())
+
+		cfg.LogSources[0].Archive.Compression = "lz4"
+		assert.ErrorContains(t, cfg.Validate(), "compression must be")
+
+		cfg.LogSources[0].Archive.Compression = CompressionGzip
+		cfg.LogSources[0].Archive.MaxAge = "a week"
+		assert.ErrorContains(t, cfg.Validate(), "max_age")
+	})
+
+	t.Run("shared archive", func(t *testing.T) {
+		cfg := newCfg()
+		for i := range cfg.LogSources {
+			cfg.LogSources[i].RotatedLogFile = filepath.Join("logs", cfg.LogSources[i].Name, "rotated.log")
+			cfg.LogSources[i].Archive = Archive{Enabled: true, Dir: "logs/archive"}
+		}
+		assert.ErrorContains(t, cfg.Validate(), "already used by log source")
+	})
+
+	t.Run("wall clock alignment", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].AlignToWallClock = true
+		cfg.LogSources[0].Timezone = "Europe/Berlin"
+		assert.NoError(t, cfg.Validate())
+		assert.Equal(t, "Europe/Berlin", cfg.LogSources[0].Location().String())
+		assert.Equal(t, time.Local, cfg.LogSources[1].Location())
+
+		cfg.LogSources[0].Timezone = "Mars/Olympus_Mons"
+		assert.ErrorContains(t, cfg.Validate(), "invalid timezone")
+
+		cfg.LogSources[0].Timezone = ""
+		cfg.LogSources[0].RotationInterval = "48h"
+		assert.ErrorContains(t, cfg.Validate(), "at most 24h")
+	})
+
+	t.Run("rotation schedule", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].RotationInterval = ""
+		cfg.LogSources[0].RotationSchedule = "0 9-18 * * MON-FRI"
+		assert.NoError(t, cfg.Validate())
+
+		cfg.LogSources[0].RotationSchedule = "*/10 * * * * *"
+		assert.ErrorContains(t, cfg.Validate(), "> 60 seconds")
+
+		cfg.LogSources[0].RotationSchedule = "0 25 * * *"
+		assert.ErrorContains(t, cfg.Validate(), "invalid rotation_schedule")
+
+		cfg.LogSources[0].RotationSchedule = "@hourly"
+		cfg.LogSources[0].RotationInterval = "1h"
+		assert.ErrorContains(t, cfg.Validate(), "cannot both be set")
+	})
+
+	t.Run("KPI matchers", func(t *testing.T) {
+		cfg := newCfg()
+		kpi := &cfg.LogSources[0].KPIs[0]
+		kpi.Exclude = []string{"HealthCheck"}
+		kpi.AnyOf = []Matcher{{Regex: "db"}, {AllOf: []Matcher{{Regex: "cache"}, {Regex: "miss"}}}}
+		assert.NoError(t, cfg.Validate())
+
+		kpi.NoneOf = []Matcher{{AnyOf: []Matcher{{}}}}
+		assert.ErrorContains(t, cfg.Validate(), "empty matcher")
+
+		kpi.NoneOf = nil
+		kpi.Exclude = []string{""}
+		assert.ErrorContains(t, cfg.Validate(), "empty exclude regex")
+	})
+
+	t.Run("KPI defined by a matcher tree", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(`
+server:
+  port: 9099
+  metrics_path: "/metrics"
+log_config:
+  source_log_file: "testdata/app.log"
+  redirect_log_file: "testdata/app_redirect.log"
+  rotated_log_file: "testdata/app_rotated.log"
+  rotation_interval: "1m"
+kpis:
+  - name: "slow_checkouts"
+    all_of:
+      - regex: "path=/checkout"
+      - regex: 'took=\d{4,}ms'
+`), 0644))
+		cfg, err := LoadCfg(path)
+		assert.NoError(t, err)
+		kpi := cfg.LogSources[0].KPIs[0]
+		assert.Empty(t, kpi.Regex)
+		assert.Len(t, kpi.AllOf, 2)
+
+		cfg.LogSources[0].KPIs[0].AllOf = nil
+		assert.ErrorContains(t, cfg.Validate(), "regex is not defined")
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].Mode = "batch"
+		assert.ErrorContains(t, cfg.Validate(), "mode must be")
+	})
+
+	t.Run("invalid KPI type", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].KPIs[0].Type = "summary"
+		assert.ErrorContains(t, cfg.Validate(), "type must be")
+	})
+
+	t.Run("negative label cardinality", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].KPIs[0].MaxLabelCardinality = -1
+		assert.ErrorContains(t, cfg.Validate(), "max_label_cardinality")
+	})
+
+	t.Run("histogram KPI", func(t *testing.T) {
+		cfg := newCfg()
+		kpi := &cfg.LogSources[0].KPIs[1]
+		kpi.Type = KPITypeHistogram
+		assert.ErrorContains(t, cfg.Validate(), "value_group is required")
+
+		kpi.ValueGroup = "took"
+		kpi.Unit = "ms"
+		kpi.Buckets = []float64{0.1, 0.5, 1}
+		assert.NoError(t, cfg.Validate())
+
+		kpi.Unit = "parsecs"
+		assert.ErrorContains(t, cfg.Validate(), "unit")
+
+		kpi.Unit = "ms"
+		kpi.Buckets = []float64{1, 0.5}
+		assert.ErrorContains(t, cfg.Validate(), "buckets")
+
+		kpi.Buckets = nil
+		kpi.NativeHistogramBucketFactor = 1
+		assert.ErrorContains(t, cfg.Validate(), "native_histogram_bucket_factor")
+	})
+
+	t.Run("KPI aggregation", func(t *testing.T) {
+		cfg := newCfg()
+		kpi := &cfg.LogSources[0].KPIs[1]
+		kpi.Aggregation = "avg"
+		assert.ErrorContains(t, cfg.Validate(), "aggregation must be")
+
+		kpi.Aggregation = AggregationMax
+		assert.ErrorContains(t, cfg.Validate(), "value_group is required")
+
+		kpi.ValueGroup = "depth"
+		assert.NoError(t, cfg.Validate())
+
+		kpi.Type = KPITypeCounter
+		assert.ErrorContains(t, cfg.Validate(), "cannot be exported as a counter")
+
+		kpi.Aggregation = AggregationSum
+		assert.NoError(t, cfg.Validate())
+	})
+
+	t.Run("KPIs sharing a name", func(t *testing.T) {
+		cfg := newCfg()
+		assert.NoError(t, cfg.Validate(), "KPIs of the same shape can share a name")
+
+		cfg.LogSources[1].KPIs[0].CustomLabels = map[string]string{"team": "web"}
+		assert.ErrorContains(t, cfg.Validate(), `log source "nginx": KPI errors exports metric errors as gauge of the count{source, team}`)
+
+		cfg = newCfg()
+		cfg.LogSources[1].KPIs[0].Regex = `" (?P<status>5\d\d) `
+		assert.ErrorContains(t, cfg.Validate(), "{source, status}")
+
+		cfg = newCfg()
+		cfg.LogSources[1].KPIs[0].Type = KPITypeBoth
+		assert.NoError(t, cfg.Validate(), "the counter has a name of its own")
+		cfg.LogSources[1].KPIs[0].Type = KPITypeHistogram
+		cfg.LogSources[1].KPIs[0].Regex = `took=(?P<took>\d+)`
+		cfg.LogSources[1].KPIs[0].ValueGroup = "took"
+		assert.ErrorContains(t, cfg.Validate(), "as histogram{source}")
+
+		cfg = newCfg()
+		cfg.LogSources[1].SourceLogFile = "testdata/nginx*.log"
+		cfg.LogSources[1].FileLabel = true
+		assert.ErrorContains(t, cfg.Validate(), "{file, source}")
+
+		cfg = newCfg()
+		cfg.LogSources[1].KPIs = append(cfg.LogSources[1].KPIs, KPI{Name: "warnings_total", Regex: "WARN"})
+		cfg.LogSources[0].KPIs[1].Type = KPITypeCounter
+		assert.ErrorContains(t, cfg.Validate(), "exports metric warnings_total as gauge of the count{source}")
+	})
+
+	t.Run("reserved source label", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.LogSources[0].KPIs[0].CustomLabels = map[string]string{SourceLabel: "x"}
+		assert.ErrorContains(t, cfg.Validate(), "reserved")
+	})
+
+	t.Run("container format", func(t *testing.T) {
+		cfg := newCfg()
+		// The container labels would set the errors KPI of app apart from
+		// that of nginx.
+		cfg.LogSources = cfg.LogSources[:1]
+		src := &cfg.LogSources[0]
+		src.Format = FormatCRI
+		src.KPIs[0].CustomLabels = map[string]string{PodLabel: "x"}
+		assert.NoError(t, cfg.Validate(), "container labels are only set on sources split by file")
+
+		src.SourceLogFile = "/var/log/pods/*/*/*.log"
+		src.FileLabel = true
+		assert.ErrorContains(t, cfg.Validate(), `custom label "pod" is reserved`)
+
+		src.KPIs[0].CustomLabels = nil
+		src.KPIs[0] = KPI{Name: "errors", Format: FormatJSON, FieldLabels: map[string]string{ContainerLabel: "c"}}
+		assert.ErrorContains(t, cfg.Validate(), `field label "container" is reserved`)
+
+		src.KPIs[0].FieldLabels = nil
+		src.Format = FormatDocker
+		assert.NoError(t, cfg.Validate())
+
+		src.Format = "json"
+		assert.ErrorContains(t, cfg.Validate(), `format must be "cri" or "docker"`)
+	})
+}
+
+func TestLogSourceForFile(t *testing.T) {
+	src := LogSource{
+		Name: "app",
+		LogCfg: LogCfg{
+			SourceLogFile:   "/var/log/app/*.log",
+			RedirectLogFile: "logs/app_redirect.log",
+			RotatedLogFile:  "logs/app_rotated.log",
+			FileLabel:       true,
+			CheckpointFile:  "state/app.json",
+		},
+	}
+
+	a := src.ForFile("/var/log/app/a.log")
+	b := src.ForFile("/var/log/app/b.log")
+	assert.Equal(t, "/var/log/app/a.log", a.SourceLogFile)
+	assert.Equal(t, "logs/app_redirect.var_log_app_a_log-9758ab72.log", a.RedirectLogFile)
+	assert.Equal(t, "logs/app_rotated.var_log_app_a_log-9758ab72.log", a.RotatedLogFile)
+	assert.Equal(t, "state/app.var_log_app_a_log-9758ab72.json", a.CheckpointFile)
+	assert.Equal(t, map[string]string{FileLabel: "/var/log/app/a.log"}, a.Labels)
+	assert.NotEqual(t, a.RotatedLogFile, b.RotatedLogFile)
+	assert.NotEqual(t, src.ForFile("/var/log/app/a.b.log").RotatedLogFile, src.ForFile("/var/log/app/a_b.log").RotatedLogFile,
+		"paths reading the same get files of their own")
+	assert.Nil(t, src.Labels)
+}
+
+func TestContainerLabels(t *testing.T) {
+	for path, want := range map[string][3]string{
+		"/var/log/pods/shop_checkout-7d9f8_0f1e2d3c-aaaa-bbbb/api/0.log":       {"shop", "checkout-7d9f8", "api"},
+		"/var/log/containers/checkout-7d9f8_shop_api-4f5e6d7c8b9a.log":         {"shop", "checkout-7d9f8", "api"},
+		"/var/log/containers/checkout-7d9f8_shop_istio-proxy-4f5e6d7c8b9a.log": {"shop", "checkout-7d9f8", "istio-proxy"},
+		"/var/lib/docker/containers/4f5e6d7c8b9a/4f5e6d7c8b9a-json.log":        {"", "", ""},
+		"/var/log/app/a.log": {"", "", ""},
+	} {
+		namespace, pod, container := containerLabels(path)
+		assert.Equal(t, want, [3]string{namespace, pod, container}, path)
+	}
+
+	src := LogSource{Name: "pods", LogCfg: LogCfg{Format: FormatCRI, FileLabel: true}}
+	assert.Equal(t, map[string]string{
+		FileLabel:      "/var/log/pods/shop_checkout_1/api/0.log",
+		NamespaceLabel: "shop",
+		PodLabel:       "checkout",
+		ContainerLabel: "api",
+	}, src.ForFile("/var/log/pods/shop_checkout_1/api/0.log").Labels)
 }
@@ -0,0 +1,68 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	// A Friday.
+	from := time.Date(2026, 10, 16, 17, 59, 30, 0, berlin)
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", from, time.Date(2026, 10, 16, 18, 0, 0, 0, berlin)},
+		{"0 9-18 * * MON-FRI", from, time.Date(2026, 10, 16, 18, 0, 0, 0, berlin)},
+		{"0 9-18 * * MON-FRI", time.Date(2026, 10, 16, 18, 0, 0, 0, berlin), time.Date(2026, 10, 19, 9, 0, 0, 0, berlin)},
+		{"0 0 9-18 * * mon-fri", from, time.Date(2026, 10, 16, 18, 0, 0, 0, berlin)},
+		{"30 */10 * * * *", from, time.Date(2026, 10, 16, 18, 0, 30, 0, berlin)},
+		{"@daily", from, time.Date(2026, 10, 17, 0, 0, 0, 0, berlin)},
+		{"0 0 * * 7", from, time.Date(2026, 10, 18, 0, 0, 0, 0, berlin)},
+		{"0 0 1 JAN *", from, time.Date(2027, 1, 1, 0, 0, 0, 0, berlin)},
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, berlin)},
+		// Either the day of month or the day of week matches.
+		{"0 0 20 * MON", from, time.Date(2026, 10, 19, 0, 0, 0, 0, berlin)},
+		// Daylight saving time ends on October 25 in Berlin.
+		{"0 3 * * *", time.Date(2026, 10, 25, 1, 0, 0, 0, berlin), time.Date(2026, 10, 25, 3, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec, berlin)
+			assert.NoError(t, err)
+			got := s.Next(tt.from)
+			assert.True(t, tt.want.Equal(got), "want %s, got %s", tt.want, got)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 25 * * *",
+		"* * * * FUNDAY",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"0 0 30 2 *",
+	} {
+		_, err := Parse(spec, time.UTC)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	s, err := Parse("0 9-18 * * MON-FRI", time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, s.MinInterval(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), 100))
+
+	s, err = Parse("*/5 * * * * *", time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, s.MinInterval(time.Now(), 100))
+}
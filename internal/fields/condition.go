@@ -0,0 +1,247 @@
+package fields
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Condition is a test on one field of a record, such as level == "error",
+// http.status >= 500 or service in [api, web].
+type Condition struct {
+	Path   string
+	op     string
+	values []any
+	number float64
+	re     *regexp.Regexp
+}
+
+// Condition operators besides the comparisons. A bare path tests that the
+// field exists and !path that it does not.
+const (
+	opExists  = "exists"
+	opMissing = "missing"
+	opIn      = "in"
+	opNotIn   = "not in"
+)
+
+// comparisons are tried in order, so two character operators come first.
+var comparisons = []string{"==", "!=", "<=", ">=", "=~", "!~", "<", ">"}
+
+// ParseCondition parses a condition of the form <path> <op> <value>, where
+// op is ==, !=, <, <=, >, >=, =~ (regex match), !~, in or not in followed
+// by a list such as [a, "b c"]. Values are numbers, true, false, null or
+// strings, quoted or not. Numbers may carry a unit as in dur > 500ms.
+func ParseCondition(expr string) (*Condition, error) {
+	c := &Condition{}
+	rest := strings.TrimSpace(expr)
+	if strings.HasPrefix(rest, "!") && !strings.ContainsAny(rest[1:], " =!<>~") {
+		c.Path, c.op = rest[1:], opMissing
+	} else {
+		end := strings.IndexAny(rest, " =!<>~")
+		if end < 0 {
+			end = len(rest)
+		}
+		c.Path, rest = rest[:end], strings.TrimSpace(rest[end:])
+		if err := c.parseOp(rest); err != nil {
+			return nil, fmt.Errorf("condition %q: %w", expr, err)
+		}
+	}
+	if c.Path == "" {
+		return nil, fmt.Errorf("condition %q: missing field path", expr)
+	}
+	return c, nil
+}
+
+func (c *Condition) parseOp(rest string) error {
+	if rest == "" {
+		c.op = opExists
+		return nil
+	}
+	for _, op := range comparisons {
+		if strings.HasPrefix(rest, op) {
+			c.op = op
+			return c.parseValue(strings.TrimSpace(rest[len(op):]))
+		}
+	}
+	for _, op := range []string{opNotIn, opIn} {
+		if after, ok := strings.CutPrefix(rest, op); ok && (after == "" || after[0] == ' ' || after[0] == '[') {
+			c.op = op
+			values, err := parseList(strings.TrimSpace(after))
+			if err != nil {
+				return err
+			}
+			c.values = values
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operator in %q", rest)
+}
+
+func (c *Condition) parseValue(text string) error {
+	v, rest, err := parseLiteral(text, "")
+	if err != nil {
+		return err
+	}
+	if rest != "" {
+		return fmt.Errorf("unexpected %q after value", rest)
+	}
+	c.values = []any{v}
+
+	switch c.op {
+	case "=~", "!~":
+		re, err := regexp.Compile(String(v))
+		if err != nil {
+			return err
+		}
+		c.re = re
+	case "<", "<=", ">", ">=":
+		if c.number, err = Number(v, ""); err != nil {
+			return fmt.Errorf("%s needs a number: %w", c.op, err)
+		}
+	}
+	return nil
+}
+
+// parseList parses a bracketed list of literals.
+func parseList(text string) ([]any, error) {
+	if !strings.HasPrefix(text, "[") {
+		return nil, fmt.Errorf("expected a list such as [a, b]")
+	}
+	rest := strings.TrimSpace(text[1:])
+	var values []any
+	for !strings.HasPrefix(rest, "]") {
+		v, after, err := parseLiteral(rest, ",]")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in list")
+		}
+	}
+	if rest = strings.TrimSpace(rest[1:]); rest != "" {
+		return nil, fmt.Errorf("unexpected %q after list", rest)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty list")
+	}
+	return values, nil
+}
+
+// parseLiteral parses the value at the start of text. An unquoted value
+// ends at one of stop or at the end of text.
+func parseLiteral(text, stop string) (any, string, error) {
+	if text == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	if q := text[0]; q == '"' || q == '\'' {
+		for i := 1; i < len(text); i++ {
+			switch text[i] {
+			case '\\':
+				i++
+			case q:
+				s, err := unquote(text[:i+1])
+				return s, text[i+1:], err
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string %s", text)
+	}
+
+	end := len(text)
+	if i := strings.IndexAny(text, stop); i >= 0 {
+		end = i
+	}
+	word := strings.TrimSpace(text[:end])
+	switch word {
+	case "":
+		return nil, "", fmt.Errorf("missing value")
+	case "true", "false":
+		return word == "true", text[end:], nil
+	case "null":
+		return nil, text[end:], nil
+	}
+	if strings.ContainsAny(word, " \t") {
+		return nil, "", fmt.Errorf("quote the value %q", word)
+	}
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		return n, text[end:], nil
+	}
+	return word, text[end:], nil
+}
+
+func unquote(quoted string) (string, error) {
+	if quoted[0] == '\'' {
+		s := quoted[1 : len(quoted)-1]
+		s = strings.ReplaceAll(s, `\'`, `'`)
+		return strings.ReplaceAll(s, `\\`, `\`), nil
+	}
+	return strconv.Unquote(quoted)
+}
+
+// Match reports whether the field of r at the condition path satisfies
+// it. Every comparison fails when the field is missing.
+func (c *Condition) Match(r Record) bool {
+	v, ok := r.Lookup(c.Path)
+	switch c.op {
+	case opExists:
+		return ok
+	case opMissing:
+		return !ok
+	}
+	if !ok {
+		return false
+	}
+
+	switch c.op {
+	case "==":
+		return equal(v, c.values[0])
+	case "!=":
+		return !equal(v, c.values[0])
+	case "=~":
+		return c.re.MatchString(String(v))
+	case "!~":
+		return !c.re.MatchString(String(v))
+	case opIn, opNotIn:
+		found := false
+		for _, want := range c.values {
+			if equal(v, want) {
+				found = true
+				break
+			}
+		}
+		return found == (c.op == opIn)
+	}
+
+	n, err := Number(v, "")
+	if err != nil {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return n < c.number
+	case "<=":
+		return n <= c.number
+	case ">":
+		return n > c.number
+	default:
+		return n >= c.number
+	}
+}
+
+// equal compares a field value with a literal: numerically for numbers,
+// as text otherwise.
+func equal(v, literal any) bool {
+	switch l := literal.(type) {
+	case nil:
+		return v == nil
+	case float64:
+		n, err := Number(v, "")
+		return err == nil && n == l
+	}
+	return v != nil && String(v) == String(literal)
+}
@@ -0,0 +1,108 @@
+// Package fields reads the fields of structured log lines and evaluates
+// conditions on them.
+package fields
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/akmanon/kpi-metricsd/internal/units"
+)
+
+// Record is a parsed structured log line.
+type Record interface {
+	// Lookup returns the value at a dotted path such as http.status.
+	Lookup(path string) (any, bool)
+}
+
+type jsonRecord map[string]any
+
+// ParseJSON parses a line holding a JSON object. Numbers are kept as
+// json.Number so that large integers used as labels keep every digit.
+func ParseJSON(line []byte) (Record, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	return jsonRecord(obj), nil
+}
+
+// Lookup walks path through nested objects and arrays. A key containing
+// dots, such as "http.status" itself, is found before nested objects.
+func (r jsonRecord) Lookup(path string) (any, bool) {
+	return lookup(map[string]any(r), path)
+}
+
+func lookup(v any, path string) (any, bool) {
+	switch node := v.(type) {
+	case map[string]any:
+		if child, ok := node[path]; ok {
+			return child, true
+		}
+		for i := 0; i < len(path); i++ {
+			if path[i] != '.' {
+				continue
+			}
+			if child, ok := node[path[:i]]; ok {
+				if found, ok := lookup(child, path[i+1:]); ok {
+					return found, true
+				}
+			}
+		}
+	case []any:
+		head, rest, nested := strings.Cut(path, ".")
+		i, err := strconv.Atoi(head)
+		if err != nil || i < 0 || i >= len(node) {
+			return nil, false
+		}
+		if !nested {
+			return node[i], true
+		}
+		return lookup(node[i], rest)
+	}
+	return nil, false
+}
+
+// String formats a field value as a label value. Objects and arrays are
+// formatted as JSON and null as an empty string.
+func String(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Number converts a field value to a number. Strings may carry a unit, as
+// in 1.2s or 512KiB, and unit applies to values without one.
+func Number(v any, unit string) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return units.Parse(v.String(), unit)
+	case float64:
+		return units.Parse(strconv.FormatFloat(v, 'f', -1, 64), unit)
+	case string:
+		return units.Parse(v, unit)
+	}
+	return 0, fmt.Errorf("%s is not a number", String(v))
+}
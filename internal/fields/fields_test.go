@@ -0,0 +1,137 @@
+package fields
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSON(t *testing.T) {
+	r, err := ParseJSON([]byte(`{"level":"error","http":{"status":503,"path":"/api"},"tags":["a",{"k":"v"}],"user.id":12345678901234567890,"ok":true,"none":null}`))
+	assert.NoError(t, err)
+
+	for path, want := range map[string]string{
+		"level":       "error",
+		"http.status": "503",
+		"http.path":   "/api",
+		"tags.0":      "a",
+		"tags.1.k":    "v",
+		"tags":        `["a",{"k":"v"}]`,
+		"user.id":     "12345678901234567890",
+		"ok":          "true",
+		"none":        "",
+	} {
+		v, ok := r.Lookup(path)
+		assert.True(t, ok, path)
+		assert.Equal(t, want, String(v), path)
+	}
+	for _, path := range []string{"missing", "http.missing", "tags.2", "level.x"} {
+		_, ok := r.Lookup(path)
+		assert.False(t, ok, path)
+	}
+
+	for _, line := range []string{"", "not json", "[1,2]", "null", `{"a":`} {
+		_, err := ParseJSON([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestCondition(t *testing.T) {
+	r, err := ParseJSON([]byte(`{"level":"error","service":"api","msg":"db timeout","http":{"status":503},"took":"1.5s","ok":false,"none":null}`))
+	assert.NoError(t, err)
+
+	for expr, want := range map[string]bool{
+		`level == "error"`:            true,
+		`level == 'error'`:            true,
+		`level == error`:              true,
+		`level=="warn"`:               false,
+		`level != "warn"`:             true,
+		`http.status >= 500`:          true,
+		`http.status < 500`:           false,
+		`http.status == 503`:          true,
+		`http.status == "503"`:        true,
+		`took > 500ms`:                true,
+		`took <= 1s`:                  false,
+		`service in [api, "web"]`:     true,
+		`service in ["web", worker]`:  false,
+		`service not in [web]`:        true,
+		`msg =~ "time(out)?"`:         true,
+		`msg !~ "^db"`:                false,
+		`ok == false`:                 true,
+		`none == null`:                true,
+		`level == null`:               false,
+		`http.status`:                 true,
+		`trace_id`:                    false,
+		`!trace_id`:                   true,
+		`!level`:                      false,
+		`trace_id != "x"`:             false,
+		`trace_id not in [x]`:         false,
+		`msg > 5`:                     false,
+		`msg in ["db timeout", x, y]`: true,
+	} {
+		c, err := ParseCondition(expr)
+		if assert.NoError(t, err, expr) {
+			assert.Equal(t, want, c.Match(r), expr)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"== 5",
+		"level ~= x",
+		"level ==",
+		`level == "error`,
+		"level == a b",
+		"status > high",
+		"msg =~ (",
+		"service in api",
+		"service in []",
+		"service in [a b]",
+		"service in [a] x",
+	} {
+		_, err := ParseCondition(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	r, err := ParseLogfmt([]byte(`ts=2026-10-16T10:00:00Z level=warn msg="slow \"db\" query\n" dur=1.2s http.status=503 debug empty= query=a=b level=error  path="/a b"`))
+	assert.NoError(t, err)
+
+	for path, want := range map[string]string{
+		"level":       "error",
+		"msg":         "slow \"db\" query\n",
+		"dur":         "1.2s",
+		"http.status": "503",
+		"debug":       "",
+		"empty":       "",
+		"query":       "a=b",
+		"path":        "/a b",
+	} {
+		v, ok := r.Lookup(path)
+		assert.True(t, ok, path)
+		assert.Equal(t, want, String(v), path)
+	}
+	_, ok := r.Lookup("http")
+	assert.False(t, ok)
+
+	c, err := ParseCondition("dur > 1s")
+	assert.NoError(t, err)
+	assert.True(t, c.Match(r))
+
+	for _, line := range []string{
+		"",
+		"plain text without pairs",
+		`msg="unterminated`,
+		`msg="bad \q escape"`,
+		`=value`,
+		`msg="a"b`,
+		`key"x=1`,
+		`msg=a"b`,
+	} {
+		_, err := ParseLogfmt([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
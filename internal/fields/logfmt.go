@@ -0,0 +1,91 @@
+package fields
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type logfmtRecord map[string]string
+
+// ParseLogfmt parses a logfmt line such as level=warn msg="slow query"
+// dur=1.2s. Quoted values use Go escapes. A key without a value holds an
+// empty string, and the last value of a repeated key wins. Unquoted values
+// may contain =, as in query=a=b. Keys are not split on dots, so
+// http.status is a key of its own.
+func ParseLogfmt(line []byte) (Record, error) {
+	r := make(logfmtRecord)
+	pairs := 0
+	i := 0
+	for i < len(line) {
+		if line[i] <= ' ' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		key := string(line[start:i])
+		if key == "" {
+			return nil, fmt.Errorf("unexpected %q at offset %d", line[i], i)
+		}
+		if i == len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil, fmt.Errorf("unexpected quote in key %s", key)
+			}
+			r[key] = ""
+			continue
+		}
+		i++
+		pairs++
+
+		if i < len(line) && line[i] == '"' {
+			end, err := quotedEnd(line, i)
+			if err != nil {
+				return nil, fmt.Errorf("value of %s: %w", key, err)
+			}
+			value, err := strconv.Unquote(string(line[i:end]))
+			if err != nil {
+				return nil, fmt.Errorf("value of %s: %w", key, err)
+			}
+			r[key] = value
+			i = end
+			if i < len(line) && line[i] > ' ' {
+				return nil, fmt.Errorf("unexpected %q after value of %s", line[i], key)
+			}
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] > ' ' {
+			if line[i] == '"' {
+				return nil, fmt.Errorf("unexpected %q in value of %s", line[i], key)
+			}
+			i++
+		}
+		r[key] = string(line[start:i])
+	}
+	if pairs == 0 {
+		return nil, fmt.Errorf("no key=value pairs")
+	}
+	return r, nil
+}
+
+// quotedEnd returns the offset following the quoted string starting at
+// start.
+func quotedEnd(line []byte, start int) (int, error) {
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted value")
+}
+
+func (r logfmtRecord) Lookup(path string) (any, bool) {
+	v, ok := r[path]
+	return v, ok
+}
@@ -0,0 +1,137 @@
+// Package grok expands grok expressions such as %{IP:client} into RE2
+// regular expressions.
+package grok
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Library maps pattern names to their definitions.
+type Library struct {
+	patterns map[string]string
+}
+
+var (
+	referenceRe = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(\w+))?\}`)
+	nameRe      = regexp.MustCompile(`^\w+$`)
+	invalidRe   = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// New returns a library holding the built-in patterns, which cover common
+// values, timestamps, syslog and Apache and nginx logs.
+func New() *Library {
+	l := &Library{patterns: make(map[string]string)}
+	if err := l.parse(strings.NewReader(builtin), "built-in patterns"); err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Add defines the pattern name, replacing any previous definition.
+func (l *Library) Add(name, pattern string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("invalid pattern name %q", name)
+	}
+	l.patterns[name] = pattern
+	return nil
+}
+
+// AddFile reads patterns from a file of NAME PATTERN lines, in the format
+// of Logstash pattern files. Blank lines and lines starting with # are
+// ignored.
+func (l *Library) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open grok pattern file %w", err)
+	}
+	defer f.Close()
+	return l.parse(f, path)
+}
+
+func (l *Library) parse(r io.Reader, source string) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, ok := strings.Cut(line, " ")
+		if !ok || strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("%s:%d: expected NAME PATTERN", source, n)
+		}
+		if err := l.Add(name, strings.TrimSpace(pattern)); err != nil {
+			return fmt.Errorf("%s:%d: %w", source, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Expand replaces every %{NAME}, %{NAME:field} and %{NAME:field:type}
+// reference of expr by the pattern it names, recursively. Named fields
+// become named capture groups, with characters that are not letters,
+// digits or underscores replaced, so client.ip is captured as client_ip.
+// The type suffix of Logstash is accepted and ignored, as KPI values are
+// always numbers.
+func (l *Library) Expand(expr string) (string, error) {
+	fields := make(map[string]bool)
+	re, err := l.expand(expr, nil, fields)
+	if err != nil {
+		return "", err
+	}
+	if _, err := regexp.Compile(re); err != nil {
+		return "", fmt.Errorf("expands to an invalid regex: %w", err)
+	}
+	return re, nil
+}
+
+func (l *Library) expand(expr string, stack []string, fields map[string]bool) (string, error) {
+	var b strings.Builder
+	last := 0
+	for _, loc := range referenceRe.FindAllStringSubmatchIndex(expr, -1) {
+		b.WriteString(expr[last:loc[0]])
+		last = loc[1]
+
+		name := expr[loc[2]:loc[3]]
+		pattern, ok := l.patterns[name]
+		if !ok {
+			return "", fmt.Errorf("unknown grok pattern %s", name)
+		}
+		for _, outer := range stack {
+			if outer == name {
+				return "", fmt.Errorf("grok pattern %s refers to itself", name)
+			}
+		}
+		if loc[6] >= 0 {
+			switch typ := expr[loc[6]:loc[7]]; typ {
+			case "int", "float", "string":
+			default:
+				return "", fmt.Errorf("unknown type %s in %s", typ, expr[loc[0]:loc[1]])
+			}
+		}
+		inner, err := l.expand(pattern, append(stack, name), fields)
+		if err != nil {
+			return "", err
+		}
+
+		if loc[4] < 0 {
+			b.WriteString("(?:" + inner + ")")
+			continue
+		}
+		field := strings.Trim(invalidRe.ReplaceAllString(expr[loc[4]:loc[5]], "_"), "_")
+		if field == "" {
+			return "", fmt.Errorf("invalid field name in %s", expr[loc[0]:loc[1]])
+		}
+		if fields[field] {
+			return "", fmt.Errorf("field %s is captured twice", field)
+		}
+		fields[field] = true
+		b.WriteString("(?P<" + field + ">" + inner + ")")
+	}
+	b.WriteString(expr[last:])
+	return b.String(), nil
+}
@@ -0,0 +1,95 @@
+package grok
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinPatterns(t *testing.T) {
+	lib := New()
+	for name := range lib.patterns {
+		_, err := lib.Expand("%{" + name + "}")
+		assert.NoError(t, err, name)
+	}
+
+	for expr, lines := range map[string][]string{
+		`^%{IP}$`:                {"10.0.0.1", "2001:db8::1", "::1", "fe80::1%eth0"},
+		`^%{TIMESTAMP_ISO8601}$`: {"2024-05-01T12:00:00Z", "2024-05-01 12:00:00.123+02:00"},
+		`^%{URI}$`:               {"https://user@example.com:8443/a/b?x=1&y=2"},
+		`^%{LOGLEVEL}$`:          {"INFO", "warning", "Error"},
+		`^%{UUID}$`:              {"123e4567-e89b-12d3-a456-426614174000"},
+	} {
+		pattern, err := lib.Expand(expr)
+		assert.NoError(t, err, expr)
+		re := regexp.MustCompile(pattern)
+		for _, line := range lines {
+			assert.True(t, re.MatchString(line), "%s should match %s", expr, line)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	lib := New()
+
+	t.Run("fields", func(t *testing.T) {
+		pattern, err := lib.Expand(`%{COMBINEDAPACHELOG}`)
+		assert.NoError(t, err)
+		re := regexp.MustCompile(pattern)
+		sub := re.FindStringSubmatch(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://example.com/" "Mozilla/5.0"`)
+		assert.NotNil(t, sub)
+		for field, want := range map[string]string{
+			"clientip": "127.0.0.1",
+			"auth":     "frank",
+			"verb":     "GET",
+			"request":  "/apache_pb.gif",
+			"response": "200",
+			"bytes":    "2326",
+			"agent":    `"Mozilla/5.0"`,
+		} {
+			assert.Equal(t, want, sub[re.SubexpIndex(field)], field)
+		}
+	})
+
+	t.Run("field names", func(t *testing.T) {
+		pattern, err := lib.Expand(`%{IP:[client][ip]} %{INT:http.status:int}`)
+		assert.NoError(t, err)
+		re := regexp.MustCompile(pattern)
+		assert.Equal(t, []string{"", "client_ip", "http_status"}, re.SubexpNames())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for expr, msg := range map[string]string{
+			`%{MISSING}`:                    "unknown grok pattern MISSING",
+			`%{IP:a} %{IP:a}`:               "field a is captured twice",
+			`%{INT:n:long}`:                 "unknown type long",
+			`%{INT:!!}`:                     "invalid field name",
+			`%{INT} (`:                      "invalid regex",
+			`%{SYSLOGLINE} %{PROG:program}`: "field program is captured twice",
+		} {
+			_, err := lib.Expand(expr)
+			assert.ErrorContains(t, err, msg, expr)
+		}
+	})
+
+	t.Run("pattern files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "patterns")
+		assert.NoError(t, os.WriteFile(path, []byte("# latency\n\nMS %{NUMBER}ms\nLOOP_A %{LOOP_B}\nLOOP_B x%{LOOP_A}\n"), 0o644))
+		lib := New()
+		assert.NoError(t, lib.AddFile(path))
+
+		pattern, err := lib.Expand(`took %{MS:took}`)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.5ms", regexp.MustCompile(pattern).FindStringSubmatch("took 1.5ms")[1])
+
+		_, err = lib.Expand(`%{LOOP_A}`)
+		assert.ErrorContains(t, err, "refers to itself")
+
+		assert.NoError(t, os.WriteFile(path, []byte("BROKEN\n"), 0o644))
+		assert.ErrorContains(t, lib.AddFile(path), path+":1: expected NAME PATTERN")
+		assert.Error(t, lib.AddFile(filepath.Join(t.TempDir(), "missing")))
+	})
+}
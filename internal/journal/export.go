@@ -0,0 +1,121 @@
+// Package journal reads systemd journal entries in the export format, from
+// journalctl or from an exported file.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Entry maps the fields of a journal entry, such as MESSAGE, PRIORITY and
+// _SYSTEMD_UNIT, to their values.
+type Entry map[string]string
+
+// CursorField holds the cursor of an entry, which journalctl resumes after.
+const CursorField = "__CURSOR"
+
+// maxFieldSize bounds the binary fields kept in an entry. Larger fields,
+// such as core dumps, are skipped.
+const maxFieldSize = 1 << 20
+
+// Decoder reads entries in the export format: fields of the form
+// NAME=value, one per line, or NAME, a newline, the little-endian 64 bit
+// size of a binary value and the value followed by a newline. An empty
+// line ends an entry.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next entry, or io.EOF at the end of the input. An entry
+// cut in the middle of a field returns io.ErrUnexpectedEOF.
+func (d *Decoder) Next() (Entry, error) {
+	var e Entry
+	for {
+		line, err := d.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// A text field longer than the buffer.
+			line, err = d.readLong(line)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if len(line) > 0 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				if e != nil {
+					return e, nil
+				}
+			}
+			return nil, err
+		}
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			if e == nil {
+				continue
+			}
+			return e, nil
+		}
+		if e == nil {
+			e = make(Entry)
+		}
+		if name, value, ok := bytes.Cut(line, []byte("=")); ok {
+			e[string(name)] = string(value)
+			continue
+		}
+		name := string(line)
+		value, err := d.readBinary(name)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if value != nil {
+			e[name] = string(value)
+		}
+	}
+}
+
+func (d *Decoder) readLong(start []byte) ([]byte, error) {
+	line := bytes.Clone(start)
+	for {
+		more, err := d.r.ReadSlice('\n')
+		line = append(line, more...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// readBinary reads the value of a binary field, or skips it and returns nil
+// when it is larger than maxFieldSize.
+func (d *Decoder) readBinary(name string) ([]byte, error) {
+	var size uint64
+	if err := binary.Read(d.r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	var value []byte
+	if size > maxFieldSize {
+		if _, err := io.CopyN(io.Discard, d.r, int64(size)); err != nil {
+			return nil, err
+		}
+	} else {
+		value = make([]byte, size)
+		if _, err := io.ReadFull(d.r, value); err != nil {
+			return nil, err
+		}
+	}
+	if b, err := d.r.ReadByte(); err != nil {
+		return nil, err
+	} else if b != '\n' {
+		return nil, fmt.Errorf("field %s: missing newline after binary value", name)
+	}
+	return value, nil
+}
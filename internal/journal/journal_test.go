@@ -0,0 +1,171 @@
+package journal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logtail"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// binaryField encodes a field the way journalctl exports values holding
+// newlines or control characters.
+func binaryField(name, value string) string {
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(value)))
+	return name + "\n" + string(size) + value + "\n"
+}
+
+func exportEntry(cursor, unit, message string) string {
+	return "__CURSOR=" + cursor + "\n_SYSTEMD_UNIT=" + unit + "\nPRIORITY=3\nMESSAGE=" + message + "\n\n"
+}
+
+func TestDecoder(t *testing.T) {
+	t.Run("text and binary fields", func(t *testing.T) {
+		input := "__CURSOR=s=1;i=1\nMESSAGE=started\nPRIORITY=6\n\n" +
+			"__CURSOR=s=1;i=2\n" + binaryField("MESSAGE", "panic\ngoroutine 1") + "_HOSTNAME=web1\n" +
+			binaryField("COREDUMP", strings.Repeat("x", maxFieldSize+1)) + "\n" +
+			"\n__CURSOR=s=1;i=3\nMESSAGE=a=b\n"
+		d := NewDecoder(strings.NewReader(input))
+
+		e, err := d.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, Entry{"__CURSOR": "s=1;i=1", "MESSAGE": "started", "PRIORITY": "6"}, e)
+		e, err = d.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, Entry{"__CURSOR": "s=1;i=2", "MESSAGE": "panic\ngoroutine 1", "_HOSTNAME": "web1"}, e, "binary fields over the limit are skipped")
+		e, err = d.Next()
+		assert.NoError(t, err, "the last entry may end without an empty line")
+		assert.Equal(t, Entry{"__CURSOR": "s=1;i=3", "MESSAGE": "a=b"}, e)
+		_, err = d.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("long text field", func(t *testing.T) {
+		long := strings.Repeat("y", 100*1024)
+		e, err := NewDecoder(strings.NewReader("MESSAGE=" + long + "\n\n")).Next()
+		assert.NoError(t, err)
+		assert.Equal(t, long, e["MESSAGE"])
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, input := range []string{
+			"MESSAGE=cut",
+			"__CURSOR=c\n" + binaryField("MESSAGE", "cut")[:12],
+		} {
+			_, err := NewDecoder(strings.NewReader(input)).Next()
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF, input)
+		}
+		_, err := NewDecoder(strings.NewReader("MESSAGE\n\x01\x00\x00\x00\x00\x00\x00\x00xy")).Next()
+		assert.ErrorContains(t, err, "missing newline after binary value")
+	})
+}
+
+// collect runs r to its end and returns the MESSAGE of every line emitted.
+func collect(t *testing.T, r *Reader) []string {
+	var messages []string
+	err := r.Run(context.Background(), func(line []byte) error {
+		var e Entry
+		assert.NoError(t, json.Unmarshal(line, &e))
+		messages = append(messages, e["MESSAGE"])
+		return nil
+	})
+	assert.ErrorIs(t, err, logtail.ErrEndOfInput)
+	return messages
+}
+
+func TestReaderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.export")
+	assert.NoError(t, os.WriteFile(path, []byte(
+		exportEntry("c1", "nginx.service", "one")+exportEntry("c2", "nginx.service", "two")+exportEntry("c3", "sshd.service", "three")), 0644))
+	cfg := config.Journal{File: path}
+
+	r := NewReader(cfg, false, zap.NewNop())
+	assert.Equal(t, []string{"one", "two", "three"}, collect(t, r))
+	assert.Equal(t, "c3", r.Position())
+
+	t.Run("resumes after the cursor", func(t *testing.T) {
+		r := NewReader(cfg, false, zap.NewNop())
+		r.Resume("c1")
+		assert.Equal(t, []string{"two", "three"}, collect(t, r))
+		assert.Equal(t, "c3", r.Position())
+	})
+
+	t.Run("reads all entries when the cursor is not found", func(t *testing.T) {
+		r := NewReader(cfg, false, zap.NewNop())
+		r.Resume("other")
+		assert.Equal(t, []string{"one", "two", "three"}, collect(t, r))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		r := NewReader(config.Journal{File: filepath.Join(t.TempDir(), "missing")}, false, zap.NewNop())
+		assert.ErrorContains(t, r.Run(context.Background(), func([]byte) error { return nil }), "failed to open journal file")
+	})
+}
+
+func TestReaderFollow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake journalctl is a shell script")
+	}
+	dir := t.TempDir()
+	export := filepath.Join(dir, "journal.export")
+	assert.NoError(t, os.WriteFile(export, []byte(exportEntry("c1", "nginx.service", "one")+exportEntry("c2", "nginx.service", "two")), 0644))
+	// The fake journalctl records its arguments, prints the journal and
+	// exits, so the reader restarts it.
+	argsFile := filepath.Join(dir, "args")
+	command := filepath.Join(dir, "journalctl")
+	assert.NoError(t, os.WriteFile(command, []byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\ncat "+export+"\n"), 0755))
+
+	r := NewReader(config.Journal{Unit: "nginx.service"}, false, zap.NewNop())
+	r.command, r.restartDelay = command, 10*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines := make(chan []byte)
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, func(line []byte) error {
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+
+	for _, want := range []string{"one", "two", "one", "two"} {
+		select {
+		case line := <-lines:
+			var e Entry
+			assert.NoError(t, json.Unmarshal(line, &e))
+			assert.Equal(t, want, e["MESSAGE"])
+			assert.Equal(t, "nginx.service", e["_SYSTEMD_UNIT"])
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive entry %q", want)
+		}
+	}
+	cancel()
+	assert.NoError(t, <-done)
+
+	args, err := os.ReadFile(argsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"--output=export --follow --lines=0 --unit=nginx.service",
+		"--output=export --follow --after-cursor=c2 --unit=nginx.service",
+	}, strings.Split(strings.TrimSpace(string(args)), "\n")[:2], "journalctl resumes after the last entry read")
+}
+
+func TestReaderArgs(t *testing.T) {
+	r := NewReader(config.Journal{Directory: "/var/log/journal/remote"}, true, zap.NewNop())
+	assert.Equal(t, []string{"--output=export", "--follow", "--lines=all", "--directory=/var/log/journal/remote"}, r.args(""))
+	assert.Equal(t, []string{"--output=export", "--follow", "--after-cursor=c1", "--directory=/var/log/journal/remote"}, r.args("c1"))
+}
@@ -0,0 +1,242 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logtail"
+	"go.uber.org/zap"
+)
+
+// restartDelay is how long the reader waits before starting journalctl
+// again after it exited.
+const restartDelay = 5 * time.Second
+
+// Reader hands every journal entry to the pipeline of its source as a line
+// holding the entry as a JSON object. It follows the journal with
+// journalctl, or reads an exported file to its end.
+type Reader struct {
+	cfg           config.Journal
+	fromBeginning bool
+	logger        *zap.Logger
+
+	// command runs journalctl, replaced in tests.
+	command      string
+	restartDelay time.Duration
+
+	mu     sync.Mutex
+	cursor string
+}
+
+// NewReader returns a reader of the journal set by cfg. Without a cursor to
+// resume after, journalctl starts at the first entry when fromBeginning is
+// set and after the last one otherwise.
+func NewReader(cfg config.Journal, fromBeginning bool, logger *zap.Logger) *Reader {
+	return &Reader{
+		cfg:           cfg,
+		fromBeginning: fromBeginning,
+		logger:        logger,
+		command:       "journalctl",
+		restartDelay:  restartDelay,
+	}
+}
+
+// Position returns the cursor of the last entry emitted.
+func (r *Reader) Position() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cursor
+}
+
+// Resume makes Run start after the entry at cursor.
+func (r *Reader) Resume(cursor string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cursor = cursor
+}
+
+// Run emits the entries of the journal until ctx is cancelled. An exported
+// file returns logtail.ErrEndOfInput at its end, while journalctl is
+// started again whenever it exits.
+func (r *Reader) Run(ctx context.Context, emit func([]byte) error) error {
+	if r.cfg.File != "" {
+		if err := r.readFile(ctx, emit); err != nil || ctx.Err() != nil {
+			return err
+		}
+		r.logger.Info("end of journal file", zap.String("file", r.cfg.File))
+		return logtail.ErrEndOfInput
+	}
+	for {
+		err := r.follow(ctx, emit)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var emitErr emitError
+		if errors.As(err, &emitErr) {
+			return emitErr.err
+		}
+		r.logger.Warn("journalctl exited, restarting", zap.Error(err), zap.Duration("delay", r.restartDelay))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.restartDelay):
+		}
+	}
+}
+
+// emitError is a failure of emit, which stops the reader instead of
+// restarting journalctl.
+type emitError struct {
+	err error
+}
+
+func (e emitError) Error() string {
+	return e.err.Error()
+}
+
+// args returns the arguments journalctl follows the journal with, starting
+// after cursor when it is set.
+func (r *Reader) args(cursor string) []string {
+	args := []string{"--output=export", "--follow"}
+	switch {
+	case cursor != "":
+		args = append(args, "--after-cursor="+cursor)
+	case r.fromBeginning:
+		args = append(args, "--lines=all")
+	default:
+		args = append(args, "--lines=0")
+	}
+	if r.cfg.Directory != "" {
+		args = append(args, "--directory="+r.cfg.Directory)
+	}
+	if r.cfg.Unit != "" {
+		args = append(args, "--unit="+r.cfg.Unit)
+	}
+	return args
+}
+
+func (r *Reader) follow(ctx context.Context, emit func([]byte) error) error {
+	cmd := exec.CommandContext(ctx, r.command, r.args(r.Position())...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s %w", r.command, err)
+	}
+	r.logger.Info("following the journal", zap.Strings("args", cmd.Args[1:]))
+	readErr := r.emitEntries(ctx, NewDecoder(stdout), "", emit)
+	if readErr != nil {
+		// Unblock journalctl writing to a pipe no longer read.
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	var emitErr emitError
+	switch {
+	case errors.As(readErr, &emitErr):
+		return readErr
+	case stderr.Len() > 0:
+		return fmt.Errorf("%s: %s", r.command, strings.TrimSpace(stderr.String()))
+	case waitErr != nil:
+		return waitErr
+	case readErr != nil:
+		return readErr
+	}
+	return fmt.Errorf("%s exited", r.command)
+}
+
+// readFile emits the entries of the exported file after the cursor the
+// reader resumes after, or all of them when the file does not hold it.
+func (r *Reader) readFile(ctx context.Context, emit func([]byte) error) error {
+	after := r.Position()
+	if after != "" {
+		found, err := r.fileHolds(after)
+		if err != nil {
+			return err
+		}
+		if !found {
+			r.logger.Warn("cursor not found in journal file, reading it from the start", zap.String("cursor", after))
+			after = ""
+		}
+	}
+	f, err := os.Open(r.cfg.File)
+	if err != nil {
+		return fmt.Errorf("failed to open journal file %w", err)
+	}
+	defer f.Close()
+	err = r.emitEntries(ctx, NewDecoder(f), after, emit)
+	var emitErr emitError
+	switch {
+	case errors.As(err, &emitErr):
+		return emitErr.err
+	case err != nil:
+		return fmt.Errorf("failed to read journal file %w", err)
+	}
+	return nil
+}
+
+func (r *Reader) fileHolds(cursor string) (bool, error) {
+	f, err := os.Open(r.cfg.File)
+	if err != nil {
+		return false, fmt.Errorf("failed to open journal file %w", err)
+	}
+	defer f.Close()
+	d := NewDecoder(f)
+	for {
+		e, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read journal file %w", err)
+		}
+		if e[CursorField] == cursor {
+			return true, nil
+		}
+	}
+}
+
+// emitEntries emits every entry of d as a JSON object, skipping the entries
+// up to the one at cursor after when it is set, and records the cursor of
+// every entry emitted. It returns nil at the end of d or once ctx is
+// cancelled, and an emitError when emit fails.
+func (r *Reader) emitEntries(ctx context.Context, d *Decoder, after string, emit func([]byte) error) error {
+	for ctx.Err() == nil {
+		e, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if after != "" {
+			if e[CursorField] == after {
+				after = ""
+			}
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := emit(line); err != nil {
+			return emitError{err}
+		}
+		if cursor, ok := e[CursorField]; ok {
+			r.Resume(cursor)
+		}
+	}
+	return nil
+}
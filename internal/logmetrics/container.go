@@ -0,0 +1,148 @@
+package logmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxContainerMessage bounds a message joined from partial lines, as
+// bufio.Scanner bounds the lines of rotated files.
+const maxContainerMessage = 1024 * 1024
+
+// containerLog unwraps the lines container runtimes write, in the CRI or
+// Docker json-file format, into the messages logged by the container, and
+// joins the partial lines runtimes split long messages into. Lines that are
+// not in the format are passed on whole.
+type containerLog struct {
+	format string
+	parse  func(line []byte) (containerLine, error)
+	// partial holds, by stream, the start of a message split into partial
+	// lines.
+	partial     map[string][]byte
+	parseErrors *prometheus.CounterVec
+}
+
+type containerLine struct {
+	stream  string
+	message []byte
+	// partial is set when the message continues on the next line of the
+	// stream.
+	partial bool
+}
+
+func newContainerLog(format string, parseErrors *prometheus.CounterVec) *containerLog {
+	c := &containerLog{format: format, partial: make(map[string][]byte), parseErrors: parseErrors}
+	switch format {
+	case config.FormatCRI:
+		c.parse = parseCRI
+	case config.FormatDocker:
+		c.parse = parseDocker
+	default:
+		return nil
+	}
+	return c
+}
+
+// fork returns a containerLog of the same format with no partial message.
+func (c *containerLog) fork() *containerLog {
+	return &containerLog{format: c.format, parse: c.parse, partial: make(map[string][]byte), parseErrors: c.parseErrors}
+}
+
+// add passes the message of line to emit once it is complete. The message
+// is only valid until emit returns.
+func (c *containerLog) add(line []byte, emit func([]byte)) {
+	l, err := c.parse(line)
+	if err != nil {
+		if c.parseErrors != nil {
+			c.parseErrors.WithLabelValues(c.format).Inc()
+		}
+		emit(line)
+		return
+	}
+	p := c.partial[l.stream]
+	if len(p) == 0 && !l.partial {
+		emit(l.message)
+		return
+	}
+	p = append(p, l.message...)
+	if l.partial && len(p) < maxContainerMessage {
+		c.partial[l.stream] = p
+		return
+	}
+	emit(p)
+	c.partial[l.stream] = p[:0]
+}
+
+// pending reports whether the start of a message waits for its end.
+func (c *containerLog) pending() bool {
+	for _, p := range c.partial {
+		if len(p) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// completes reports whether line ends a message, so that the next line
+// starts one, as far as line alone tells.
+func (c *containerLog) completes(line []byte) bool {
+	l, err := c.parse(line)
+	return err != nil || !l.partial
+}
+
+// message returns the message of line, or line when it is not in the
+// format.
+func (c *containerLog) message(line []byte) []byte {
+	if l, err := c.parse(line); err == nil {
+		return l.message
+	}
+	return line
+}
+
+// parseCRI parses a line of the CRI format, such as
+// "2016-10-06T00:17:09.669794202Z stdout F message", whose tag is P for a
+// partial line and F for a full one, possibly followed by other tags.
+func parseCRI(line []byte) (containerLine, error) {
+	ts, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok || len(ts) == 0 {
+		return containerLine{}, fmt.Errorf("missing timestamp")
+	}
+	stream, rest, ok := bytes.Cut(rest, []byte(" "))
+	if !ok || (string(stream) != "stdout" && string(stream) != "stderr") {
+		return containerLine{}, fmt.Errorf("invalid stream")
+	}
+	tags, message, _ := bytes.Cut(rest, []byte(" "))
+	tag, _, _ := bytes.Cut(tags, []byte(":"))
+	switch string(tag) {
+	case "F":
+		return containerLine{stream: string(stream), message: message}, nil
+	case "P":
+		return containerLine{stream: string(stream), message: message, partial: true}, nil
+	}
+	return containerLine{}, fmt.Errorf("invalid tag %q", tags)
+}
+
+// parseDocker parses a line of the Docker json-file format, such as
+// {"log":"message\n","stream":"stdout","time":"..."}. Docker splits long
+// messages into lines whose log does not end with a newline.
+func parseDocker(line []byte) (containerLine, error) {
+	var entry struct {
+		Log    *string `json:"log"`
+		Stream string  `json:"stream"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return containerLine{}, err
+	}
+	if entry.Log == nil {
+		return containerLine{}, fmt.Errorf("missing log")
+	}
+	message := []byte(*entry.Log)
+	if n := len(message); n > 0 && message[n-1] == '\n' {
+		return containerLine{stream: entry.Stream, message: bytes.TrimRight(message, "\r\n")}, nil
+	}
+	return containerLine{stream: entry.Stream, message: message, partial: true}, nil
+}
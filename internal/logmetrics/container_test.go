@@ -0,0 +1,69 @@
+package logmetrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerLog(t *testing.T) {
+	parseErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "parse_errors"}, []string{"format"})
+	unwrap := func(format string, lines ...string) []string {
+		c := newContainerLog(format, parseErrors)
+		var messages []string
+		for _, line := range lines {
+			c.add([]byte(line), func(message []byte) { messages = append(messages, string(message)) })
+		}
+		return messages
+	}
+
+	t.Run("CRI", func(t *testing.T) {
+		messages := unwrap(config.FormatCRI,
+			"2024-05-01T12:00:00.000000001Z stdout F GET /health 200",
+			"2024-05-01T12:00:00.000000002Z stdout P ERROR a long ",
+			"2024-05-01T12:00:00.000000003Z stderr F panic: boom",
+			"2024-05-01T12:00:00.000000004Z stdout P message split ",
+			"2024-05-01T12:00:00.000000005Z stdout F:x in three",
+			"2024-05-01T12:00:00.000000006Z stdout F",
+			"not a CRI line",
+		)
+		assert.Equal(t, []string{
+			"GET /health 200",
+			"panic: boom",
+			"ERROR a long message split in three",
+			"",
+			"not a CRI line",
+		}, messages)
+		assert.Equal(t, float64(1), testutil.ToFloat64(parseErrors.WithLabelValues(config.FormatCRI)))
+	})
+
+	t.Run("Docker", func(t *testing.T) {
+		messages := unwrap(config.FormatDocker,
+			`{"log":"GET /health 200\n","stream":"stdout","time":"2024-05-01T12:00:00Z"}`,
+			`{"log":"ERROR a long ","stream":"stdout","time":"2024-05-01T12:00:01Z"}`,
+			`{"log":"message\r\n","stream":"stdout","time":"2024-05-01T12:00:01Z"}`,
+			`{"log":"{\"level\":\"error\"}\n","stream":"stderr","time":"2024-05-01T12:00:02Z"}`,
+			`{"stream":"stdout"}`,
+		)
+		assert.Equal(t, []string{
+			"GET /health 200",
+			"ERROR a long message",
+			`{"level":"error"}`,
+			`{"stream":"stdout"}`,
+		}, messages)
+		assert.Equal(t, float64(1), testutil.ToFloat64(parseErrors.WithLabelValues(config.FormatDocker)))
+	})
+
+	t.Run("long message", func(t *testing.T) {
+		part := "2024-05-01T12:00:00Z stdout P " + strings.Repeat("x", maxContainerMessage/2)
+		messages := unwrap(config.FormatCRI, part, part, part, "2024-05-01T12:00:00Z stdout F end")
+		assert.Len(t, messages, 2, "messages are cut at maxContainerMessage")
+		assert.Equal(t, maxContainerMessage, len(messages[0]))
+	})
+
+	assert.Nil(t, newContainerLog("", parseErrors))
+}
@@ -0,0 +1,131 @@
+package logmetrics
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/fields"
+	"github.com/akmanon/kpi-metricsd/internal/prefilter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// engine matches lines against a set of KPIs. The literals each KPI regex
+// requires are searched for in one pass over the line, and only the KPIs
+// whose literals occur run their regex.
+type engine struct {
+	metrics    []*kpiMetric
+	filter     *prefilter.Filter
+	candidates []bool
+}
+
+func newEngine(metrics []*kpiMetric) *engine {
+	res := make([]*regexp.Regexp, len(metrics))
+	for i, m := range metrics {
+		res[i] = m.re
+	}
+	filter := prefilter.New(res)
+	return &engine{
+		metrics:    metrics,
+		filter:     filter,
+		candidates: make([]bool, filter.Len()),
+	}
+}
+
+// fork returns an engine sharing the KPIs and filter of e, for use by
+// another goroutine.
+func (e *engine) fork() *engine {
+	return &engine{
+		metrics:    e.metrics,
+		filter:     e.filter,
+		candidates: make([]bool, len(e.candidates)),
+	}
+}
+
+// sortedMetrics returns the KPIs of kpiMetrics ordered by name.
+func sortedMetrics(kpiMetrics map[string]*kpiMetric) []*kpiMetric {
+	metrics := make([]*kpiMetric, 0, len(kpiMetrics))
+	for _, m := range kpiMetrics {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].kpi.Name < metrics[j].kpi.Name })
+	return metrics
+}
+
+// each calls fn with every KPI that may match line. The engine is not safe
+// for concurrent use.
+func (e *engine) each(line []byte, fn func(i int, m *kpiMetric)) {
+	e.filter.Candidates(line, e.candidates)
+	for i, ok := range e.candidates {
+		if ok {
+			fn(i, e.metrics[i])
+		}
+	}
+}
+
+// unfiltered returns the names of the regex KPIs that run on every line.
+func (e *engine) unfiltered() []string {
+	var names []string
+	for _, i := range e.filter.Unfiltered() {
+		if e.metrics[i].re != nil {
+			names = append(names, e.metrics[i].kpi.Name)
+		}
+	}
+	return names
+}
+
+// logLine is a line being evaluated. Structured KPIs parse it on first use
+// and share the result.
+type logLine struct {
+	raw []byte
+	// parseErrors, when set, counts the lines that fail to parse by format.
+	parseErrors *prometheus.CounterVec
+
+	json   parsedRecord
+	logfmt parsedRecord
+
+	// input holds the fields the input of the source decoded raw from, in
+	// inputFormat, such as the header of a syslog message.
+	inputFormat string
+	input       fields.Record
+}
+
+type parsedRecord struct {
+	done   bool
+	record fields.Record
+}
+
+// record returns the fields of the line in format, or nil if it cannot be
+// parsed as such.
+func (l *logLine) record(format string) fields.Record {
+	if format == l.inputFormat {
+		return l.input
+	}
+	switch format {
+	case config.FormatJSON:
+		return l.parse(&l.json, format, fields.ParseJSON)
+	case config.FormatLogfmt:
+		return l.parse(&l.logfmt, format, fields.ParseLogfmt)
+	}
+	return nil
+}
+
+func (l *logLine) parse(p *parsedRecord, format string, parse func([]byte) (fields.Record, error)) fields.Record {
+	if p.done {
+		return p.record
+	}
+	p.done = true
+	record, err := parse(l.raw)
+	if err != nil {
+		l.parseError(format)
+		return nil
+	}
+	p.record = record
+	return record
+}
+
+func (l *logLine) parseError(format string) {
+	if l.parseErrors != nil {
+		l.parseErrors.WithLabelValues(format).Inc()
+	}
+}
@@ -0,0 +1,131 @@
+package logmetrics
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"testing"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// benchKPIs returns n KPIs in the shape of a large configuration: most
+// regexes contain a literal, a few do not.
+func benchKPIs(n int) []config.KPI {
+	kpis := make([]config.KPI, n)
+	for i := range kpis {
+		var regex string
+		switch i % 5 {
+		case 0:
+			regex = fmt.Sprintf(`ERROR \[svc%03d\] (?P<op>\w+) failed`, i)
+		case 1:
+			regex = fmt.Sprintf(`svc%03d request took=(?P<took>\d+)ms`, i)
+		case 2:
+			regex = fmt.Sprintf(`(?i)svc%03d (?:timeout|refused)`, i)
+		case 3:
+			regex = fmt.Sprintf(`status=5\d\d service=svc%03d`, i)
+		default:
+			regex = fmt.Sprintf(`user=\w+ action=(?:login|logout) shard=%d\b`, i)
+		}
+		kpis[i] = config.KPI{Name: fmt.Sprintf("kpi_%03d", i), Regex: regex}
+	}
+	kpis[n-1].Regex = `^\w+\d+$`
+	return kpis
+}
+
+func benchLines(n, services int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	lines := make([][]byte, n)
+	for i := range lines {
+		svc := r.Intn(services)
+		var line string
+		switch r.Intn(10) {
+		case 0:
+			line = fmt.Sprintf("2026-10-16T10:00:00Z ERROR [svc%03d] charge failed", svc)
+		case 1:
+			line = fmt.Sprintf("2026-10-16T10:00:00Z INFO svc%03d request took=%dms", svc, r.Intn(500))
+		case 2:
+			line = fmt.Sprintf("2026-10-16T10:00:00Z WARN SVC%03d Timeout", svc)
+		case 3:
+			line = fmt.Sprintf("2026-10-16T10:00:00Z INFO status=503 service=svc%03d", svc)
+		default:
+			line = fmt.Sprintf("2026-10-16T10:00:00Z INFO user=u%d action=view page=/home latency=%dus", r.Intn(1000), r.Intn(900))
+		}
+		lines[i] = []byte(line)
+	}
+	return lines
+}
+
+func newBenchMetrics(t testing.TB, kpis []config.KPI) []*kpiMetric {
+	compiledRegex := make(map[string]*regexp.Regexp)
+	assert.NoError(t, compileRegexpFromCfg(&kpis, &compiledRegex, &map[string]*matcher{}))
+	kpiMetrics := make(map[string]*kpiMetric)
+	for _, kpi := range kpis {
+		m, err := newKPIMetric(kpi, compiledRegex[kpi.Name])
+		assert.NoError(t, err)
+		kpiMetrics[kpi.Name] = m
+	}
+	return sortedMetrics(kpiMetrics)
+}
+
+func TestEngine(t *testing.T) {
+	metrics := newBenchMetrics(t, benchKPIs(50))
+	e := newEngine(metrics)
+	assert.Equal(t, []string{"kpi_049"}, e.unfiltered())
+
+	for _, line := range benchLines(2000, 60) {
+		var got []int
+		e.each(line, func(i int, m *kpiMetric) {
+			if m.re.Match(line) {
+				got = append(got, i)
+			}
+		})
+		var want []int
+		for i, m := range metrics {
+			if m.re.Match(line) {
+				want = append(want, i)
+			}
+		}
+		assert.Equal(t, want, got, "line %q", line)
+	}
+}
+
+// BenchmarkMatch compares running every KPI regex on every line, as lines
+// were evaluated before the engine, with the prefiltered engine.
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{20, 200} {
+		metrics := newBenchMetrics(b, benchKPIs(n))
+		lines := benchLines(1000, n)
+
+		b.Run(fmt.Sprintf("kpis=%d/regex loop", n), func(b *testing.B) {
+			for b.Loop() {
+				for _, line := range lines {
+					text := string(line)
+					for _, m := range metrics {
+						if len(m.labelNames) == 0 {
+							m.re.MatchString(text)
+						} else {
+							m.re.FindStringSubmatch(text)
+						}
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("kpis=%d/engine", n), func(b *testing.B) {
+			e := newEngine(metrics)
+			for b.Loop() {
+				for _, line := range lines {
+					e.each(line, func(_ int, m *kpiMetric) {
+						if len(m.labelNames) == 0 {
+							m.re.Match(line)
+						} else {
+							m.re.FindSubmatch(line)
+						}
+					})
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package logmetrics
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"go.uber.org/zap"
+)
+
+// KPIResult is the outcome of evaluating one KPI over a file.
+type KPIResult struct {
+	Name    string
+	Matches int
+	// Series maps the variable labels of each series, formatted as in the
+	// exposition format, to its value with the whole file as one window.
+	// Histogram series hold their number of observations.
+	Series map[string]float64
+	// Lines holds the first matching lines.
+	Lines []string
+}
+
+// EvaluateFile matches every line of path against the KPIs of src the way
+// a rotated file of src is evaluated, keeping up to maxLines matching lines
+// per KPI.
+func EvaluateFile(src config.LogSource, path string, maxLines int) ([]KPIResult, error) {
+	kpis := src.KPIs
+	compiledRegex := make(map[string]*regexp.Regexp)
+	compiledMatchers := make(map[string]*matcher)
+	if err := compileRegexpFromCfg(&kpis, &compiledRegex, &compiledMatchers); err != nil {
+		return nil, err
+	}
+	var ml *multiline
+	if src.Multiline.Enabled() {
+		var err error
+		if ml, err = newMultiline(src.Multiline); err != nil {
+			return nil, fmt.Errorf("multiline: %w", err)
+		}
+	}
+	metrics := make([]*kpiMetric, len(kpis))
+	counts := make([]map[string]float64, len(kpis))
+	results := make([]KPIResult, len(kpis))
+	for i, kpi := range kpis {
+		m, err := newKPIMetric(kpi, compiledRegex[kpi.Name])
+		if err != nil {
+			return nil, err
+		}
+		m.filter = compiledMatchers[kpi.Name]
+		metrics[i] = m
+		counts[i] = make(map[string]float64)
+		results[i] = KPIResult{Name: kpi.Name, Series: make(map[string]float64)}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file %w", err)
+	}
+	defer f.Close()
+
+	logger := zap.NewNop()
+	e := newEngine(metrics)
+	decode := newDecoder(src.LogCfg)
+	events := assembler{container: newContainerLog(src.Format, nil), multiline: ml}
+	err = scanEvents(f, events, func(line []byte) {
+		l := logLine{raw: line}
+		if decode != nil {
+			decode(&l)
+		}
+		e.each(l.raw, func(i int, m *kpiMetric) {
+			values, value, ok := m.match(&l, logger)
+			if !ok {
+				return
+			}
+			key := m.seriesKey(values, logger)
+			results[i].Matches++
+			if len(results[i].Lines) < maxLines {
+				results[i].Lines = append(results[i].Lines, string(line))
+			}
+			if m.histogram != nil {
+				counts[i][key]++
+				return
+			}
+			m.aggregate(counts[i], key, value)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input file %w", err)
+	}
+
+	for i, m := range metrics {
+		for key, v := range counts[i] {
+			if strings.HasSuffix(key, negativeSuffix) {
+				continue
+			}
+			results[i].Series[formatLabels(m.labelNames, m.series[key])] = v
+		}
+		if len(m.labelNames) == 0 && m.kpi.Additive() {
+			results[i].Series[""] = counts[i][""]
+		}
+	}
+	return results, nil
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
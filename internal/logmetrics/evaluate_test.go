@@ -0,0 +1,57 @@
+package logmetrics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateFile(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "sample.log")
+	lines := "ERROR disk full\nstatus=200 took=30ms\nERROR timeout\nstatus=500 took=1s\nstatus=200 took=10ms\n"
+	assert.NoError(t, os.WriteFile(input, []byte(lines), 0644))
+
+	kpis := []config.KPI{
+		{Name: "errors", Regex: "ERROR"},
+		{Name: "requests", Regex: `status=(?P<status>\d+)`},
+		{Name: "slowest", Regex: `took=(?P<took>\S+)`, ValueGroup: "took", Aggregation: config.AggregationMax},
+		{Name: "panics", Regex: "PANIC"},
+	}
+	results, err := EvaluateFile(config.LogSource{KPIs: kpis}, input, 1)
+	assert.NoError(t, err)
+	assert.Len(t, results, 4)
+
+	assert.Equal(t, KPIResult{
+		Name:    "errors",
+		Matches: 2,
+		Series:  map[string]float64{"": 2},
+		Lines:   []string{"ERROR disk full"},
+	}, results[0])
+	assert.Equal(t, map[string]float64{`{status="200"}`: 2, `{status="500"}`: 1}, results[1].Series)
+	assert.Equal(t, map[string]float64{"": 1}, results[2].Series)
+	assert.Equal(t, 0, results[3].Matches)
+	assert.Equal(t, map[string]float64{"": 0}, results[3].Series)
+
+	t.Run("multiline", func(t *testing.T) {
+		results, err := EvaluateFile(config.LogSource{
+			LogCfg: config.LogCfg{Multiline: config.Multiline{Continuation: `^status=`}},
+			KPIs:   kpis[:1],
+		}, input, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, results[0].Matches)
+		assert.Equal(t, []string{"ERROR disk full\nstatus=200 took=30ms"}, results[0].Lines)
+	})
+
+	t.Run("invalid regex", func(t *testing.T) {
+		_, err := EvaluateFile(config.LogSource{KPIs: []config.KPI{{Name: "broken", Regex: "("}}}, input, 1)
+		assert.ErrorContains(t, err, "KPI broken")
+	})
+
+	t.Run("missing input", func(t *testing.T) {
+		_, err := EvaluateFile(config.LogSource{KPIs: kpis}, filepath.Join(t.TempDir(), "missing.log"), 1)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,86 @@
+package logmetrics
+
+// assembler turns the lines of a source into the events KPIs are matched
+// against: container log lines are unwrapped into messages, which are then
+// grouped by the multiline rules. Either step may be unset.
+type assembler struct {
+	container *containerLog
+	multiline *multiline
+}
+
+func (a assembler) enabled() bool {
+	return a.container != nil || a.multiline != nil
+}
+
+// fork returns an assembler with the same rules and no pending event.
+func (a assembler) fork() assembler {
+	var f assembler
+	if a.container != nil {
+		f.container = a.container.fork()
+	}
+	if a.multiline != nil {
+		f.multiline = a.multiline.fork()
+	}
+	return f
+}
+
+// add passes line on, calling emit with every event it completes. The
+// event is only valid until emit returns.
+func (a assembler) add(line []byte, emit func([]byte)) {
+	if a.container == nil {
+		a.addMessage(line, emit)
+		return
+	}
+	a.container.add(line, func(message []byte) {
+		a.addMessage(message, emit)
+	})
+}
+
+func (a assembler) addMessage(message []byte, emit func([]byte)) {
+	if a.multiline == nil {
+		emit(message)
+		return
+	}
+	a.multiline.add(message, emit)
+}
+
+// flush emits the pending multiline event, if any. A partial container
+// message stays pending until the line completing it, which may only be
+// added in the next window.
+func (a assembler) flush(emit func([]byte)) {
+	if a.multiline != nil {
+		a.multiline.flush(emit)
+	}
+}
+
+// pending reports whether a partial container message is waiting for the
+// line completing it.
+func (a assembler) pending() bool {
+	return a.container != nil && a.container.pending()
+}
+
+// carry takes over the partial container messages pending in b, a fork of
+// a that read the end of a rotated file.
+func (a assembler) carry(b assembler) {
+	if a.container != nil {
+		a.container.partial = b.container.partial
+	}
+}
+
+// startsEvent reports whether line, following prev, begins a new event. A
+// nil prev is unknown, so that a container line never starts an event.
+// Streams interleaved in a container log are not told apart: a message
+// split into partial lines on one stream may be cut by a full line of the
+// other.
+func (a assembler) startsEvent(prev, line []byte) bool {
+	if a.container != nil {
+		if prev == nil || !a.container.completes(prev) {
+			return false
+		}
+		line = a.container.message(line)
+	}
+	if a.multiline != nil {
+		return a.multiline.startsEvent(line)
+	}
+	return true
+}
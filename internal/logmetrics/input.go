@@ -0,0 +1,49 @@
+package logmetrics
+
+import (
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/fields"
+	"github.com/akmanon/kpi-metricsd/internal/syslog"
+)
+
+// decoder extracts the text KPIs match from a line read by the input of a
+// source, along with the fields the input provides.
+type decoder func(l *logLine)
+
+// newDecoder returns the decoder of the input of src, or nil when lines are
+// matched as read.
+func newDecoder(src config.LogCfg) decoder {
+	switch src.InputFormat() {
+	case config.FormatSyslog:
+		return decodeSyslog
+	case config.FormatJournal:
+		return decodeJournal
+	}
+	return nil
+}
+
+// decodeSyslog matches KPIs against the body of syslog messages. A line
+// that is not a valid message is matched whole, without fields.
+func decodeSyslog(l *logLine) {
+	l.inputFormat = config.FormatSyslog
+	msg, err := syslog.Parse(l.raw)
+	if err != nil {
+		l.parseError(config.FormatSyslog)
+		return
+	}
+	l.raw, l.input = msg.Body, msg
+}
+
+// decodeJournal matches KPIs against the MESSAGE of journal entries, read
+// as JSON objects. A line that is not an entry is matched whole, without
+// fields.
+func decodeJournal(l *logLine) {
+	l.inputFormat = config.FormatJournal
+	entry, err := fields.ParseJSON(l.raw)
+	if err != nil {
+		l.parseError(config.FormatJournal)
+		return
+	}
+	message, _ := entry.Lookup("MESSAGE")
+	l.raw, l.input = []byte(fields.String(message)), entry
+}
@@ -0,0 +1,518 @@
+package logmetrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/fields"
+	"github.com/akmanon/kpi-metricsd/internal/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// OverflowLabelValue replaces every label value of a match once a KPI has
+// reached its max_label_cardinality.
+const OverflowLabelValue = "__overflow__"
+
+// labelKeySep joins label values into a single map key.
+const labelKeySep = "\xff"
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// kpiMetric matches lines for one KPI and owns its collectors. Named
+// capture groups of the regex, except the value group, become variable
+// labels.
+type kpiMetric struct {
+	kpi         config.KPI
+	re          *regexp.Regexp
+	filter      *matcher
+	labelNames  []string
+	labelGroups []int
+	valueGroup  int
+
+	// where and labelPaths replace the regex and its capture groups for
+	// structured KPIs.
+	where      []*fields.Condition
+	labelPaths []string
+	maxSeries  int
+	// seriesMu guards series and overflowed, as chunks of a file are
+	// matched concurrently.
+	seriesMu   sync.RWMutex
+	series     map[string][]string
+	overflowed bool
+	gauge      *prometheus.GaugeVec
+	counter    *prometheus.CounterVec
+	histogram  *prometheus.HistogramVec
+
+	// windowEnd, when set, holds the end of the last published window in
+	// Unix nanoseconds, exposed as the timestamp of the gauge samples.
+	windowEnd *atomic.Int64
+}
+
+func newKPIMetric(kpi config.KPI, re *regexp.Regexp) (*kpiMetric, error) {
+	m := &kpiMetric{
+		kpi:       kpi,
+		re:        re,
+		maxSeries: kpi.MaxCardinality(),
+		series:    make(map[string][]string),
+	}
+	if kpi.Structured() {
+		if err := m.initFields(); err != nil {
+			return nil, fmt.Errorf("KPI %s: %w", kpi.Name, err)
+		}
+	} else if kpi.Grok != "" {
+		if err := m.initGrokFields(); err != nil {
+			return nil, fmt.Errorf("KPI %s: %w", kpi.Name, err)
+		}
+	} else if re != nil {
+		for i, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if name == kpi.ValueGroup {
+				m.valueGroup = i
+				continue
+			}
+			if err := m.checkLabel("capture group", name); err != nil {
+				return nil, fmt.Errorf("KPI %s: %w", kpi.Name, err)
+			}
+			m.labelNames = append(m.labelNames, name)
+			m.labelGroups = append(m.labelGroups, i)
+		}
+		if kpi.ValueGroup != "" && m.valueGroup == 0 {
+			return nil, fmt.Errorf("KPI %s: value_group %q is not a capture group of the regex", kpi.Name, kpi.ValueGroup)
+		}
+	}
+	if kpi.HasGauge() {
+		m.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        kpi.Name,
+			Help:        m.help(),
+			ConstLabels: kpi.CustomLabels,
+		}, m.labelNames)
+	}
+	if kpi.HasCounter() {
+		m.counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        kpi.Name + "_total",
+			Help:        "total " + m.help(),
+			ConstLabels: kpi.CustomLabels,
+		}, m.labelNames)
+	}
+	if kpi.Type == config.KPITypeHistogram {
+		m.histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        kpi.Name,
+			Help:                        "distribution of " + kpi.Name + " values from log monitoring",
+			ConstLabels:                 kpi.CustomLabels,
+			Buckets:                     kpi.Buckets,
+			NativeHistogramBucketFactor: kpi.NativeHistogramBucketFactor,
+		}, m.labelNames)
+	}
+	if len(m.labelNames) == 0 {
+		// Without variable labels the single series is exported from the
+		// start, as a zero, like a plain gauge.
+		m.series[""] = nil
+		m.publish(nil)
+		if m.histogram != nil {
+			m.histogram.WithLabelValues()
+		}
+	}
+	return m, nil
+}
+
+// initFields parses the where conditions and field labels of a structured
+// KPI. Labels are ordered by name.
+func (m *kpiMetric) initFields() error {
+	for _, expr := range m.kpi.Where {
+		c, err := fields.ParseCondition(expr)
+		if err != nil {
+			return err
+		}
+		m.where = append(m.where, c)
+	}
+	for name := range m.kpi.FieldLabels {
+		if err := m.checkLabel("field label", name); err != nil {
+			return err
+		}
+		m.labelNames = append(m.labelNames, name)
+	}
+	sort.Strings(m.labelNames)
+	for _, name := range m.labelNames {
+		m.labelPaths = append(m.labelPaths, m.kpi.FieldLabels[name])
+	}
+	return nil
+}
+
+// initGrokFields maps the field labels and value field of a grok KPI to
+// the capture groups of its fields. Other fields are not exported.
+func (m *kpiMetric) initGrokFields() error {
+	groups := make(map[string]int)
+	for i, name := range m.re.SubexpNames() {
+		if name != "" {
+			groups[name] = i
+		}
+	}
+	if field := m.kpi.ValueField; field != "" {
+		if m.valueGroup = groups[field]; m.valueGroup == 0 {
+			return fmt.Errorf("value_field %q is not a field of the grok pattern", field)
+		}
+	}
+	for name := range m.kpi.FieldLabels {
+		if err := m.checkLabel("field label", name); err != nil {
+			return err
+		}
+		m.labelNames = append(m.labelNames, name)
+	}
+	sort.Strings(m.labelNames)
+	for _, name := range m.labelNames {
+		field := m.kpi.FieldLabels[name]
+		i, ok := groups[field]
+		if !ok {
+			return fmt.Errorf("field label %q refers to %q, which is not a field of the grok pattern", name, field)
+		}
+		m.labelGroups = append(m.labelGroups, i)
+	}
+	return nil
+}
+
+// checkLabel reports whether name can be used as a variable label.
+func (m *kpiMetric) checkLabel(kind, name string) error {
+	if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("%s %q is not a valid label name", kind, name)
+	}
+	if _, ok := m.kpi.CustomLabels[name]; ok || name == config.SourceLabel || name == config.FileLabel {
+		return fmt.Errorf("%s %q clashes with another label", kind, name)
+	}
+	return nil
+}
+
+// checkSourceLabels fails if a variable label of the KPI is also set on
+// every series of the source, such as the pod of a container log file.
+func (m *kpiMetric) checkSourceLabels(labels map[string]string) error {
+	for _, name := range m.labelNames {
+		if _, ok := labels[name]; ok {
+			return fmt.Errorf("KPI %s: label %q clashes with a label of the source", m.kpi.Name, name)
+		}
+	}
+	return nil
+}
+
+func (m *kpiMetric) help() string {
+	if m.kpi.Aggregate() == config.AggregationCount {
+		return "count of " + m.kpi.Name + " events from log monitoring"
+	}
+	return m.kpi.Aggregate() + " of " + m.kpi.Name + " values from log monitoring"
+}
+
+// collectors returns the collectors registered for the KPI.
+func (m *kpiMetric) collectors() []prometheus.Collector {
+	cs := m.vecs()
+	if m.gauge != nil && m.windowEnd != nil {
+		cs[0] = timestampedCollector{Collector: m.gauge, end: m.windowEnd}
+	}
+	return cs
+}
+
+// vecs returns the metric vectors of the KPI, gauge first, without window
+// timestamps, which the PushGateway rejects.
+func (m *kpiMetric) vecs() []prometheus.Collector {
+	var cs []prometheus.Collector
+	if m.gauge != nil {
+		cs = append(cs, m.gauge)
+	}
+	if m.counter != nil {
+		cs = append(cs, m.counter)
+	}
+	if m.histogram != nil {
+		cs = append(cs, m.histogram)
+	}
+	return cs
+}
+
+// match reports whether line matches and returns the label values of the
+// series the match is counted in, nil for KPIs without labels, along with
+// the captured value for KPIs with a value_group. A match whose value cannot
+// be parsed is dropped.
+func (m *kpiMetric) match(l *logLine, logger *zap.Logger) ([]string, float64, bool) {
+	if m.kpi.Structured() {
+		return m.matchFields(l, logger)
+	}
+	line := l.raw
+	if len(m.labelNames) == 0 && m.valueGroup == 0 {
+		return nil, 0, (m.re == nil || m.re.Match(line)) && m.accept(line)
+	}
+	sub := m.re.FindSubmatch(line)
+	if sub == nil || !m.accept(line) {
+		return nil, 0, false
+	}
+	var value float64
+	if m.valueGroup > 0 {
+		var err error
+		if value, err = units.Parse(string(sub[m.valueGroup]), m.kpi.Unit); err != nil {
+			logger.Debug("failed to parse KPI value", zap.String("kpi", m.kpi.Name), zap.Error(err))
+			return nil, 0, false
+		}
+	}
+	if len(m.labelNames) == 0 {
+		return nil, value, true
+	}
+	values := make([]string, len(m.labelGroups))
+	for i, g := range m.labelGroups {
+		values[i] = string(sub[g])
+	}
+	return values, value, true
+}
+
+// matchFields matches the fields of a structured line against the where
+// conditions of the KPI. Missing label fields yield empty label values.
+func (m *kpiMetric) matchFields(l *logLine, logger *zap.Logger) ([]string, float64, bool) {
+	r := l.record(m.kpi.Format)
+	if r == nil {
+		return nil, 0, false
+	}
+	for _, c := range m.where {
+		if !c.Match(r) {
+			return nil, 0, false
+		}
+	}
+	if !m.accept(l.raw) {
+		return nil, 0, false
+	}
+	var value float64
+	if m.kpi.ValueField != "" {
+		v, ok := r.Lookup(m.kpi.ValueField)
+		err := fmt.Errorf("field %s is missing", m.kpi.ValueField)
+		if ok {
+			value, err = fields.Number(v, m.kpi.Unit)
+		}
+		if err != nil {
+			logger.Debug("failed to parse KPI value", zap.String("kpi", m.kpi.Name), zap.Error(err))
+			return nil, 0, false
+		}
+	}
+	if len(m.labelNames) == 0 {
+		return nil, value, true
+	}
+	values := make([]string, len(m.labelPaths))
+	for i, path := range m.labelPaths {
+		if v, ok := r.Lookup(path); ok {
+			values[i] = fields.String(v)
+		}
+	}
+	return values, value, true
+}
+
+// negativeSuffix marks the key holding the negative part of the sum of a
+// series of a sum KPI exported as a counter. A counter cannot decrease, so
+// the negative values are left out of its increments while the gauge keeps
+// the true sum. Keys of a KPI hold one separator less than its label count,
+// so the marked keys never collide with those of series.
+const negativeSuffix = labelKeySep + "-"
+
+func negativeKey(key string) string {
+	return key + negativeSuffix
+}
+
+// aggregate folds a match with value into the window counts of its series.
+func (m *kpiMetric) aggregate(counts map[string]float64, key string, value float64) {
+	prev, seen := counts[key]
+	switch m.kpi.Aggregate() {
+	case config.AggregationSum:
+		counts[key] += value
+		if value < 0 && m.counter != nil {
+			counts[negativeKey(key)] += value
+		}
+	case config.AggregationMin:
+		if !seen || value < prev {
+			counts[key] = value
+		}
+	case config.AggregationMax:
+		if !seen || value > prev {
+			counts[key] = value
+		}
+	case config.AggregationLast:
+		counts[key] = value
+	default:
+		counts[key]++
+	}
+}
+
+// merge folds the count of a series in a later part of a window into dst.
+func (m *kpiMetric) merge(dst map[string]float64, key string, value float64) {
+	switch m.kpi.Aggregate() {
+	case config.AggregationCount, config.AggregationSum:
+		dst[key] += value
+		return
+	}
+	m.aggregate(dst, key, value)
+}
+
+// chunkCounts holds the matches of a KPI in one chunk of a file. Series
+// first seen in the chunk are only registered when it is merged, in file
+// order, so that the series folded into the overflow series do not depend
+// on how the workers were scheduled.
+type chunkCounts struct {
+	m      *kpiMetric
+	counts map[string]float64
+	// newKeys lists the keys of the series first seen in the chunk in the
+	// order they were seen, and labels their label values.
+	newKeys []string
+	labels  map[string][]string
+	// observations holds the histogram values of the new series.
+	observations map[string][]float64
+}
+
+func newChunkCounts(m *kpiMetric) *chunkCounts {
+	return &chunkCounts{
+		m:            m,
+		counts:       make(map[string]float64),
+		labels:       make(map[string][]string),
+		observations: make(map[string][]float64),
+	}
+}
+
+// add records a match with the label values and value returned by match.
+func (c *chunkCounts) add(values []string, value float64) {
+	key := strings.Join(values, labelKeySep)
+	if len(values) > 0 && !c.m.hasSeries(key) {
+		if _, ok := c.labels[key]; !ok {
+			c.newKeys = append(c.newKeys, key)
+			c.labels[key] = values
+		}
+		if c.m.histogram != nil {
+			c.observations[key] = append(c.observations[key], value)
+			return
+		}
+	} else if c.m.histogram != nil {
+		c.m.observe(key, value)
+		return
+	}
+	c.m.aggregate(c.counts, key, value)
+}
+
+// mergeChunk registers the series first seen in c and folds its counts into
+// dst.
+func (m *kpiMetric) mergeChunk(dst map[string]float64, c *chunkCounts, logger *zap.Logger) {
+	keys := make(map[string]string, len(c.newKeys))
+	for _, key := range c.newKeys {
+		keys[key] = m.seriesKey(c.labels[key], logger)
+		for _, v := range c.observations[key] {
+			m.observe(keys[key], v)
+		}
+	}
+	for key, value := range c.counts {
+		series, negative := strings.CutSuffix(key, negativeSuffix)
+		if k, ok := keys[series]; ok {
+			series = k
+		}
+		if negative {
+			dst[negativeKey(series)] += value
+			continue
+		}
+		m.merge(dst, series, value)
+	}
+}
+
+// accept applies the exclude regexes and matcher tree to a line matching
+// the KPI regex.
+func (m *kpiMetric) accept(line []byte) bool {
+	return m.filter == nil || m.filter.match(line)
+}
+
+// observe records value in the histogram series of key.
+func (m *kpiMetric) observe(key string, value float64) {
+	m.seriesMu.RLock()
+	values := m.series[key]
+	m.seriesMu.RUnlock()
+	m.histogram.WithLabelValues(values...).Observe(value)
+}
+
+// timestampedCollector exposes the samples of a collector with the end of
+// the last window as their timestamp.
+type timestampedCollector struct {
+	prometheus.Collector
+	end *atomic.Int64
+}
+
+func (c timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	end := c.end.Load()
+	if end == 0 {
+		c.Collector.Collect(ch)
+		return
+	}
+	ts := time.Unix(0, end)
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		ch <- prometheus.NewMetricWithTimestamp(ts, m)
+	}
+}
+
+func (m *kpiMetric) hasSeries(key string) bool {
+	m.seriesMu.RLock()
+	defer m.seriesMu.RUnlock()
+	_, ok := m.series[key]
+	return ok
+}
+
+// seriesKey returns the key for values, folding new label combinations into
+// the overflow series once maxSeries distinct combinations have been seen.
+// KPIs without labels count every match in the series of key "".
+func (m *kpiMetric) seriesKey(values []string, logger *zap.Logger) string {
+	if len(m.labelNames) == 0 {
+		return ""
+	}
+	key := strings.Join(values, labelKeySep)
+	if m.hasSeries(key) {
+		return key
+	}
+
+	m.seriesMu.Lock()
+	defer m.seriesMu.Unlock()
+	if _, ok := m.series[key]; ok {
+		return key
+	}
+	if len(m.series) < m.maxSeries {
+		m.series[key] = values
+		return key
+	}
+
+	if !m.overflowed {
+		m.overflowed = true
+		logger.Warn("KPI reached max_label_cardinality, counting new label values as overflow",
+			zap.String("kpi", m.kpi.Name), zap.Int("max_label_cardinality", m.maxSeries))
+	}
+	overflow := make([]string, len(values))
+	for i := range overflow {
+		overflow[i] = OverflowLabelValue
+	}
+	key = strings.Join(overflow, labelKeySep)
+	m.series[key] = overflow
+	return key
+}
+
+// publish exports the counts of one window. Series that were seen in an
+// earlier window but not in this one are set to zero, or removed when the
+// aggregation has no meaningful value for an empty window.
+func (m *kpiMetric) publish(counts map[string]float64) {
+	for key, values := range m.series {
+		v, ok := counts[key]
+		if !ok && !m.kpi.Additive() {
+			m.gauge.DeleteLabelValues(values...)
+			continue
+		}
+		if m.gauge != nil {
+			m.gauge.WithLabelValues(values...).Set(v)
+		}
+		if m.counter != nil {
+			m.counter.WithLabelValues(values...).Add(v - counts[negativeKey(key)])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package logmetrics
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+)
+
+// matcher is a compiled config.Matcher.
+type matcher struct {
+	re     *regexp.Regexp
+	allOf  []*matcher
+	anyOf  []*matcher
+	noneOf []*matcher
+}
+
+// compileKPIMatcher compiles the exclude regexes and the matcher tree of a
+// KPI into a single matcher, or returns nil if the KPI has neither.
+func compileKPIMatcher(kpi config.KPI) (*matcher, error) {
+	if len(kpi.Exclude) == 0 && len(kpi.AllOf) == 0 && len(kpi.AnyOf) == 0 && len(kpi.NoneOf) == 0 {
+		return nil, nil
+	}
+	root := config.Matcher{AllOf: kpi.AllOf, AnyOf: kpi.AnyOf, NoneOf: kpi.NoneOf}
+	for _, exclude := range kpi.Exclude {
+		root.NoneOf = append(root.NoneOf, config.Matcher{Regex: exclude})
+	}
+	return compileMatcher(root)
+}
+
+func compileMatcher(cfg config.Matcher) (*matcher, error) {
+	m := &matcher{}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	for _, group := range []struct {
+		cfg []config.Matcher
+		dst *[]*matcher
+	}{
+		{cfg.AllOf, &m.allOf}, {cfg.AnyOf, &m.anyOf}, {cfg.NoneOf, &m.noneOf},
+	} {
+		for _, c := range group.cfg {
+			child, err := compileMatcher(c)
+			if err != nil {
+				return nil, err
+			}
+			*group.dst = append(*group.dst, child)
+		}
+	}
+	if m.re == nil && len(m.allOf) == 0 && len(m.anyOf) == 0 && len(m.noneOf) == 0 {
+		return nil, fmt.Errorf("empty matcher")
+	}
+	return m, nil
+}
+
+func (m *matcher) match(line []byte) bool {
+	if m.re != nil && !m.re.Match(line) {
+		return false
+	}
+	for _, c := range m.allOf {
+		if !c.match(line) {
+			return false
+		}
+	}
+	if len(m.anyOf) > 0 {
+		matched := false
+		for _, c := range m.anyOf {
+			if c.match(line) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, c := range m.noneOf {
+		if c.match(line) {
+			return false
+		}
+	}
+	return true
+}
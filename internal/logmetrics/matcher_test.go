@@ -0,0 +1,68 @@
+package logmetrics
+
+import (
+	"testing"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestKPIMatcher(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{
+			Name:    "errors",
+			Regex:   "ERROR",
+			Exclude: []string{"HealthCheck", "Ping"},
+		},
+		{
+			Name:  "payment_failures",
+			Regex: `status=(?P<status>5\d\d)`,
+			AllOf: []config.Matcher{{Regex: "path=/pay"}},
+			AnyOf: []config.Matcher{
+				{Regex: "method=POST"},
+				{AllOf: []config.Matcher{{Regex: "method=PUT"}, {Regex: "retry=true"}}},
+			},
+			NoneOf: []config.Matcher{{Regex: "user=test-"}},
+		},
+		{
+			Name:    "pay_requests",
+			AnyOf:   []config.Matcher{{Regex: "path=/pay"}, {Regex: "path=/refund"}},
+			Exclude: []string{"user=test-"},
+		},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{
+		"ERROR db timeout",
+		"ERROR HealthCheck failed",
+		"ERROR Ping lost",
+		"INFO ok",
+		"status=500 path=/pay method=POST user=alice",
+		"status=502 path=/pay method=PUT retry=true user=bob",
+		"status=503 path=/pay method=PUT user=bob",
+		"status=500 path=/pay method=POST user=test-1",
+		"status=500 path=/cart method=POST user=alice",
+		"status=200 path=/pay method=POST user=alice",
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, float64(1), lm.kpiCount["errors"][""])
+	assert.Equal(t, map[string]float64{"500": 1, "502": 1}, lm.kpiCount["payment_failures"])
+	assert.Equal(t, float64(4), lm.kpiCount["pay_requests"][""])
+	assert.NotContains(t, lm.kpiMetrics["payment_failures"].series, "503", "rejected lines should not create series")
+
+	t.Run("invalid exclude regex", func(t *testing.T) {
+		err := ValidateKPIs([]config.KPI{{Name: "broken", Regex: "ERROR", Exclude: []string{"("}}})
+		assert.ErrorContains(t, err, "KPI broken")
+	})
+}
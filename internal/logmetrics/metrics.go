@@ -2,153 +2,663 @@ package logmetrics
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"maps"
-	"net/http"
 	"os"
+	"reflect"
 	"regexp"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/akmanon/kpi-metricsd/internal/archive"
 	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logrotate"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
 	"go.uber.org/zap"
 )
 
 type LogMetrics struct {
+	source         string
+	sourceLabels   prometheus.Labels
 	logFile        string
 	kpis           *[]config.KPI
 	compiledRegex  map[string]*regexp.Regexp
 	ctx            context.Context
 	cancel         context.CancelFunc
-	promMetrics    map[string]prometheus.Gauge
-	kpiCount       map[string]float64
+	kpiMetrics     map[string]*kpiMetric
+	engine         *engine
+	registered     bool
+	kpiCount       map[string]map[string]float64
 	logger         *zap.Logger
 	mu             sync.Mutex
-	listenAddr     string
-	metricsPath    string
+	registerer     prometheus.Registerer
 	PushGatewayCfg config.PushGateway
+
+	// stream delivers lines in streaming mode. Counts are then accumulated
+	// in memory for the current window instead of scanning logFile.
+	stream <-chan []byte
+	// marker, when set, is told which streamed lines have been published.
+	marker Marker
+
+	// events unwraps container log lines and groups lines into events
+	// before they are matched. In streaming mode it holds the event still
+	// receiving lines, and in file mode the partial container messages left
+	// at the end of the last rotated file.
+	events assembler
+
+	// decode, when set, decodes the lines of inputs such as syslog.
+	decode      decoder
+	inputFormat string
+
+	// archiver, when set, keeps a copy of logFile once its window has been
+	// published. Copies are made in the background, one at a time under
+	// archiveMu, and Start waits for them in archiving before returning.
+	archiver  *archive.Archiver
+	archiveMu sync.Mutex
+	archiving sync.WaitGroup
+
+	// windowStartSeconds and windowEndSeconds expose the bounds of the last
+	// published window and windowInfo why it ended; they have no samples
+	// before the first window. With windowTimestamps, windowEnd also
+	// timestamps the gauge samples.
+	windowStartSeconds *prometheus.GaugeVec
+	windowEndSeconds   *prometheus.GaugeVec
+	windowInfo         *prometheus.GaugeVec
+	windowEnd          atomic.Int64
+	windowTimestamps   bool
+
+	// workers is the number of goroutines evaluating the rotated file.
+	workers      int
+	evalDuration prometheus.Histogram
+	parseErrors  *prometheus.CounterVec
 }
 
-func NewLogMetrics(cfg *config.Cfg, logFile string, logger *zap.Logger) (*LogMetrics, error) {
+// Names of the metrics exposing the last published window of each source:
+// its bounds as Unix times, and why it ended as the reason label of an
+// info metric.
+const (
+	WindowStartMetric = "kpi_metricsd_window_start_seconds"
+	WindowEndMetric   = "kpi_metricsd_window_end_seconds"
+	WindowInfoMetric  = "kpi_metricsd_window_info"
+)
+
+// EvaluationDurationMetric is the name of the metric observing how long
+// each rotated file takes to evaluate.
+const EvaluationDurationMetric = "kpi_metricsd_evaluation_duration_seconds"
+
+// ParseErrorsMetric is the name of the metric counting the lines a
+// structured KPI could not parse, by format.
+const ParseErrorsMetric = "kpi_metricsd_parse_errors_total"
+
+// minChunkSize is the smallest part of a rotated file given to a worker.
+const minChunkSize = 256 << 10
+
+func NewLogMetrics(cfg *config.Cfg, src config.LogSource, logger *zap.Logger) (*LogMetrics, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	compiledRegex := make(map[string]*regexp.Regexp)
-	promMetrics := make(map[string]prometheus.Gauge)
-	kpiCount := make(map[string]float64)
+	compiledMatchers := make(map[string]*matcher)
+	kpiMetrics := make(map[string]*kpiMetric)
+	kpiCount := make(map[string]map[string]float64)
 	var pushGatewayCfg config.PushGateway
-	kpis := &cfg.KPIs
-	fmt.Println(cfg.Server.PushGateway)
+	kpis := &src.KPIs
 	if cfg.Server.PushGateway.Enabled {
 		pushGatewayCfg = cfg.Server.PushGateway
 	}
 
-	err := compileRegexpFromCfg(kpis, &compiledRegex)
+	err := compileRegexpFromCfg(kpis, &compiledRegex, &compiledMatchers)
 	if err != nil {
 		logger.Error("failed to compile regex", zap.Error(err))
 		cancel()
 		return nil, err
 	}
 	logger.Info("regex from config has been compiled sucessfully")
-	return &LogMetrics{
+	for _, kpi := range *kpis {
+		m, err := newKPIMetric(kpi, compiledRegex[kpi.Name])
+		if err == nil {
+			err = m.checkSourceLabels(src.Labels)
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		m.filter = compiledMatchers[kpi.Name]
+		kpiMetrics[kpi.Name] = m
+	}
+	var ml *multiline
+	if src.Multiline.Enabled() {
+		if ml, err = newMultiline(src.Multiline); err != nil {
+			cancel()
+			return nil, fmt.Errorf("multiline: %w", err)
+		}
+	}
+	sourceLabels := prometheus.Labels{config.SourceLabel: src.Name}
+	maps.Copy(sourceLabels, src.Labels)
+	lm := &LogMetrics{
+		source:         src.Name,
+		sourceLabels:   sourceLabels,
 		kpis:           kpis,
 		compiledRegex:  compiledRegex,
-		promMetrics:    promMetrics,
-		logFile:        logFile,
+		kpiMetrics:     kpiMetrics,
+		logFile:        src.RotatedLogFile,
 		kpiCount:       kpiCount,
 		ctx:            ctx,
 		cancel:         cancel,
 		logger:         logger,
-		listenAddr:     ":" + strconv.Itoa(cfg.Server.Port),
-		metricsPath:    cfg.Server.MetricsPath,
+		registerer:     prometheus.DefaultRegisterer,
 		PushGatewayCfg: pushGatewayCfg,
-	}, nil
+
+		windowStartSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: WindowStartMetric,
+			Help: "start of the last window whose KPIs were published, in seconds since the epoch",
+		}, nil),
+		windowEndSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: WindowEndMetric,
+			Help: "end of the last window whose KPIs were published, in seconds since the epoch",
+		}, nil),
+		windowInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: WindowInfoMetric,
+			Help: "reason the last window whose KPIs were published ended",
+		}, []string{"reason"}),
+		windowTimestamps: src.WindowTimestamps,
+
+		events:      assembler{multiline: ml},
+		decode:      newDecoder(src.LogCfg),
+		inputFormat: src.InputFormat(),
+		workers:     src.Workers(),
+		evalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    EvaluationDurationMetric,
+			Help:    "time taken to evaluate the KPIs of a rotated log file",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+		}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: ParseErrorsMetric,
+			Help: "lines that could not be parsed in the format of a structured KPI or of their source",
+		}, []string{"format"}),
+	}
+	lm.events.container = newContainerLog(src.Format, lm.parseErrors)
+	for _, m := range kpiMetrics {
+		lm.attach(m)
+	}
+	lm.setEngine()
+	lm.resetKPICount()
+	return lm, nil
 }
 
-func compileRegexpFromCfg(kpis *[]config.KPI, compiledRegex *map[string]*regexp.Regexp) error {
+// compileRegexpFromCfg compiles the regex of every KPI, and its exclude
+// regexes and matcher tree when it has any.
+func compileRegexpFromCfg(kpis *[]config.KPI, compiledRegex *map[string]*regexp.Regexp, compiledMatchers *map[string]*matcher) error {
 	for _, kpi := range *kpis {
-		if kpi.Regex == "" {
-			continue
+		if kpi.Grok != "" && kpi.Pattern() == "" {
+			return fmt.Errorf("KPI %s: grok pattern is not expanded, validate the config first", kpi.Name)
 		}
-		re, err := regexp.Compile(kpi.Regex)
+		if pattern := kpi.Pattern(); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+			}
+			(*compiledRegex)[kpi.Name] = re
+		}
+
+		filter, err := compileKPIMatcher(kpi)
 		if err != nil {
+			return fmt.Errorf("KPI %s: %w", kpi.Name, err)
+		}
+		if filter != nil {
+			(*compiledMatchers)[kpi.Name] = filter
+		}
+	}
+	return nil
+}
+
+// ValidateKPIs reports whether every KPI can be evaluated: its regex must
+// compile and its capture groups must make valid labels.
+func ValidateKPIs(kpis []config.KPI) error {
+	compiledRegex := make(map[string]*regexp.Regexp)
+	if err := compileRegexpFromCfg(&kpis, &compiledRegex, &map[string]*matcher{}); err != nil {
+		return err
+	}
+	for _, kpi := range kpis {
+		if _, err := newKPIMetric(kpi, compiledRegex[kpi.Name]); err != nil {
 			return err
 		}
-		(*compiledRegex)[kpi.Name] = re
 	}
 	return nil
 }
 
-func (lm *LogMetrics) Start(metricsChan <-chan bool) error {
+// ValidateSources reports whether the sources of cfg can export their
+// metrics together: the collectors every source would register are built and
+// registered with a throwaway registry, so that conflicting metrics are
+// reported before any pipeline starts. Sources with a file label are checked
+// with their glob standing for the files it matches.
+func ValidateSources(cfg *config.Cfg) error {
+	reg := prometheus.NewRegistry()
+	for _, src := range cfg.LogSources {
+		if src.FileLabel {
+			src = src.ForFile(src.SourceLogFile)
+		}
+		lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+		if err != nil {
+			return fmt.Errorf("log source %q: %w", src.Name, err)
+		}
+		lm.registerer = reg
+		if src.Mode == config.ModeStream {
+			lm.Stream(make(chan []byte))
+		}
+		err = lm.initMetrics()
+		lm.cancel()
+		if err != nil {
+			return fmt.Errorf("log source %q: %w", src.Name, err)
+		}
+	}
+	return nil
+}
+
+// Stream switches the metrics to streaming mode, counting lines received
+// from ch as they arrive and publishing them at each window boundary.
+func (lm *LogMetrics) Stream(ch <-chan []byte) {
+	lm.stream = ch
+}
+
+// Marker is the source of a stream that checkpoints only the lines whose
+// window has been published.
+type Marker interface {
+	// Mark returns a function committing the lines streamed so far.
+	Mark() func()
+}
+
+// CommitTo makes the metrics commit to m the lines of every window they
+// publish in streaming mode.
+func (lm *LogMetrics) CommitTo(m Marker) {
+	lm.marker = m
+}
 
-	lm.initMetrics()
+// ArchiveWith archives the rotated file with a after each window.
+func (lm *LogMetrics) ArchiveWith(a *archive.Archiver) {
+	lm.archiver = a
+}
 
-	go lm.serveMetrics()
+// setEngine rebuilds the matching engine for the current KPIs.
+func (lm *LogMetrics) setEngine() {
+	lm.engine = newEngine(sortedMetrics(lm.kpiMetrics))
+	if names := lm.engine.unfiltered(); len(names) > 0 {
+		lm.logger.Debug("KPIs without required literals are evaluated on every line", zap.Strings("kpis", names))
+	}
+}
+
+// attach links a KPI to the window state of the source.
+func (lm *LogMetrics) attach(m *kpiMetric) {
+	if lm.windowTimestamps {
+		m.windowEnd = &lm.windowEnd
+	}
+}
+
+func (lm *LogMetrics) Start(metricsChan <-chan logrotate.Window) error {
+	defer lm.archiving.Wait()
+
+	if err := lm.initMetrics(); err != nil {
+		return err
+	}
+
+	// An event is matched once its next line starts a new one, or after
+	// the flush timeout when no line follows.
+	var flush <-chan time.Time
+	var flushTimer *time.Timer
+	if lm.stream != nil && lm.events.multiline != nil {
+		flushTimer = time.NewTimer(lm.events.multiline.timeout)
+		flushTimer.Stop()
+		defer flushTimer.Stop()
+		flush = flushTimer.C
+	}
 
 	for {
 		select {
-		case <-metricsChan:
-			err := lm.updatePromMetrics()
-			if err != nil {
+		case window := <-metricsChan:
+			if err := lm.endWindow(window); err != nil {
 				return err
 			}
+			if window.Reason == logrotate.ReasonEndOfInput {
+				return nil
+			}
+		case line := <-lm.stream:
+			lm.mu.Lock()
+			lm.events.add(line, lm.countLine)
+			if flushTimer != nil {
+				flushTimer.Reset(lm.events.multiline.timeout)
+			}
+			lm.mu.Unlock()
+		case <-flush:
+			lm.mu.Lock()
+			lm.events.flush(lm.countLine)
+			lm.mu.Unlock()
 		case <-lm.ctx.Done():
 			return lm.ctx.Err()
 		}
 	}
 }
 
-func (lm *LogMetrics) initMetrics() {
-	var constLabels prometheus.Labels
+// endWindow publishes the window that just ended. In streaming mode the
+// lines queued by then are counted in it first and the pending event is
+// ended, as a rotated file ends its events in file mode. The lines are then
+// committed to the marker, unless a partial container message is still
+// waiting for the line completing it.
+func (lm *LogMetrics) endWindow(window logrotate.Window) error {
+	var commit func()
+	if lm.stream != nil {
+		if lm.marker != nil {
+			commit = lm.marker.Mark()
+		}
+		lm.mu.Lock()
+		// Lines keep coming while the queued ones are counted, so only
+		// those queued by now are taken.
+		for range len(lm.stream) {
+			lm.events.add(<-lm.stream, lm.countLine)
+		}
+		lm.events.flush(lm.countLine)
+		if lm.events.pending() {
+			commit = nil
+		}
+		lm.mu.Unlock()
+	}
+	if err := lm.updatePromMetrics(window); err != nil {
+		return err
+	}
+	if commit != nil {
+		commit()
+	}
+	return nil
+}
+
+// initMetrics registers the collectors of every KPI. Series are registered
+// through a registerer that adds the source labels, while pushMetrics pushes
+// the bare collectors and lets the PushGateway grouping key supply them
+// instead. On error nothing is left registered.
+func (lm *LogMetrics) initMetrics() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.registered {
+		return nil
+	}
+	if err := lm.register(); err != nil {
+		lm.unregister()
+		return err
+	}
+	lm.registered = true
+	return nil
+}
+
+// Register registers the collectors of the source, as Start does before
+// evaluating anything, so that a conflict with the metrics of another
+// source is reported before the pipeline is started.
+func (lm *LogMetrics) Register() error {
+	return lm.initMetrics()
+}
+
+func (lm *LogMetrics) register() error {
+	reg := prometheus.WrapRegistererWith(lm.sourceLabels, lm.registerer)
+	for _, kpi := range *lm.kpis {
+		if err := registerCollectors(reg, lm.kpiMetrics[kpi.Name]); err != nil {
+			return err
+		}
+	}
+	for name, c := range map[string]prometheus.Collector{
+		WindowStartMetric: lm.windowStartSeconds,
+		WindowEndMetric:   lm.windowEndSeconds,
+		WindowInfoMetric:  lm.windowInfo,
+	} {
+		if err := lm.selfRegisterer().Register(c); err != nil {
+			return fmt.Errorf("failed to register metric %s %w", name, err)
+		}
+	}
+	if err := lm.selfRegisterer().Register(lm.parseErrors); err != nil {
+		return fmt.Errorf("failed to register metric %s %w", ParseErrorsMetric, err)
+	}
+	// Export a zero for the formats in use, so rates start from the
+	// first error.
 	for _, kpi := range *lm.kpis {
+		if kpi.Structured() {
+			lm.parseErrors.WithLabelValues(kpi.Format)
+		}
+	}
+	if lm.inputFormat != "" {
+		lm.parseErrors.WithLabelValues(lm.inputFormat)
+	}
+	if lm.events.container != nil {
+		lm.parseErrors.WithLabelValues(lm.events.container.format)
+	}
+	if lm.stream == nil {
+		if err := lm.selfRegisterer().Register(lm.evalDuration); err != nil {
+			return fmt.Errorf("failed to register metric %s %w", EvaluationDurationMetric, err)
+		}
+	}
+	return nil
+}
+
+// UpdateKPIs replaces the KPI set of the source. Collectors of removed and
+// changed KPIs are unregistered and those of new and changed KPIs are
+// registered, while unchanged KPIs keep their series and the counts of the
+// current window. On error the previous KPI set is kept.
+func (lm *LogMetrics) UpdateKPIs(kpis []config.KPI) error {
+	compiledRegex := make(map[string]*regexp.Regexp)
+	compiledMatchers := make(map[string]*matcher)
+	if err := compileRegexpFromCfg(&kpis, &compiledRegex, &compiledMatchers); err != nil {
+		return err
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 
-		if _, exists := lm.promMetrics[kpi.Name]; exists {
+	kpiMetrics := make(map[string]*kpiMetric)
+	var added, removed []*kpiMetric
+	for _, kpi := range kpis {
+		if m, ok := lm.kpiMetrics[kpi.Name]; ok && reflect.DeepEqual(m.kpi, kpi) {
+			kpiMetrics[kpi.Name] = m
 			continue
 		}
+		m, err := newKPIMetric(kpi, compiledRegex[kpi.Name])
+		if err == nil {
+			err = m.checkSourceLabels(lm.sourceLabels)
+		}
+		if err != nil {
+			return err
+		}
+		m.filter = compiledMatchers[kpi.Name]
+		lm.attach(m)
+		kpiMetrics[kpi.Name] = m
+		added = append(added, m)
+	}
+	for name, m := range lm.kpiMetrics {
+		if kpiMetrics[name] != m {
+			removed = append(removed, m)
+		}
+	}
+
+	if lm.registered {
+		reg := prometheus.WrapRegistererWith(lm.sourceLabels, lm.registerer)
+		for _, m := range removed {
+			for _, c := range m.collectors() {
+				reg.Unregister(c)
+			}
+		}
+		for i, m := range added {
+			if err := registerCollectors(reg, m); err != nil {
+				// Restore the previous KPI set before giving up.
+				for _, m := range added[:i+1] {
+					for _, c := range m.collectors() {
+						reg.Unregister(c)
+					}
+				}
+				for _, m := range removed {
+					_ = registerCollectors(reg, m)
+				}
+				return err
+			}
+		}
+	}
 
-		constLabels = make(prometheus.Labels)
-		if len(kpi.CustomLabels) > 0 {
-			maps.Copy(constLabels, kpi.CustomLabels)
+	kpiCount := make(map[string]map[string]float64)
+	for name := range kpiMetrics {
+		kpiCount[name] = make(map[string]float64)
+		if counts, ok := lm.kpiCount[name]; ok && kpiMetrics[name] == lm.kpiMetrics[name] {
+			kpiCount[name] = counts
 		}
-		gauge := promauto.NewGauge(prometheus.GaugeOpts{
-			Name:        kpi.Name,
-			Help:        "count of " + kpi.Name + " events from log monitoring",
-			ConstLabels: constLabels,
-		})
-		lm.promMetrics[kpi.Name] = gauge
 	}
+	lm.kpis = &kpis
+	lm.compiledRegex = compiledRegex
+	lm.kpiMetrics = kpiMetrics
+	lm.kpiCount = kpiCount
+	lm.setEngine()
+	lm.logger.Info("KPIs updated", zap.Int("added", len(added)), zap.Int("removed", len(removed)))
+	return nil
 }
 
-func (lm *LogMetrics) updatePromMetrics() error {
-	err := lm.updateKPICount()
-	if err != nil {
-		return err
+// Unregister removes the collectors of every KPI from the registry, so the
+// source can be evaluated again by a new LogMetrics.
+func (lm *LogMetrics) Unregister() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if !lm.registered {
+		return
+	}
+	lm.unregister()
+	lm.registered = false
+}
+
+func (lm *LogMetrics) unregister() {
+	reg := prometheus.WrapRegistererWith(lm.sourceLabels, lm.registerer)
+	for _, m := range lm.kpiMetrics {
+		for _, c := range m.collectors() {
+			reg.Unregister(c)
+		}
+	}
+	lm.selfRegisterer().Unregister(lm.windowStartSeconds)
+	lm.selfRegisterer().Unregister(lm.windowEndSeconds)
+	lm.selfRegisterer().Unregister(lm.windowInfo)
+	lm.selfRegisterer().Unregister(lm.evalDuration)
+	lm.selfRegisterer().Unregister(lm.parseErrors)
+}
+
+// selfRegisterer registers the metrics the daemon exposes about a source.
+// Unlike KPIs they are shared by every source, so they always carry the
+// file label, empty unless the source is split by file, and only the
+// source and file labels, to keep the label names of every series the same.
+func (lm *LogMetrics) selfRegisterer() prometheus.Registerer {
+	labels := prometheus.Labels{
+		config.SourceLabel: lm.sourceLabels[config.SourceLabel],
+		config.FileLabel:   lm.sourceLabels[config.FileLabel],
 	}
+	return prometheus.WrapRegistererWith(labels, lm.registerer)
+}
+
+func registerCollectors(reg prometheus.Registerer, m *kpiMetric) error {
+	for _, c := range m.collectors() {
+		if err := reg.Register(c); err != nil {
+			return fmt.Errorf("failed to register metric %s %w", m.kpi.Name, err)
+		}
+	}
+	return nil
+}
 
-	for k, v := range lm.kpiCount {
-		lm.promMetrics[k].Set(v)
+func (lm *LogMetrics) updatePromMetrics(window logrotate.Window) error {
+	if lm.stream == nil {
+		err := lm.updateKPICount()
+		if err != nil {
+			return err
+		}
 	}
+
+	lm.publishWindow()
+	lm.setWindow(window)
 	if lm.PushGatewayCfg.Enabled {
 		lm.pushMetrics()
 	}
+	if lm.archiver != nil {
+		// Archives are named after the end of their window, as they are
+		// written some time after it.
+		at := window.End
+		if at.IsZero() {
+			at = time.Now()
+		}
+		lm.archive(at)
+	}
 	return nil
 
 }
 
+// archive copies logFile into the archive in the background, so that
+// compressing a large file does not hold up the next window. The file is
+// opened right away, as the next rotation replaces it.
+func (lm *LogMetrics) archive(t time.Time) {
+	f, err := os.Open(lm.logFile)
+	if err != nil {
+		lm.logger.Warn("failed to archive rotated log file", zap.Error(err))
+		return
+	}
+	lm.archiving.Add(1)
+	go func() {
+		defer lm.archiving.Done()
+		defer f.Close()
+		lm.archiveMu.Lock()
+		defer lm.archiveMu.Unlock()
+		path, err := lm.archiver.ArchiveFile(f, t)
+		if err != nil {
+			lm.logger.Warn("failed to archive rotated log file", zap.Error(err))
+		} else {
+			lm.logger.Info("rotated log file archived", zap.String("archive", path))
+		}
+	}()
+}
+
+// publishWindow exports the counts of the window that just ended. In
+// streaming mode the counts are then reset for the next window.
+func (lm *LogMetrics) publishWindow() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for name, m := range lm.kpiMetrics {
+		m.publish(lm.kpiCount[name])
+	}
+	if lm.stream != nil {
+		lm.resetKPICount()
+	}
+}
+
+// setWindow records the bounds of the window that was just published.
+func (lm *LogMetrics) setWindow(window logrotate.Window) {
+	if window.End.IsZero() {
+		return
+	}
+	lm.windowEnd.Store(window.End.UnixNano())
+	lm.windowStartSeconds.WithLabelValues().Set(float64(window.Start.UnixNano()) / 1e9)
+	lm.windowEndSeconds.WithLabelValues().Set(float64(window.End.UnixNano()) / 1e9)
+	lm.windowInfo.Reset()
+	lm.windowInfo.WithLabelValues(window.Reason).Set(1)
+}
+
 func (lm *LogMetrics) pushMetrics() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	pusher := push.New(lm.PushGatewayCfg.URL, lm.PushGatewayCfg.Job).
 		Grouping("instance", lm.PushGatewayCfg.Instance)
+	for name, value := range lm.sourceLabels {
+		pusher.Grouping(name, value)
+	}
 
 	// Push all KPIs
-	for _, metric := range lm.promMetrics {
-		pusher.Collector(metric)
+	lm.mu.Lock()
+	for _, m := range lm.kpiMetrics {
+		for _, c := range m.vecs() {
+			pusher.Collector(c)
+		}
 	}
+	lm.mu.Unlock()
+	pusher.Collector(lm.windowStartSeconds)
+	pusher.Collector(lm.windowEndSeconds)
+	pusher.Collector(lm.windowInfo)
 
 	if err := pusher.PushContext(ctx); err != nil {
 		lm.logger.Info("failed to push metrics to PushGateway", zap.Error(err))
@@ -159,15 +669,6 @@ func (lm *LogMetrics) pushMetrics() error {
 
 }
 
-func (lm *LogMetrics) serveMetrics() {
-	mux := http.NewServeMux()
-	mux.Handle(lm.metricsPath, promhttp.Handler())
-
-	if err := http.ListenAndServe(lm.listenAddr, mux); err != nil {
-		lm.logger.Fatal("metrics server failed", zap.Error(err))
-	}
-}
-
 func (lm *LogMetrics) Stop() {
 	lm.logger.Info("stopping metrics component")
 	lm.cancel()
@@ -179,6 +680,7 @@ func (lm *LogMetrics) updateKPICount() error {
 	defer lm.mu.Unlock()
 
 	lm.logger.Info("Triggered KPI count update")
+	start := time.Now()
 	lm.resetKPICount()
 
 	f, err := os.Open(lm.logFile)
@@ -188,27 +690,200 @@ func (lm *LogMetrics) updateKPICount() error {
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	if err := lm.evaluateFile(f); err != nil {
+		lm.logger.Error("scanner error while reading rotated log file", zap.Error(err))
+		return nil
+	}
+	elapsed := time.Since(start)
+	lm.evalDuration.Observe(elapsed.Seconds())
+	lm.logger.Info("KPI count update completed", zap.Duration("duration", elapsed))
+	return nil
+}
+
+// evaluateFile counts the lines of f. Large files are split into line
+// aligned chunks matched by concurrent workers, whose counts are merged in
+// file order so that the last value of a window stays the last one, and
+// new series are registered as if the file had been read by one worker.
+func (lm *LogMetrics) evaluateFile(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	n := min(lm.workers, int(info.Size()/minChunkSize)+1)
+	var startsEvent func(prev, line []byte) bool
+	if lm.events.enabled() {
+		startsEvent = lm.events.startsEvent
+	}
+	bounds, err := lineChunks(f, info.Size(), n, startsEvent)
+	if err != nil {
+		return err
+	}
+	if len(bounds) <= 2 {
+		return scanEvents(f, lm.events, lm.countLine)
+	}
+
+	// Only the first chunk continues the messages of the previous file and
+	// only the last one ends within a message, as chunks start at events.
+	counts := make([]map[string]*chunkCounts, len(bounds)-1)
+	events := make([]assembler, len(counts))
+	errs := make([]error, len(counts))
+	var wg sync.WaitGroup
+	for i := range counts {
+		counts[i] = make(map[string]*chunkCounts)
+		for name, m := range lm.kpiMetrics {
+			counts[i][name] = newChunkCounts(m)
+		}
+		events[i] = lm.events
+		if i > 0 {
+			events[i] = lm.events.fork()
+		}
+		e := lm.engine.fork()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chunk := io.NewSectionReader(f, bounds[i], bounds[i+1]-bounds[i])
+			errs[i] = scanEvents(chunk, events[i], func(line []byte) {
+				lm.count(e, line, func(m *kpiMetric, values []string, value float64) {
+					counts[i][m.kpi.Name].add(values, value)
+				})
+			})
+		}()
+	}
+	wg.Wait()
+	lm.events.carry(events[len(events)-1])
+
+	for _, c := range counts {
+		for name, m := range lm.kpiMetrics {
+			m.mergeChunk(lm.kpiCount[name], c[name], lm.logger)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lineChunks splits the first size bytes of r into at most n chunks that
+// each start at the beginning of a line, and returns the offsets bounding
+// them. When startsEvent is set, chunks also start at the beginning of an
+// event, so that no event is split between two chunks.
+func lineChunks(r io.ReaderAt, size int64, n int, startsEvent func(prev, line []byte) bool) ([]int64, error) {
+	bounds := []int64{0}
+	buf := make([]byte, 4096)
+	for i := 1; i < n; i++ {
+		// Move the bound past the end of the line it falls in, starting a
+		// byte early in case it already starts a line.
+		off := max(size*int64(i)/int64(n)-1, bounds[len(bounds)-1])
+		for off < size {
+			k, err := r.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+			if j := bytes.IndexByte(buf[:k], '\n'); j >= 0 {
+				off += int64(j) + 1
+				break
+			}
+			off += int64(k)
+			if err == io.EOF {
+				off = size
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if startsEvent != nil && off < size {
+			next, err := nextEvent(r, off, size, startsEvent)
+			if err != nil {
+				return nil, err
+			}
+			off = next
+		}
+		if off >= size {
+			break
+		}
+		bounds = append(bounds, off)
+	}
+	return append(bounds, size), nil
+}
+
+// nextEvent returns the offset of the first line at or after off, which
+// must start a line, that starts an event. The line before off is not
+// read, so startsEvent gets a nil prev for the line at off.
+func nextEvent(r io.ReaderAt, off, size int64, startsEvent func(prev, line []byte) bool) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r, off, size-off))
+	var prev []byte
+	for off < size {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Lines longer than the buffer are skipped: they are cut
+			// anyway, so they never start an event on their own.
+			off += int64(len(line))
+			prev = nil
+			continue
+		}
+		n := len(line)
+		line = bytes.TrimRight(line, "\r\n")
+		if startsEvent(prev, line) {
+			return off, nil
+		}
+		prev = append(prev[:0], line...)
+		off += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// scanEvents calls fn with every event of r: its lines, or the events they
+// are assembled into by a when it is enabled. The event is only valid until
+// fn returns. A partial container message at the end of r stays pending in
+// a.
+func scanEvents(r io.Reader, a assembler, fn func([]byte)) error {
+	if !a.enabled() {
+		return scanLines(r, fn)
+	}
+	err := scanLines(r, func(line []byte) {
+		a.add(line, fn)
+	})
+	a.flush(fn)
+	return err
+}
+
+// scanLines calls fn with every line of r. The line is only valid until fn
+// returns.
+func scanLines(r io.Reader, fn func([]byte)) error {
+	scanner := bufio.NewScanner(r)
 	buf := make([]byte, 0, 1024*1024)
 	scanner.Buffer(buf, 1024*1024)
 
 	for scanner.Scan() {
-		for kpiName, re := range lm.compiledRegex {
-			if re.MatchString(scanner.Text()) {
-				lm.kpiCount[kpiName]++
-			}
-		}
+		fn(scanner.Bytes())
 	}
-	if err := scanner.Err(); err != nil {
-		lm.logger.Error("scanner error while reading rotated log file", zap.Error(err))
-		return nil
+	return scanner.Err()
+}
+
+func (lm *LogMetrics) countLine(line []byte) {
+	lm.count(lm.engine, line, func(m *kpiMetric, values []string, value float64) {
+		key := m.seriesKey(values, lm.logger)
+		if m.histogram != nil {
+			m.observe(key, value)
+			return
+		}
+		m.aggregate(lm.kpiCount[m.kpi.Name], key, value)
+	})
+}
+
+// count matches line with e and passes each match to add.
+func (lm *LogMetrics) count(e *engine, line []byte, add func(m *kpiMetric, values []string, value float64)) {
+	l := logLine{raw: line, parseErrors: lm.parseErrors}
+	if lm.decode != nil {
+		lm.decode(&l)
 	}
-	lm.logger.Info("KPI count update completed")
-	return nil
+	e.each(l.raw, func(_ int, m *kpiMetric) {
+		if values, value, ok := m.match(&l, lm.logger); ok {
+			add(m, values, value)
+		}
+	})
 }
 
 func (lm *LogMetrics) resetKPICount() {
-	for kpiName := range lm.compiledRegex {
-		lm.kpiCount[kpiName] = 0
+	for kpiName := range lm.kpiMetrics {
+		lm.kpiCount[kpiName] = make(map[string]float64)
 	}
 }
@@ -3,12 +3,23 @@ package logmetrics
 import (
 	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/akmanon/kpi-metricsd/internal/archive"
 	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/akmanon/kpi-metricsd/internal/logrotate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -23,10 +34,10 @@ test 3`
 	err := os.WriteFile(logFile, []byte(testLine), 0755)
 	assert.NoError(t, err, "Expected no error when writing to test log file")
 
-	cfg, err := config.LoadCfg("../../conf.yaml")
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
 	assert.NoError(t, err)
 
-	metrics, err := NewLogMetrics(cfg, logFile, zap.NewNop())
+	metrics, err := NewLogMetrics(cfg, cfg.LogSources[0], zap.NewNop())
 	assert.NoError(t, err, "Expected no error when creating LogMetrics")
 
 	// Check if the compiled regex map is not empty
@@ -56,9 +67,13 @@ func TestLogMetricsStart(t *testing.T) {
 	cfg, err := config.LoadCfg("../testdata/conf.yaml")
 	assert.NoError(t, err)
 
-	notifyMetrics := make(chan bool)
-	lm, err := NewLogMetrics(cfg, logFile, logger)
+	src := cfg.LogSources[0]
+	src.RotatedLogFile = logFile
+	notifyMetrics := make(chan logrotate.Window)
+	lm, err := NewLogMetrics(cfg, src, logger)
 	assert.NoError(t, err, "Expected no error when creating LogMetrics")
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
 
 	go func() {
 		ticker := time.NewTicker(time.Millisecond * 300)
@@ -68,7 +83,7 @@ func TestLogMetricsStart(t *testing.T) {
 			case <-lm.ctx.Done():
 				return
 			case <-ticker.C:
-				notifyMetrics <- true
+				notifyMetrics <- logrotate.Window{}
 			}
 		}
 
@@ -85,11 +100,1003 @@ func TestLogMetricsStart(t *testing.T) {
 	}()
 
 	time.Sleep(time.Millisecond * 400)
-	assert.Equal(t, lm.kpiCount["test1"], float64(2))
-	assert.Equal(t, lm.kpiCount["test2"], float64(1))
-	assert.Equal(t, lm.kpiCount["test3"], float64(0))
+	assert.Equal(t, lm.kpiCount["test1"][""], float64(2))
+	assert.Equal(t, lm.kpiCount["test2"][""], float64(1))
+	assert.Equal(t, lm.kpiCount["test3"][""], float64(0))
+
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	// The three KPIs and the evaluation duration.
+	assert.Len(t, mfs, 4)
+	for _, mf := range mfs {
+		assert.Equal(t, config.DefaultSourceName, labelValue(mf.GetMetric()[0], config.SourceLabel))
+	}
+}
+
+func TestLogMetricsMultipleSources(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/multi_source_config.yaml")
+	assert.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	for _, src := range cfg.LogSources {
+		lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+		assert.NoError(t, err)
+		lm.registerer = reg
+		assert.NoError(t, lm.initMetrics())
+	}
+
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	sources := map[string]bool{}
+	for _, mf := range mfs {
+		if mf.GetName() != "errors" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			sources[labelValue(m, config.SourceLabel)] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{"app": true, "nginx": true}, sources)
+}
+
+func TestLogMetricsStream(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+
+	lines := make(chan []byte)
+	notifyMetrics := make(chan logrotate.Window)
+	lm, err := NewLogMetrics(cfg, cfg.LogSources[0], zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	lm.Stream(lines)
+
+	done := make(chan error)
+	go func() {
+		done <- lm.Start(notifyMetrics)
+	}()
+
+	lines <- []byte("a test line")
+	lines <- []byte("a Test line")
+	lines <- []byte("another test line")
+	notifyMetrics <- logrotate.Window{}
+	lines <- []byte("test in the next window")
+	notifyMetrics <- logrotate.Window{}
+	lm.Stop()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(lm.kpiMetrics["test1"].gauge))
+	assert.Equal(t, float64(0), testutil.ToFloat64(lm.kpiMetrics["test2"].gauge))
+	assert.Empty(t, lm.kpiCount["test1"])
+}
+
+func TestLogMetricsCounter(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{Name: "gauge_only", Regex: "test"},
+		{Name: "counter_only", Regex: "test", Type: config.KPITypeCounter},
+		{Name: "both", Regex: "test", Type: config.KPITypeBoth},
+	}
+
+	lines := make(chan []byte)
+	notifyMetrics := make(chan logrotate.Window)
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	lm.Stream(lines)
+
+	done := make(chan error)
+	go func() {
+		done <- lm.Start(notifyMetrics)
+	}()
+	lines <- []byte("test")
+	lines <- []byte("test")
+	notifyMetrics <- logrotate.Window{}
+	lines <- []byte("test")
+	notifyMetrics <- logrotate.Window{}
+	lm.Stop()
+	<-done
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(lm.kpiMetrics["gauge_only"].gauge))
+	assert.Equal(t, float64(1), testutil.ToFloat64(lm.kpiMetrics["both"].gauge))
+	assert.Equal(t, float64(3), testutil.ToFloat64(lm.kpiMetrics["counter_only"].counter))
+	assert.Equal(t, float64(3), testutil.ToFloat64(lm.kpiMetrics["both"].counter))
+	assert.Nil(t, lm.kpiMetrics["counter_only"].gauge)
+
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.ElementsMatch(t, []string{"gauge_only", "counter_only_total", "both", "both_total"}, names)
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestLogMetricsCaptureGroupLabels(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{
+			Name:                "http_requests",
+			Regex:               `status=(?P<status>\d{3}) path=(?P<endpoint>/\S*)`,
+			Type:                config.KPITypeBoth,
+			MaxLabelCardinality: 2,
+		},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+	m := lm.kpiMetrics["http_requests"]
+	assert.Equal(t, []string{"status", "endpoint"}, m.labelNames)
+
+	for _, line := range []string{
+		"status=200 path=/api",
+		"status=200 path=/api",
+		"status=500 path=/api",
+		"status=404 path=/missing",
+		"status=302 path=/login",
+		"no match",
+	} {
+		lm.countLine([]byte(line))
+	}
+	lm.publishWindow()
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.gauge.WithLabelValues("200", "/api")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.gauge.WithLabelValues("500", "/api")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.gauge.WithLabelValues(OverflowLabelValue, OverflowLabelValue)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.counter.WithLabelValues(OverflowLabelValue, OverflowLabelValue)))
+	assert.Equal(t, 3, testutil.CollectAndCount(m.gauge))
+
+	lm.resetKPICount()
+	lm.countLine([]byte("status=500 path=/api"))
+	lm.publishWindow()
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.gauge.WithLabelValues("200", "/api")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.counter.WithLabelValues("500", "/api")))
+}
+
+func TestLogMetricsHistogram(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{
+			Name:       "request_duration_seconds",
+			Regex:      `path=(?P<endpoint>/\S*) took=(?P<took>\S+)`,
+			Type:       config.KPITypeHistogram,
+			ValueGroup: "took",
+			Unit:       "ms",
+			Buckets:    []float64{0.1, 1},
+		},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+	m := lm.kpiMetrics["request_duration_seconds"]
+	assert.Equal(t, []string{"endpoint"}, m.labelNames)
+	assert.Len(t, m.collectors(), 1)
+
+	for _, line := range []string{
+		"path=/api took=50",
+		"path=/api took=0.5s",
+		"path=/api took=2s",
+		"path=/api took=fast",
+		"path=/login took=1500us",
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	metric := &dto.Metric{}
+	assert.NoError(t, m.histogram.WithLabelValues("/api").(prometheus.Histogram).Write(metric))
+	h := metric.GetHistogram()
+	assert.Equal(t, uint64(3), h.GetSampleCount())
+	assert.InDelta(t, 2.55, h.GetSampleSum(), 1e-9)
+	assert.Equal(t, uint64(1), h.GetBucket()[0].GetCumulativeCount())
+	assert.Equal(t, uint64(2), h.GetBucket()[1].GetCumulativeCount())
+	assert.Equal(t, 2, testutil.CollectAndCount(m.histogram))
+
+	t.Run("value group must exist", func(t *testing.T) {
+		kpi := src.KPIs[0]
+		kpi.ValueGroup = "latency"
+		_, err := newKPIMetric(kpi, regexp.MustCompile(kpi.Regex))
+		assert.ErrorContains(t, err, "value_group")
+	})
+}
+
+func TestLogMetricsAggregations(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	regex := `queue=(?P<queue>\w+) depth=(?P<depth>\d+)`
+	for _, agg := range []string{config.AggregationSum, config.AggregationMin, config.AggregationMax, config.AggregationLast} {
+		src.KPIs = append(src.KPIs, config.KPI{
+			Name:        "queue_depth_" + agg,
+			Regex:       regex,
+			ValueGroup:  "depth",
+			Aggregation: agg,
+		})
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{
+		"queue=jobs depth=7",
+		"queue=jobs depth=3",
+		"queue=jobs depth=12",
+		"queue=jobs depth=5",
+		"queue=mail depth=1",
+	} {
+		lm.countLine([]byte(line))
+	}
+	lm.publishWindow()
+
+	for agg, want := range map[string]float64{
+		config.AggregationSum:  27,
+		config.AggregationMin:  3,
+		config.AggregationMax:  12,
+		config.AggregationLast: 5,
+	} {
+		m := lm.kpiMetrics["queue_depth_"+agg]
+		assert.Equal(t, want, testutil.ToFloat64(m.gauge.WithLabelValues("jobs")), agg)
+	}
+
+	t.Run("empty window", func(t *testing.T) {
+		lm.resetKPICount()
+		lm.countLine([]byte("queue=jobs depth=4"))
+		lm.publishWindow()
+
+		sum := lm.kpiMetrics["queue_depth_sum"]
+		assert.Equal(t, float64(0), testutil.ToFloat64(sum.gauge.WithLabelValues("mail")))
+		peak := lm.kpiMetrics["queue_depth_max"]
+		assert.Equal(t, 1, testutil.CollectAndCount(peak.gauge))
+		assert.Equal(t, float64(4), testutil.ToFloat64(peak.gauge.WithLabelValues("jobs")))
+	})
+}
+
+func TestLogMetricsNegativeCounterSum(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{Name: "delta", Regex: `delta=(?P<delta>-?\d+)`, ValueGroup: "delta", Aggregation: config.AggregationSum, Type: config.KPITypeBoth},
+		{Name: "delta_json", Format: config.FormatJSON, ValueField: "delta", Aggregation: config.AggregationSum, Type: config.KPITypeCounter},
+		{Name: "delta_gauge", Regex: `delta=(?P<delta>-?\d+)`, ValueGroup: "delta", Aggregation: config.AggregationSum},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{"delta=7", "delta=-5", `{"delta": -5}`, `{"delta": 2}`} {
+		lm.countLine([]byte(line))
+	}
+	assert.NotPanics(t, lm.publishWindow)
+
+	assert.Equal(t, float64(7), testutil.ToFloat64(lm.kpiMetrics["delta"].counter), "negative values of counters are dropped")
+	assert.Equal(t, float64(2), testutil.ToFloat64(lm.kpiMetrics["delta"].gauge), "the gauge keeps the true sum")
+	assert.Equal(t, float64(2), testutil.ToFloat64(lm.kpiMetrics["delta_json"].counter))
+	assert.Equal(t, float64(2), testutil.ToFloat64(lm.kpiMetrics["delta_gauge"].gauge), "gauges keep negative values")
+}
+
+func TestLogMetricsUpdateKPIs(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{Name: "errors", Regex: "ERROR"},
+		{Name: "warnings", Regex: "WARN"},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	assert.NoError(t, lm.initMetrics())
+	lm.countLine([]byte("ERROR disk full"))
+	errorsMetric := lm.kpiMetrics["errors"]
+
+	kpis := []config.KPI{
+		{Name: "errors", Regex: "ERROR"},
+		{Name: "warnings", Regex: "WARN(ING)?"},
+		{Name: "panics", Regex: "PANIC", Type: config.KPITypeCounter},
+	}
+	assert.NoError(t, lm.UpdateKPIs(kpis))
+	assert.Same(t, errorsMetric, lm.kpiMetrics["errors"])
+	assert.Equal(t, float64(1), lm.kpiCount["errors"][""])
+	assert.Equal(t, "WARN(ING)?", lm.compiledRegex["warnings"].String())
+
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	assert.ElementsMatch(t, []string{"errors", "warnings", "panics_total", EvaluationDurationMetric}, names)
+
+	t.Run("removed KPIs are unregistered", func(t *testing.T) {
+		assert.NoError(t, lm.UpdateKPIs(kpis[:1]))
+		n, err := testutil.GatherAndCount(reg, "errors", "warnings", "panics_total")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("invalid KPIs keep the previous set", func(t *testing.T) {
+		err := lm.UpdateKPIs([]config.KPI{{Name: "broken", Regex: "("}})
+		assert.ErrorContains(t, err, "KPI broken")
+		assert.Contains(t, lm.kpiMetrics, "errors")
+		assert.NotContains(t, lm.kpiMetrics, "broken")
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		lm.Unregister()
+		n, err := testutil.GatherAndCount(reg)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+}
+
+func TestLogMetricsWindow(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{{Name: "errors", Regex: "ERROR", Type: config.KPITypeBoth}}
+	src.Timezone = "Asia/Kolkata"
+	src.WindowTimestamps = true
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	assert.NoError(t, lm.initMetrics())
+
+	window := logrotate.Window{
+		Start:  time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC),
+		End:    time.Date(2026, 10, 16, 10, 1, 0, 0, time.UTC),
+		Reason: logrotate.ReasonInterval,
+	}
+	lm.countLine([]byte("ERROR disk full"))
+	lm.publishWindow()
+	lm.setWindow(window)
+
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	metrics := make(map[string]*dto.Metric)
+	for _, f := range families {
+		assert.Len(t, f.GetMetric(), 1, f.GetName())
+		metrics[f.GetName()] = f.GetMetric()[0]
+	}
+
+	assert.Equal(t, window.End.UnixMilli(), metrics["errors"].GetTimestampMs())
+	assert.Equal(t, float64(1), metrics["errors"].GetGauge().GetValue())
+	assert.Zero(t, metrics["errors_total"].GetTimestampMs(), "counters are not timestamped")
+
+	assert.Equal(t, float64(window.Start.Unix()), metrics[WindowStartMetric].GetGauge().GetValue())
+	assert.Equal(t, float64(window.End.Unix()), metrics[WindowEndMetric].GetGauge().GetValue())
+	info := metrics[WindowInfoMetric]
+	assert.Equal(t, logrotate.ReasonInterval, labelValue(info, "reason"))
+	assert.Equal(t, "default", labelValue(info, config.SourceLabel))
+	assert.Equal(t, "", labelValue(info, config.FileLabel))
+
+	// Later windows update the same series instead of adding new ones.
+	window.Start, window.End = window.End, window.End.Add(time.Minute)
+	lm.setWindow(window)
+	for _, name := range []string{WindowStartMetric, WindowEndMetric, WindowInfoMetric} {
+		n, err := testutil.GatherAndCount(reg, name)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n, name)
+	}
+	assert.Equal(t, float64(window.End.Unix()), testutil.ToFloat64(lm.windowEndSeconds.WithLabelValues()))
+}
+
+func TestValidateSources(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/multi_source_config.yaml")
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateSources(cfg))
+
+	// The config check already rejects this, so build the conflict past it:
+	// nginx exports errors with a label app does not.
+	nginx := &cfg.LogSources[1]
+	nginx.KPIs = slices.Clone(nginx.KPIs)
+	nginx.KPIs[0].CustomLabels = map[string]string{"tier": "edge"}
+	err = ValidateSources(cfg)
+	assert.ErrorContains(t, err, `log source "nginx"`)
+	assert.ErrorContains(t, err, "errors")
+}
+
+func TestNewKPIMetricInvalidLabels(t *testing.T) {
+	for _, kpi := range []config.KPI{
+		{Name: "a", Regex: `(?P<source>\w+)`},
+		{Name: "b", Regex: `(?P<env>\w+)`, CustomLabels: map[string]string{"env": "prod"}},
+		{Name: "c", Regex: `(?P<__name>\w+)`},
+	} {
+		_, err := newKPIMetric(kpi, regexp.MustCompile(kpi.Regex))
+		assert.Error(t, err, kpi.Name)
+	}
+}
+
+func TestLineChunks(t *testing.T) {
+	text := "aaaa\nbbbbbbbbbb\ncc\n\ndddddddd\ne"
+	r := strings.NewReader(text)
+
+	for _, n := range []int{1, 2, 3, 4, 8, 40} {
+		bounds, err := lineChunks(r, int64(len(text)), n, nil)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(bounds)-1, n)
+		assert.Equal(t, int64(0), bounds[0])
+		assert.Equal(t, int64(len(text)), bounds[len(bounds)-1])
+		for _, b := range bounds[1 : len(bounds)-1] {
+			assert.Equal(t, byte('\n'), text[b-1], "chunk at %d should start a line", b)
+		}
+	}
+
+	bounds, err := lineChunks(r, int64(len(text)), 3, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 16, 20, 30}, bounds)
+
+	// Events start with an upper-case letter; the lines after them are
+	// continuation lines, some ending with CRLF.
+	text = "A first\n  more\r\n  more\nB second\r\n  more\nC third\n  more\n  more\n  more\nD fourth\n"
+	r = strings.NewReader(text)
+	startsEvent := func(prev, line []byte) bool {
+		return len(line) > 0 && line[0] >= 'A' && line[0] <= 'Z'
+	}
+	for _, n := range []int{2, 3, 4, 8} {
+		bounds, err := lineChunks(r, int64(len(text)), n, startsEvent)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(text)), bounds[len(bounds)-1])
+		for _, b := range bounds[1 : len(bounds)-1] {
+			assert.Equal(t, byte('\n'), text[b-1], "chunk at %d should start a line", b)
+			assert.True(t, startsEvent(nil, []byte(text[b:])), "chunk at %d should start an event", b)
+		}
+	}
+}
+
+func TestLogMetricsParallel(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.RotatedLogFile = filepath.Join(t.TempDir(), "rotated.log")
+	src.KPIs = []config.KPI{
+		{Name: "errors", Regex: `ERROR (?P<code>E\d)`},
+		{Name: "bytes_sum", Regex: `sent=(?P<sent>\d+)`, ValueGroup: "sent", Aggregation: config.AggregationSum},
+		{Name: "bytes_max", Regex: `sent=(?P<sent>\d+)`, ValueGroup: "sent", Aggregation: config.AggregationMax},
+		{Name: "bytes_last", Regex: `sent=(?P<sent>\d+)`, ValueGroup: "sent", Aggregation: config.AggregationLast},
+		{Name: "latency", Regex: `took=(?P<took>\d+)ms`, ValueGroup: "took", Unit: "ms", Type: config.KPITypeHistogram},
+		// Requests past the first chunk overflow whatever the order the
+		// workers run in.
+		{Name: "requests", Regex: `request (?P<id>\d+) sent`, MaxLabelCardinality: 10},
+		{Name: "latency_by_id", Regex: `request (?P<id>\d+) .*took=(?P<took>\d+)ms`, ValueGroup: "took", Unit: "ms",
+			Type: config.KPITypeHistogram, MaxLabelCardinality: 5},
+		// Negative values are left out of the counter, including those of
+		// series folded into the overflow series when chunks are merged.
+		{Name: "delta", Regex: `WARN (?P<code>E\d) delta=(?P<delta>-?\d+)`, ValueGroup: "delta",
+			Aggregation: config.AggregationSum, Type: config.KPITypeBoth, MaxLabelCardinality: 2},
+	}
+
+	var b strings.Builder
+	for i := 0; b.Len() < 4*minChunkSize; i++ {
+		fmt.Fprintf(&b, "INFO request %d sent=%d took=%dms\n", i, i%1000, i%300)
+		if i%7 == 0 {
+			fmt.Fprintf(&b, "ERROR E%d request %d failed\n", i%3, i)
+		}
+		if i%5 == 0 {
+			fmt.Fprintf(&b, "WARN E%d delta=%d\n", i%3, i%11-5)
+		}
+	}
+	b.WriteString("INFO request final sent=4242 took=1ms\n")
+	assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte(b.String()), 0644))
+
+	evaluate := func(workers int) (*LogMetrics, *prometheus.Registry) {
+		src.EvaluationWorkers = workers
+		lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+		assert.NoError(t, err)
+		reg := prometheus.NewRegistry()
+		lm.registerer = reg
+		assert.NoError(t, lm.initMetrics())
+		assert.NoError(t, lm.updateKPICount())
+		return lm, reg
+	}
+
+	sequential, _ := evaluate(1)
+	parallel, reg := evaluate(4)
+	assert.Equal(t, sequential.kpiCount, parallel.kpiCount)
+	assert.Equal(t, float64(4242), parallel.kpiCount["bytes_last"][""])
+	sequential.publishWindow()
+	parallel.publishWindow()
+	for _, key := range []string{"E0", OverflowLabelValue} {
+		gauge := testutil.ToFloat64(parallel.kpiMetrics["delta"].gauge.WithLabelValues(key))
+		counter := testutil.ToFloat64(parallel.kpiMetrics["delta"].counter.WithLabelValues(key))
+		assert.Equal(t, testutil.ToFloat64(sequential.kpiMetrics["delta"].counter.WithLabelValues(key)), counter, key)
+		assert.Equal(t, sequential.kpiCount["delta"][key], gauge, key)
+		assert.Greater(t, counter, gauge, "%s: negative values are left out of the counter", key)
+	}
+	for _, name := range []string{"requests", "latency_by_id"} {
+		assert.Equal(t, sequential.kpiMetrics[name].series, parallel.kpiMetrics[name].series, name)
+	}
+	assert.Contains(t, parallel.kpiMetrics["requests"].series, "9")
+	assert.Contains(t, parallel.kpiMetrics["latency_by_id"].series, "4")
+	assert.Equal(t, testutil.CollectAndCount(sequential.kpiMetrics["latency_by_id"].histogram),
+		testutil.CollectAndCount(parallel.kpiMetrics["latency_by_id"].histogram))
+
+	seqLatency := testutil.CollectAndCount(sequential.kpiMetrics["latency"].histogram)
+	assert.Equal(t, seqLatency, testutil.CollectAndCount(parallel.kpiMetrics["latency"].histogram))
+	metric := &dto.Metric{}
+	assert.NoError(t, parallel.kpiMetrics["latency"].histogram.WithLabelValues().(prometheus.Histogram).Write(metric))
+	assert.Equal(t, strings.Count(b.String(), "took="), int(metric.GetHistogram().GetSampleCount()))
+
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var observed uint64
+	for _, f := range families {
+		if f.GetName() == EvaluationDurationMetric {
+			observed = f.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	assert.Equal(t, uint64(1), observed)
+}
+
+func TestLogMetricsJSON(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{
+			Name:        "errors",
+			Format:      config.FormatJSON,
+			Where:       []string{`level == "error"`},
+			FieldLabels: map[string]string{"service": "service", "status": "http.status"},
+		},
+		{
+			Name:        "server_errors",
+			Format:      config.FormatJSON,
+			Where:       []string{`http.status >= 500`, `service in [api, web]`},
+			Exclude:     []string{"healthcheck"},
+			ValueField:  "http.duration",
+			Unit:        "ms",
+			Aggregation: config.AggregationMax,
+		},
+		{Name: "raw_errors", Regex: `"level":"error"`},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{
+		`{"level":"error","service":"api","http":{"status":503,"duration":120}}`,
+		`{"level":"error","service":"api","http":{"status":503,"duration":"1.5s"}}`,
+		`{"level":"error","service":"worker","http":{"status":500,"duration":900}}`,
+		`{"level":"error","service":"web","http":{"status":502,"duration":80},"path":"/healthcheck"}`,
+		`{"level":"info","service":"web","http":{"status":200,"duration":10}}`,
+		`{"level":"error","service":"web"}`,
+		`level=error service=api`,
+		`{"level":"error",`,
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, map[string]float64{
+		"api\xff503":    2,
+		"worker\xff500": 1,
+		"web\xff502":    1,
+		"web\xff":       1,
+	}, lm.kpiCount["errors"])
+	assert.Equal(t, map[string]float64{"": 1.5}, lm.kpiCount["server_errors"])
+	assert.Equal(t, float64(6), lm.kpiCount["raw_errors"][""], "regex KPIs still see every line")
+
+	t.Run("invalid condition", func(t *testing.T) {
+		err := ValidateKPIs([]config.KPI{{Name: "broken", Format: config.FormatJSON, Where: []string{"status >"}}})
+		assert.ErrorContains(t, err, "KPI broken")
+	})
+
+	t.Run("invalid field label", func(t *testing.T) {
+		err := ValidateKPIs([]config.KPI{{Name: "broken", Format: config.FormatJSON, FieldLabels: map[string]string{"source": "svc"}}})
+		assert.ErrorContains(t, err, "clashes")
+	})
+}
+
+func TestLogMetricsLogfmt(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.KPIs = []config.KPI{
+		{
+			Name:        "slow_requests",
+			Format:      config.FormatLogfmt,
+			Where:       []string{"level == warn", `msg == "slow request"`},
+			FieldLabels: map[string]string{"route": "route"},
+			ValueField:  "dur",
+			Aggregation: config.AggregationSum,
+		},
+		{
+			Name:   "failed_jobs",
+			Format: config.FormatLogfmt,
+			Where:  []string{"job.status == failed"},
+		},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	assert.NoError(t, lm.initMetrics())
+	n, err := testutil.GatherAndCount(reg, ParseErrorsMetric)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n, "the parse error counter of the format in use starts at zero")
+
+	for _, line := range []string{
+		`level=warn msg="slow request" route=/api dur=1.2s`,
+		`level=warn msg="slow request" route=/api dur=300ms`,
+		`level=info level=warn msg="slow request" route="/a b" dur=2s`,
+		`level=warn msg="slow" route=/api dur=9s`,
+		`level=error job.status=failed`,
+		`level=warn msg="slow request`,
+		`plain text`,
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, map[string]float64{"/api": 1.5, "/a b": 2}, lm.kpiCount["slow_requests"])
+	assert.Equal(t, float64(1), lm.kpiCount["failed_jobs"][""])
+	assert.Equal(t, float64(2), testutil.ToFloat64(lm.parseErrors.WithLabelValues(config.FormatLogfmt)), "each line is counted once however many KPIs parse it")
+}
+
+func TestLogMetricsGrok(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	cfg.LogSources[0].KPIs = []config.KPI{
+		{
+			Name:        "http_bytes",
+			Grok:        `^%{COMMONAPACHELOG}`,
+			FieldLabels: map[string]string{"status": "response", "method": "verb"},
+			ValueField:  "bytes",
+			Aggregation: config.AggregationSum,
+		},
+		{
+			Name: "sshd_failures",
+			Grok: `%{SYSLOGBASE} Failed password for %{USERNAME:user} from %{IP:client}`,
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+	src := cfg.LogSources[0]
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"method", "status"}, lm.kpiMetrics["http_bytes"].labelNames)
+	assert.Empty(t, lm.kpiMetrics["sshd_failures"].labelNames, "grok fields are not labels unless listed in field_labels")
+
+	for _, line := range []string{
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+		`10.0.0.7 - - [10/Oct/2000:13:55:37 -0700] "GET /index.html HTTP/1.1" 200 100`,
+		`2001:db8::1 - - [10/Oct/2000:13:55:38 -0700] "POST /login HTTP/1.1" 401 15`,
+		`10.0.0.7 - - [10/Oct/2000:13:55:39 -0700] "GET /empty HTTP/1.1" 304 -`,
+		`Oct 11 22:14:15 host1 sshd[4321]: Failed password for root from 192.168.1.5 port 22 ssh2`,
+		`Oct 11 22:14:16 host1 sshd[4321]: Accepted password for root from 192.168.1.5 port 22 ssh2`,
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, map[string]float64{"GET\xff200": 2426, "POST\xff401": 15}, lm.kpiCount["http_bytes"])
+	assert.Equal(t, float64(1), lm.kpiCount["sshd_failures"][""])
+
+	t.Run("unknown field", func(t *testing.T) {
+		cfg.LogSources[0].KPIs = []config.KPI{{
+			Name:        "http_bytes",
+			Grok:        `%{COMMONAPACHELOG}`,
+			FieldLabels: map[string]string{"status": "status"},
+		}}
+		assert.NoError(t, cfg.Validate())
+		_, err := NewLogMetrics(cfg, cfg.LogSources[0], zap.NewNop())
+		assert.ErrorContains(t, err, `refers to "status", which is not a field`)
+	})
+}
+
+func TestLogMetricsMultiline(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.Multiline = config.Multiline{Start: `^\d+ `}
+	src.KPIs = []config.KPI{
+		{Name: "errors", Regex: `^\d+ ERROR`},
+		{Name: "io_errors", Regex: `ERROR(?s:.*)Caused by: java\.io`},
+		{Name: "caused_by", Regex: `^Caused by`},
+	}
+
+	t.Run("file", func(t *testing.T) {
+		src.RotatedLogFile = filepath.Join(t.TempDir(), "rotated.log")
+		var b strings.Builder
+		for i := 0; b.Len() < 4*minChunkSize; i++ {
+			fmt.Fprintf(&b, "%d INFO request\n", i)
+			if i%5 == 0 {
+				fmt.Fprintf(&b, "%d ERROR request failed\njava.lang.RuntimeException: boom\n\tat Foo.bar(Foo.java:1)\n", i)
+				fmt.Fprintf(&b, "Caused by: java.io.IOException: closed\n\t... 1 more\n")
+			}
+		}
+		assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte(b.String()), 0644))
 
-	resp, err := http.Get("http://localhost" + lm.listenAddr + lm.metricsPath)
+		var counts []map[string]map[string]float64
+		for _, workers := range []int{1, 4} {
+			src.EvaluationWorkers = workers
+			lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+			assert.NoError(t, err)
+			assert.NoError(t, lm.updateKPICount())
+			counts = append(counts, lm.kpiCount)
+		}
+		failures := float64(strings.Count(b.String(), "ERROR"))
+		assert.Equal(t, failures, counts[0]["errors"][""])
+		assert.Equal(t, failures, counts[0]["io_errors"][""])
+		assert.Equal(t, float64(0), counts[0]["caused_by"][""], "continuation lines are not events of their own")
+		assert.Equal(t, counts[0], counts[1], "chunks start at events")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		src.Mode = config.ModeStream
+		src.Multiline.FlushTimeout = "200ms"
+		lines := make(chan []byte)
+		notifyMetrics := make(chan logrotate.Window)
+		lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+		assert.NoError(t, err)
+		lm.registerer = prometheus.NewRegistry()
+		lm.Stream(lines)
+		done := make(chan error)
+		go func() {
+			done <- lm.Start(notifyMetrics)
+		}()
+
+		for _, line := range []string{"1 ERROR failed", "Caused by: java.io.IOException", "2 INFO ok", "3 ERROR failed", "Caused by: java.io.EOFException"} {
+			lines <- []byte(line)
+		}
+		count := func(name string) float64 {
+			lm.mu.Lock()
+			defer lm.mu.Unlock()
+			return lm.kpiCount[name][""]
+		}
+		assert.Equal(t, float64(1), count("io_errors"), "the last event waits for more lines")
+		assert.Eventually(t, func() bool { return count("io_errors") == 2 }, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, float64(2), count("errors"))
+		lm.Stop()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+}
+
+func TestLogMetricsSyslog(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.Input = config.InputSyslog
+	src.SourceLogFile = ""
+	src.Syslog = config.Syslog{UDP: ":5514"}
+	src.KPIs = []config.KPI{
+		{
+			Name:        "auth_failures",
+			Format:      config.FormatSyslog,
+			Where:       []string{"severity_code <= 4", `message =~ "^Failed password"`},
+			FieldLabels: map[string]string{"app": "app_name", "host": "hostname"},
+		},
+		{Name: "errors", Regex: `ERROR`},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{
+		`<36>Oct 11 22:14:15 host1 sshd[4321]: Failed password for root from 192.168.1.5`,
+		`<38>Oct 11 22:14:16 host1 sshd[4321]: Failed password for root from 192.168.1.5`,
+		`<36>1 2003-10-11T22:14:15.003Z host2 sshd 77 - - Failed password for admin`,
+		`<11>1 2003-10-11T22:14:15.003Z host2 app - - - ERROR disk full`,
+		`<11>1 2003-10-11T22:14:15.003Z host2 app - - [bad ERROR`,
+		`<13>host1 app: stack#012ERROR nested`,
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, map[string]float64{"sshd\xffhost1": 1, "sshd\xffhost2": 1}, lm.kpiCount["auth_failures"])
+	assert.Equal(t, float64(3), lm.kpiCount["errors"][""], "regex KPIs match the message body, or the whole line when it is not valid syslog")
+	assert.Equal(t, float64(1), testutil.ToFloat64(lm.parseErrors.WithLabelValues(config.FormatSyslog)))
+}
+
+func TestLogMetricsJournal(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.Input = config.InputJournal
+	src.SourceLogFile = ""
+	src.KPIs = []config.KPI{
+		{
+			Name:        "unit_errors",
+			Format:      config.FormatJournal,
+			Where:       []string{"PRIORITY <= 3"},
+			FieldLabels: map[string]string{"unit": "_SYSTEMD_UNIT", "host": "_HOSTNAME"},
+		},
+		{Name: "timeouts", Regex: `^upstream timed out`},
+	}
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	lm.registerer = reg
+	assert.NoError(t, lm.initMetrics())
+
+	for _, line := range []string{
+		`{"MESSAGE":"upstream timed out","PRIORITY":"3","_HOSTNAME":"web1","_SYSTEMD_UNIT":"nginx.service"}`,
+		`{"MESSAGE":"started","PRIORITY":"6","_HOSTNAME":"web1","_SYSTEMD_UNIT":"nginx.service"}`,
+		`{"MESSAGE":"disk full","PRIORITY":"2","_HOSTNAME":"db1","_SYSTEMD_UNIT":"postgresql.service"}`,
+		`upstream timed out`,
+	} {
+		lm.countLine([]byte(line))
+	}
+
+	assert.Equal(t, map[string]float64{"web1\xffnginx.service": 1, "db1\xffpostgresql.service": 1}, lm.kpiCount["unit_errors"])
+	assert.Equal(t, float64(2), lm.kpiCount["timeouts"][""], "regex KPIs match the MESSAGE, or the whole line when it is not an entry")
+	assert.Equal(t, float64(1), testutil.ToFloat64(lm.parseErrors.WithLabelValues(config.FormatJournal)))
+}
+
+func TestLogMetricsContainer(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	src := cfg.LogSources[0]
+	src.Format = config.FormatCRI
+	src.FileLabel = true
+	src.Multiline = config.Multiline{Start: `^\d+ `}
+	src.KPIs = []config.KPI{
+		{Name: "errors", Regex: `^\d+ ERROR`},
+		{Name: "io_errors", Regex: `ERROR request failed(?s:.*)Caused by: java\.io`},
+		{Name: "timestamps", Regex: `^\d{4}-\d\d-\d\dT`},
+	}
+	src = src.ForFile("/var/log/pods/shop_checkout-7d9f_0f1e/api/0.log")
+	src.RotatedLogFile = filepath.Join(t.TempDir(), "rotated.log")
+
+	// Error messages are split into partial lines, with stderr lines in
+	// between, so that chunks must not start within a message.
+	var b strings.Builder
+	for i := 0; b.Len() < 4*minChunkSize; i++ {
+		fmt.Fprintf(&b, "2024-05-01T12:00:00.%09dZ stdout F %d INFO request\n", i, i)
+		if i%5 == 0 {
+			fmt.Fprintf(&b, "2024-05-01T12:00:00.%09dZ stdout P %d ERROR request \n", i, i)
+			fmt.Fprintf(&b, "2024-05-01T12:00:00.%09dZ stderr F warning: slow\n", i)
+			fmt.Fprintf(&b, "2024-05-01T12:00:00.%09dZ stdout F failed\n", i)
+			fmt.Fprintf(&b, "2024-05-01T12:00:00.%09dZ stdout F Caused by: java.io.IOException: closed\n", i)
+		}
+	}
+	assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte(b.String()), 0644))
+
+	var counts []map[string]map[string]float64
+	for _, workers := range []int{1, 4} {
+		src.EvaluationWorkers = workers
+		lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+		assert.NoError(t, err)
+		assert.Equal(t, "checkout-7d9f", lm.sourceLabels[config.PodLabel])
+		assert.NoError(t, lm.updateKPICount())
+		counts = append(counts, lm.kpiCount)
+	}
+	failures := float64(strings.Count(b.String(), "ERROR"))
+	assert.Equal(t, failures, counts[0]["errors"][""])
+	assert.Equal(t, failures, counts[0]["io_errors"][""])
+	assert.Equal(t, float64(0), counts[0]["timestamps"][""], "KPIs match the messages, not the CRI lines")
+	assert.Equal(t, counts[0], counts[1], "chunks start at complete messages")
+
+	t.Run("message split across windows", func(t *testing.T) {
+		src.Multiline = config.Multiline{}
+		src.KPIs = []config.KPI{{Name: "failures", Regex: `^ERROR request failed$`}}
+		var filler strings.Builder
+		for i := 0; filler.Len() < 4*minChunkSize; i++ {
+			fmt.Fprintf(&filler, "2024-05-01T12:00:00.%09dZ stdout F INFO request\n", i)
+		}
+		windows := []string{
+			filler.String() + "2024-05-01T12:00:01Z stdout P ERROR request \n",
+			"2024-05-01T12:00:02Z stdout F failed\n" + filler.String(),
+		}
+		for _, workers := range []int{1, 4} {
+			src.EvaluationWorkers = workers
+			lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+			assert.NoError(t, err)
+			var got []float64
+			for _, w := range windows {
+				assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte(w), 0644))
+				assert.NoError(t, lm.updateKPICount())
+				got = append(got, lm.kpiCount["failures"][""])
+			}
+			assert.Equal(t, []float64{0, 1}, got, "workers %d", workers)
+		}
+	})
+
+	t.Run("label clash", func(t *testing.T) {
+		src.KPIs = []config.KPI{{Name: "errors", Regex: `ERROR (?P<pod>\w+)`}}
+		_, err := NewLogMetrics(cfg, src, zap.NewNop())
+		assert.ErrorContains(t, err, `label "pod" clashes with a label of the source`)
+	})
+}
+
+func TestLogMetricsArchive(t *testing.T) {
+	cfg, err := config.LoadCfg("../testdata/conf.yaml")
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	src := cfg.LogSources[0]
+	src.RotatedLogFile = filepath.Join(dir, "rotated.log")
+	src.Archive = config.Archive{Enabled: true, Compression: config.CompressionZstd, Dir: filepath.Join(dir, "archive")}
+	src.KPIs = []config.KPI{{Name: "errors", Regex: "ERROR"}}
+	assert.NoError(t, os.WriteFile(src.RotatedLogFile, []byte("ERROR one\n"), 0644))
+
+	lm, err := NewLogMetrics(cfg, src, zap.NewNop())
+	assert.NoError(t, err)
+	lm.registerer = prometheus.NewRegistry()
+	archiver := archive.New(src)
+	lm.ArchiveWith(archiver)
+
+	// Hold the archives back: windows are still handed off and published.
+	lm.archiveMu.Lock()
+	notifyMetrics := make(chan logrotate.Window)
+	done := make(chan error)
+	go func() {
+		done <- lm.Start(notifyMetrics)
+	}()
+	send := func(w logrotate.Window) {
+		select {
+		case notifyMetrics <- w:
+		case <-time.After(2 * time.Second):
+			t.Fatal("window was not received while archiving")
+		}
+	}
+	start := time.Now()
+	window := func(i int) logrotate.Window {
+		return logrotate.Window{
+			Start:  start.Add(time.Duration(i) * time.Minute),
+			End:    start.Add(time.Duration(i+1) * time.Minute),
+			Reason: logrotate.ReasonInterval,
+		}
+	}
+	send(window(0))
+	// Once the next window is received the first one has been published
+	// and its file opened for archiving.
+	send(window(1))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(lm.windowEndSeconds), float64(window(0).End.UnixNano())/1e9)
+
+	// The next rotation replaces the rotated file while it is archived.
+	next := filepath.Join(dir, "next.log")
+	assert.NoError(t, os.WriteFile(next, []byte("ERROR two\nERROR three\n"), 0644))
+	assert.NoError(t, os.Rename(next, src.RotatedLogFile))
+	send(window(2))
+	files, err := archiver.Files()
+	assert.NoError(t, err)
+	assert.Empty(t, files, "archives should still be pending")
+
+	lm.archiveMu.Unlock()
+	lm.Stop()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// Start returned once the pending archives were written.
+	files, err = archiver.Files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+	f, err := os.Open(files[0].Path)
+	assert.NoError(t, err)
+	defer f.Close()
+	r, err := zstd.NewReader(f)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(r)
 	assert.NoError(t, err)
-	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, "ERROR one\n", string(content))
 }
@@ -0,0 +1,77 @@
+package logmetrics
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+)
+
+// multiline assembles lines into events following the multiline rules of
+// a source. Events are emitted with their lines joined by newlines.
+type multiline struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	maxLines     int
+	timeout      time.Duration
+
+	event []byte
+	lines int
+}
+
+func newMultiline(cfg config.Multiline) (*multiline, error) {
+	m := &multiline{maxLines: cfg.Lines(), timeout: cfg.Timeout()}
+	var err error
+	if cfg.Start != "" {
+		if m.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Continuation != "" {
+		if m.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// fork returns an assembler with the same rules and no pending event.
+func (m *multiline) fork() *multiline {
+	return &multiline{start: m.start, continuation: m.continuation, maxLines: m.maxLines, timeout: m.timeout}
+}
+
+// startsEvent reports whether line begins a new event rather than
+// continuing the previous one.
+func (m *multiline) startsEvent(line []byte) bool {
+	if m.start != nil && m.start.Match(line) {
+		return true
+	}
+	if m.continuation != nil {
+		return !m.continuation.Match(line)
+	}
+	return false
+}
+
+// add appends line to the pending event, first emitting the pending event
+// when line starts a new one or the event already has maxLines lines. The
+// event passed to emit is only valid until emit returns.
+func (m *multiline) add(line []byte, emit func([]byte)) {
+	if m.lines > 0 && (m.lines >= m.maxLines || m.startsEvent(line)) {
+		m.flush(emit)
+	}
+	if m.lines > 0 {
+		m.event = append(m.event, '\n')
+	}
+	m.event = append(m.event, line...)
+	m.lines++
+}
+
+// flush emits the pending event, if any.
+func (m *multiline) flush(emit func([]byte)) {
+	if m.lines == 0 {
+		return
+	}
+	emit(m.event)
+	m.event = m.event[:0]
+	m.lines = 0
+}
@@ -0,0 +1,66 @@
+package logmetrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiline(t *testing.T) {
+	assemble := func(cfg config.Multiline, lines ...string) []string {
+		m, err := newMultiline(cfg)
+		assert.NoError(t, err)
+		var events []string
+		emit := func(event []byte) { events = append(events, string(event)) }
+		for _, line := range lines {
+			m.add([]byte(line), emit)
+		}
+		m.flush(emit)
+		return events
+	}
+
+	javaTrace := []string{
+		"2024-05-01 12:00:00 ERROR request failed",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.Foo.bar(Foo.java:42)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 3 more",
+		"2024-05-01 12:00:01 INFO recovered",
+	}
+
+	t.Run("start", func(t *testing.T) {
+		events := assemble(config.Multiline{Start: `^\d{4}-\d\d-\d\d `}, javaTrace...)
+		assert.Equal(t, []string{strings.Join(javaTrace[:5], "\n"), javaTrace[5]}, events)
+	})
+
+	t.Run("continuation", func(t *testing.T) {
+		events := assemble(config.Multiline{Continuation: `^(\s|Caused by:|[\w.]+(Exception|Error)\b)`}, javaTrace...)
+		assert.Equal(t, []string{strings.Join(javaTrace[:5], "\n"), javaTrace[5]}, events)
+	})
+
+	t.Run("start and continuation", func(t *testing.T) {
+		events := assemble(config.Multiline{Start: `^Traceback`, Continuation: `^\s`},
+			"Traceback (most recent call last):",
+			`  File "app.py", line 3, in <module>`,
+			"ValueError: bad input",
+			"INFO done",
+		)
+		assert.Equal(t, []string{
+			"Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>",
+			"ValueError: bad input",
+			"INFO done",
+		}, events)
+	})
+
+	t.Run("max lines", func(t *testing.T) {
+		events := assemble(config.Multiline{Start: `^START`, MaxLines: 2}, "START", "a", "b", "c", "START")
+		assert.Equal(t, []string{"START\na", "b\nc", "START"}, events)
+	})
+
+	t.Run("invalid regex", func(t *testing.T) {
+		_, err := newMultiline(config.Multiline{Start: "("})
+		assert.Error(t, err)
+	})
+}
@@ -17,11 +17,35 @@ type LogRotate struct {
 	dstFile  string
 	ctx      context.Context
 	cancel   context.CancelFunc
-	interval time.Duration
+	schedule Schedule
 	logger   *zap.Logger
 	mu       sync.Mutex
+
+	// windowOnly skips the file copy and only marks window boundaries,
+	// for sources whose lines are streamed to the metrics in memory.
+	windowOnly bool
+
+	// maxSize triggers a rotation once the redirect file reaches it,
+	// checked every sizeCheckInterval. Zero disables the size trigger.
+	maxSize           int64
+	sizeCheckInterval time.Duration
+
+	// finish is closed by Finish to end the last window early.
+	finish     chan struct{}
+	finishOnce sync.Once
 }
 
+// Rotation triggers, logged as the reason of a rotation.
+const (
+	ReasonInterval   = "scheduled interval"
+	ReasonMaxSize    = "max size reached"
+	ReasonEndOfInput = "end of input"
+)
+
+// defaultSizeCheckInterval is how often the redirect file size is compared
+// to the max size.
+const defaultSizeCheckInterval = time.Second
+
 func NewLogRotate(srcFile string, dstFile string, interval time.Duration, logger *zap.Logger) *LogRotate {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -30,34 +54,111 @@ func NewLogRotate(srcFile string, dstFile string, interval time.Duration, logger
 		dstFile:  dstFile,
 		ctx:      ctx,
 		cancel:   cancel,
-		interval: interval,
+		schedule: IntervalSchedule(interval),
 		logger:   logger,
+
+		sizeCheckInterval: defaultSizeCheckInterval,
+		finish:            make(chan struct{}),
 	}
 
 }
 
-var ErrStoppedByCancelSignal = fmt.Errorf("stopped by cancel signal")
+// RotateAtSize makes the rotator also rotate as soon as the redirect file
+// reaches maxSize bytes. With the default schedule the interval then
+// restarts, so that no window is longer than the interval.
+func (l *LogRotate) RotateAtSize(maxSize int64) {
+	l.maxSize = maxSize
+}
+
+// UseSchedule replaces the fixed interval with s.
+func (l *LogRotate) UseSchedule(s Schedule) {
+	l.schedule = s
+}
 
-func (l *LogRotate) Start(rotateChan chan<- bool, processMetricsNotify chan bool) error {
+// WindowOnly makes the rotator only notify about window boundaries without
+// touching the redirect and rotated files.
+func (l *LogRotate) WindowOnly() {
+	l.windowOnly = true
+}
+
+// Finish ends the current window now, once the input of the source has
+// ended. Start returns after sending that window.
+func (l *LogRotate) Finish() {
+	l.finishOnce.Do(func() { close(l.finish) })
+}
 
-	ticker := time.NewTicker(l.interval)
-	defer ticker.Stop()
+var ErrStoppedByCancelSignal = fmt.Errorf("stopped by cancel signal")
+
+// Start rotates at the end of every window of the schedule, and sends the
+// window that ended to processMetricsNotify once its lines are in the
+// rotated file.
+func (l *LogRotate) Start(rotateChan chan<- bool, processMetricsNotify chan<- Window) error {
+
+	window := Window{Start: time.Now()}
+	next := l.schedule.Next(window.Start)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	var sizeC <-chan time.Time
+	if l.maxSize > 0 && !l.windowOnly {
+		sizeTicker := time.NewTicker(l.sizeCheckInterval)
+		defer sizeTicker.Stop()
+		sizeC = sizeTicker.C
+	}
 
 	for {
 		select {
 		case <-l.ctx.Done():
 			return ErrStoppedByCancelSignal
-		case <-ticker.C:
-			if err := l.rotate(rotateChan); err != nil {
-				return err
+		case <-timer.C:
+			window.End = next
+			window.Reason = ReasonInterval
+		case <-l.finish:
+			window.End = time.Now()
+			window.Reason = ReasonEndOfInput
+		case now := <-sizeC:
+			if !l.reachedMaxSize() {
+				continue
+			}
+			window.End = now
+			window.Reason = ReasonMaxSize
+		}
+		next = l.schedule.Next(window.End)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
-			processMetricsNotify <- true
+		}
+		timer.Reset(time.Until(next))
 
+		if !l.windowOnly {
+			if err := l.rotate(rotateChan, window.Reason); err != nil {
+				return err
+			}
+		}
+		select {
+		case processMetricsNotify <- window:
+		case <-l.ctx.Done():
+			return ErrStoppedByCancelSignal
 		}
+		if window.Reason == ReasonEndOfInput {
+			return nil
+		}
+		window = Window{Start: window.End}
 	}
 }
 
-func (l *LogRotate) rotate(rotateChan chan<- bool) error {
+func (l *LogRotate) reachedMaxSize() bool {
+	l.mu.Lock()
+	srcFile := l.srcFile
+	l.mu.Unlock()
+
+	info, err := os.Stat(srcFile)
+	return err == nil && info.Size() >= l.maxSize
+}
+
+func (l *LogRotate) rotate(rotateChan chan<- bool, reason string) error {
 	// Only lock the mutex when accessing shared state, not during I/O
 	l.mu.Lock()
 	dstFile := l.dstFile
@@ -69,16 +170,19 @@ func (l *LogRotate) rotate(rotateChan chan<- bool) error {
 		return err
 	}
 
-	dst, err := os.Create(dstFile)
+	// The rotated file is replaced rather than overwritten, so that the
+	// previous one can still be read, such as by an archive in progress.
+	dst, err := os.CreateTemp(dstDir, "."+filepath.Base(dstFile)+".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(dst.Name())
 	defer dst.Close()
 
 	src, err := os.OpenFile(srcFile, os.O_RDWR, 0644)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			return nil
+			return replaceFile(dst, dstFile)
 		}
 		return err
 	}
@@ -87,6 +191,9 @@ func (l *LogRotate) rotate(rotateChan chan<- bool) error {
 	if _, err = io.Copy(dst, src); err != nil {
 		return err
 	}
+	if err = replaceFile(dst, dstFile); err != nil {
+		return err
+	}
 
 	if err = src.Truncate(0); err != nil {
 		return err
@@ -99,7 +206,7 @@ func (l *LogRotate) rotate(rotateChan chan<- bool) error {
 				zap.String("redirect_file", srcFile),
 				zap.String("rotate_file", dstFile),
 				zap.Time("rotated_at", time.Now()),
-				zap.String("reason", "scheduled interval"),
+				zap.String("reason", reason),
 			)
 			return nil
 		case <-l.ctx.Done():
@@ -109,6 +216,17 @@ func (l *LogRotate) rotate(rotateChan chan<- bool) error {
 
 }
 
+// replaceFile closes the temporary file f and renames it to path.
+func replaceFile(f *os.File, path string) error {
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func (l *LogRotate) Stop() {
 	l.logger.Info("stopping logrotate component")
 	l.cancel()
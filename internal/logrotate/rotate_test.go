@@ -22,7 +22,7 @@ func TestRotateLog(t *testing.T) {
 		f.Write([]byte("CancelTest"))
 		f.Close()
 		rotateChan := make(chan bool)
-		processMetricsNotify := make(chan bool)
+		processMetricsNotify := make(chan Window)
 
 		logRotate := NewLogRotate(srcFile, destFile, interval, zap.NewNop())
 
@@ -41,7 +41,7 @@ func TestRotateLog(t *testing.T) {
 		destFile := "test_log/nonexistent_rotate.log"
 		interval := time.Millisecond * 200
 		rotateChan := make(chan bool)
-		processMetricsNotify := make(chan bool)
+		processMetricsNotify := make(chan Window)
 
 		logRotate := NewLogRotate(srcFile, destFile, interval, zap.NewNop())
 
@@ -67,19 +67,19 @@ func TestRotateLog(t *testing.T) {
 		f.WriteString("HelloWorld")
 		f.Close()
 		rotateChan := make(chan bool)
-		processMetricsNotify := make(chan bool)
+		processMetricsNotify := make(chan Window)
 
 		logRotate := NewLogRotate(srcFile, destFile, interval, zap.NewNop())
 
 		time.AfterFunc(time.Millisecond*700, func() {
 			logRotate.Stop()
-			cleanUpTestDir()
 		})
 
 		err = logRotate.Start(rotateChan, processMetricsNotify)
 		assert.Error(t, err)
 		dstData, _ := os.ReadFile(destFile)
 		assert.Equal(t, "HelloWorld", string(dstData), "got %s, want %s", "HelloWorld", dstData)
+		cleanUpTestDir()
 
 	})
 
@@ -95,7 +95,7 @@ func TestLogRotate_RotatedFileExistsAndContentMatches(t *testing.T) {
 		srcContent := []byte("Rotated file content check")
 		os.WriteFile(srcFile, srcContent, 0644)
 		rotateChan := make(chan bool)
-		processMetricsNotify := make(chan bool)
+		processMetricsNotify := make(chan Window)
 
 		logRotate := NewLogRotate(srcFile, dstFile, interval, zap.NewNop())
 		time.AfterFunc(time.Millisecond*170, func() {
@@ -124,6 +124,134 @@ func TestLogRotate_RotatedFileExistsAndContentMatches(t *testing.T) {
 	})
 }
 
+func TestLogRotateWindowOnly(t *testing.T) {
+	srcFile := "test_log/window_only.log"
+	dstFile := "test_log/window_only_rotated.log"
+	defer cleanUpTestDir()
+
+	os.MkdirAll(filepath.Dir(srcFile), 0755)
+	os.WriteFile(srcFile, []byte("untouched"), 0644)
+	processMetricsNotify := make(chan Window)
+
+	logRotate := NewLogRotate(srcFile, dstFile, time.Millisecond*50, zap.NewNop())
+	logRotate.WindowOnly()
+	done := make(chan error)
+	go func() {
+		done <- logRotate.Start(make(chan bool), processMetricsNotify)
+	}()
+
+	select {
+	case <-processMetricsNotify:
+	case <-time.After(time.Second):
+		t.Fatal("window boundary was not notified")
+	}
+	logRotate.Stop()
+	assert.Equal(t, ErrStoppedByCancelSignal, <-done)
+
+	srcContent, _ := os.ReadFile(srcFile)
+	assert.Equal(t, "untouched", string(srcContent))
+	_, err := os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(err), "rotated file should not be created")
+}
+
+func TestLogRotateFinish(t *testing.T) {
+	srcFile := "test_log/finish.log"
+	dstFile := "test_log/finish_rotated.log"
+	defer cleanUpTestDir()
+
+	os.MkdirAll(filepath.Dir(srcFile), 0755)
+	os.WriteFile(srcFile, []byte("last line\n"), 0644)
+	rotateChan := make(chan bool, 1)
+	processMetricsNotify := make(chan Window, 1)
+
+	logRotate := NewLogRotate(srcFile, dstFile, time.Hour, zap.NewNop())
+	done := make(chan error)
+	go func() {
+		done <- logRotate.Start(rotateChan, processMetricsNotify)
+	}()
+	logRotate.Finish()
+	logRotate.Finish()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("rotator did not return after the last window")
+	}
+	window := <-processMetricsNotify
+	assert.Equal(t, ReasonEndOfInput, window.Reason)
+	assert.WithinDuration(t, time.Now(), window.End, time.Second)
+	dstContent, _ := os.ReadFile(dstFile)
+	assert.Equal(t, "last line\n", string(dstContent), "the last window is rotated before the hour is up")
+}
+
+func TestLogRotateAlignedWindows(t *testing.T) {
+	srcFile := "test_log/aligned.log"
+	dstFile := "test_log/aligned_rotated.log"
+	defer cleanUpTestDir()
+
+	os.MkdirAll(filepath.Dir(srcFile), 0755)
+	os.WriteFile(srcFile, nil, 0644)
+	processMetricsNotify := make(chan Window)
+
+	interval := time.Millisecond * 100
+	logRotate := NewLogRotate(srcFile, dstFile, interval, zap.NewNop())
+	logRotate.UseSchedule(AlignedSchedule(interval, time.UTC))
+	done := make(chan error)
+	go func() {
+		done <- logRotate.Start(make(chan bool, 2), processMetricsNotify)
+	}()
+
+	first := <-processMetricsNotify
+	second := <-processMetricsNotify
+	logRotate.Stop()
+	assert.Equal(t, ErrStoppedByCancelSignal, <-done)
+
+	assert.Equal(t, ReasonInterval, first.Reason)
+	assert.Zero(t, first.End.UnixNano()%int64(interval), "window should end on an interval boundary")
+	assert.Equal(t, first.End, second.Start)
+	assert.Equal(t, interval, second.End.Sub(second.Start))
+}
+
+func TestLogRotateMaxSize(t *testing.T) {
+	srcFile := "test_log/max_size.log"
+	dstFile := "test_log/max_size_rotated.log"
+	defer cleanUpTestDir()
+
+	os.MkdirAll(filepath.Dir(srcFile), 0755)
+	os.WriteFile(srcFile, []byte("small"), 0644)
+	rotateChan := make(chan bool, 1)
+	processMetricsNotify := make(chan Window)
+
+	logRotate := NewLogRotate(srcFile, dstFile, time.Hour, zap.NewNop())
+	logRotate.RotateAtSize(10)
+	logRotate.sizeCheckInterval = time.Millisecond * 20
+	done := make(chan error)
+	go func() {
+		done <- logRotate.Start(rotateChan, processMetricsNotify)
+	}()
+
+	select {
+	case <-processMetricsNotify:
+		t.Fatal("rotated below the max size")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	os.WriteFile(srcFile, []byte("now over the limit"), 0644)
+	select {
+	case <-processMetricsNotify:
+	case <-time.After(time.Second):
+		t.Fatal("max size did not trigger a rotation")
+	}
+	logRotate.Stop()
+	assert.Equal(t, ErrStoppedByCancelSignal, <-done)
+
+	dstContent, _ := os.ReadFile(dstFile)
+	assert.Equal(t, "now over the limit", string(dstContent))
+	info, _ := os.Stat(srcFile)
+	assert.Equal(t, int64(0), info.Size())
+}
+
 func cleanUpTestDir() {
 	println("Removing the folder")
 	os.RemoveAll("test_log")
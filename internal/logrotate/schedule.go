@@ -0,0 +1,51 @@
+package logrotate
+
+import "time"
+
+// Schedule decides when a window ends.
+type Schedule interface {
+	// Next returns the end of the window starting at t.
+	Next(t time.Time) time.Time
+}
+
+// Window is the span of log lines evaluated together, delimited by two
+// rotations.
+type Window struct {
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+type intervalSchedule time.Duration
+
+// IntervalSchedule ends a window interval after it started.
+func IntervalSchedule(interval time.Duration) Schedule {
+	return intervalSchedule(interval)
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+type alignedSchedule struct {
+	interval time.Duration
+	loc      *time.Location
+}
+
+// AlignedSchedule ends windows on multiples of interval since midnight in
+// loc, so that a 1m interval ends windows on every minute and a 1h interval
+// on every hour. An interval that does not divide a day restarts at
+// midnight.
+func AlignedSchedule(interval time.Duration, loc *time.Location) Schedule {
+	return alignedSchedule{interval: interval, loc: loc}
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.loc)
+	next := midnight.Add((t.Sub(midnight)/s.interval + 1) * s.interval)
+	if tomorrow := midnight.AddDate(0, 0, 1); next.After(tomorrow) {
+		return tomorrow
+	}
+	return next
+}
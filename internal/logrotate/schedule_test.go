@@ -0,0 +1,33 @@
+package logrotate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.NoError(t, err)
+	at := time.Date(2026, 10, 16, 10, 3, 17, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		from     time.Time
+		want     time.Time
+	}{
+		{"interval", IntervalSchedule(time.Minute), at, at.Add(time.Minute)},
+		{"aligned minute", AlignedSchedule(time.Minute, time.UTC), at, time.Date(2026, 10, 16, 10, 4, 0, 0, time.UTC)},
+		{"aligned on a boundary", AlignedSchedule(time.Minute, time.UTC), time.Date(2026, 10, 16, 10, 4, 0, 0, time.UTC), time.Date(2026, 10, 16, 10, 5, 0, 0, time.UTC)},
+		{"aligned hour in timezone", AlignedSchedule(time.Hour, kolkata), at, time.Date(2026, 10, 16, 16, 0, 0, 0, kolkata)},
+		{"aligned day", AlignedSchedule(24*time.Hour, kolkata), at, time.Date(2026, 10, 17, 0, 0, 0, 0, kolkata)},
+		{"uneven interval restarts at midnight", AlignedSchedule(7*time.Minute, time.UTC), time.Date(2026, 10, 16, 23, 55, 0, 0, time.UTC), time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.True(t, tt.want.Equal(tt.schedule.Next(tt.from)), "got %s", tt.schedule.Next(tt.from))
+		})
+	}
+}
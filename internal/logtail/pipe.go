@@ -0,0 +1,117 @@
+package logtail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrEndOfInput is returned by a Reader, and by Start, at the end of an
+// input that cannot be reopened, such as stdin.
+var ErrEndOfInput = errors.New("end of input")
+
+// PipeReader reads lines from stdin or from a named pipe, with the same
+// framing as tailed files.
+type PipeReader struct {
+	// path is the named pipe, or "" for stdin.
+	path   string
+	logger *zap.Logger
+}
+
+// NewStdinReader returns a reader of stdin, which returns ErrEndOfInput at
+// the end of stdin.
+func NewStdinReader(logger *zap.Logger) *PipeReader {
+	return &PipeReader{logger: logger}
+}
+
+// NewFIFOReader returns a reader of the named pipe at path. The pipe is
+// reopened whenever its last writer closes it.
+func NewFIFOReader(path string, logger *zap.Logger) *PipeReader {
+	return &PipeReader{path: path, logger: logger}
+}
+
+// stdinLines reads stdin once for the whole process, so that a source
+// restarted on reload resumes where the previous reader stopped.
+var stdinLines = sync.OnceValue(func() <-chan []byte {
+	return readLines(os.Stdin, nil, zap.NewNop())
+})
+
+func (r *PipeReader) Run(ctx context.Context, emit func([]byte) error) error {
+	if r.path == "" {
+		if err := forward(ctx, stdinLines(), emit); err != nil || ctx.Err() != nil {
+			return err
+		}
+		r.logger.Info("end of stdin")
+		return ErrEndOfInput
+	}
+	for {
+		f, err := openFIFO(ctx, r.path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to open %s %w", r.path, err)
+		}
+		done := make(chan struct{})
+		err = forward(ctx, readLines(f, done, r.logger), emit)
+		close(done)
+		f.Close()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		r.logger.Info("named pipe closed by its writers, waiting for a new writer", zap.String("src", r.path))
+	}
+}
+
+// forward emits the lines received until lines is closed or ctx is
+// cancelled.
+func forward(ctx context.Context, lines <-chan []byte, emit func([]byte) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readLines sends the lines of r, without their trailing newline, until the
+// end of r or until done is closed. A last line without a newline is sent
+// at the end of r.
+func readLines(r io.Reader, done <-chan struct{}, logger *zap.Logger) <-chan []byte {
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				select {
+				case lines <- bytes.TrimRight(line, "\r\n"):
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+					logger.Warn("read failed", zap.Error(err))
+				}
+				return
+			}
+		}
+	}()
+	return lines
+}
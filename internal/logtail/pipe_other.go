@@ -0,0 +1,13 @@
+//go:build !unix
+
+package logtail
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+func openFIFO(ctx context.Context, path string) (*os.File, error) {
+	return nil, errors.New("named pipes are not supported on this platform")
+}
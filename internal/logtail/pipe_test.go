@@ -0,0 +1,76 @@
+//go:build unix
+
+package logtail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReadLines(t *testing.T) {
+	var got []string
+	for line := range readLines(strings.NewReader("first\r\n\nsecond\nlast"), nil, zap.NewNop()) {
+		got = append(got, string(line))
+	}
+	assert.Equal(t, []string{"first", "", "second", "last"}, got)
+}
+
+func TestFIFOReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.pipe")
+	assert.NoError(t, syscall.Mkfifo(path, 0600))
+
+	var mu sync.Mutex
+	var got []string
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewFIFOReader(path, zap.NewNop()).Run(ctx, func(line []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, string(line))
+			return nil
+		})
+	}()
+
+	// Each writer closing the pipe is followed by a reopen.
+	for _, content := range []string{"first\nsecond\n", "third"} {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		assert.NoError(t, err)
+		_, err = f.WriteString(content)
+		assert.NoError(t, err)
+		f.Close()
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"first", "second", "third"}, got)
+	mu.Unlock()
+
+	// Cancelling releases the reader waiting for a writer.
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader did not stop")
+	}
+
+	err := NewFIFOReader(filepath.Join(t.TempDir(), "missing"), zap.NewNop()).Run(context.Background(), nil)
+	assert.Error(t, err)
+	regular := filepath.Join(t.TempDir(), "regular.log")
+	assert.NoError(t, os.WriteFile(regular, nil, 0644))
+	err = NewFIFOReader(regular, zap.NewNop()).Run(context.Background(), nil)
+	assert.ErrorContains(t, err, "is not a named pipe")
+}
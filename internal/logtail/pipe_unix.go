@@ -0,0 +1,52 @@
+//go:build unix
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// openFIFO opens the named pipe at path for reading, which blocks until a
+// writer opens it or ctx is cancelled.
+func openFIFO(ctx context.Context, path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a named pipe", path)
+	}
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.Open(path)
+		opened <- result{f, err}
+	}()
+	select {
+	case res := <-opened:
+		return res.f, res.err
+	case <-ctx.Done():
+	}
+	// Opening the pipe for writing releases the pending open, which may not
+	// have started yet.
+	for {
+		if w, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+		}
+		select {
+		case res := <-opened:
+			if res.f != nil {
+				res.f.Close()
+			}
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
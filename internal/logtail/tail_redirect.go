@@ -2,29 +2,50 @@ package logtail
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/akmanon/kpi-metricsd/internal/checkpoint"
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 )
 
+// tailedFile is a single source file being followed, with its own offset.
+type tailedFile struct {
+	path   string
+	file   *os.File
+	reader *bufio.Reader
+	offset atomic.Int64
+	// published is the offset the checkpoint records when only published
+	// lines are checkpointed.
+	published atomic.Int64
+
+	// partial holds an unterminated last line until the rest of it is
+	// written.
+	partial []byte
+}
+
 type TailAndRedirect struct {
-	dstFilename      string
-	dstFilePath      string
-	dstFile          *os.File
-	srcFile          *os.File
-	srcFilename      string
-	srcFilePath      string
-	srcReader        *bufio.Reader
-	srcFileShortName string
-	srcOffset        int64
+	dstFilename string
+	dstFilePath string
+	dstFile     *os.File
+
+	// srcPattern is either a plain path or a glob. Every matching file is
+	// tailed on its own and redirected to the same destination.
+	srcPattern    string
+	srcIsGlob     bool
+	srcFiles      map[string]*tailedFile
+	filesMu       sync.Mutex
+	initialWhence int
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -32,35 +53,155 @@ type TailAndRedirect struct {
 	mu     sync.RWMutex
 
 	srcPollTruncate    time.Duration
+	srcRescan          time.Duration
 	fsWatcher          *fsnotify.Watcher
-	truncateDetectorCh chan struct{}
+	truncateDetectorCh chan string
 	truncateErrCh      chan error
 	dstWriter          *bufio.Writer
 	flushTicker        *time.Ticker
+	rescanTicker       *time.Ticker
+
+	checkpoint         *checkpoint.Store
+	checkpointInterval time.Duration
+	// publishedOnly makes the checkpoint record the offsets, and the reader
+	// position, committed by Mark instead of those of every line read.
+	publishedOnly     bool
+	publishedPosition string
+
+	stream chan<- []byte
+
+	// reader, when set, produces the lines instead of tailed files.
+	reader Reader
+}
+
+// Reader is an input producing lines other than by tailing files, such as
+// a network listener.
+type Reader interface {
+	// Run calls emit with every line, without its trailing newline, until
+	// ctx is cancelled or the input ends. emit does not retain the line and
+	// fails once the tailer stops.
+	Run(ctx context.Context, emit func([]byte) error) error
+}
+
+// Positioner is a Reader that can resume where a previous run stopped,
+// such as at a journal cursor. Its position is recorded in the checkpoint
+// of the source.
+type Positioner interface {
+	// Position returns the position reached by the lines emitted so far,
+	// or "" before the first one.
+	Position() string
+	// Resume makes Run start after position.
+	Resume(position string)
 }
 
+// readerCheckpointKey is the checkpoint entry holding the position of a
+// Positioner.
+const readerCheckpointKey = "input"
+
+// whenceResume positions a source file at its checkpointed offset, falling
+// back to initialWhence when there is no matching checkpoint entry.
+const whenceResume = -1
+
 func NewTailAndRedirect(srcFile, dstFile string, logger *zap.Logger) *TailAndRedirect {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &TailAndRedirect{
 		dstFilename:        dstFile,
 		dstFilePath:        filepath.Dir(dstFile),
-		srcFilename:        srcFile,
-		srcFilePath:        filepath.Dir(srcFile),
-		srcFileShortName:   filepath.Base(srcFile),
+		srcPattern:         filepath.Clean(srcFile),
+		srcIsGlob:          IsGlob(srcFile),
+		srcFiles:           make(map[string]*tailedFile),
+		initialWhence:      io.SeekEnd,
 		ctx:                ctx,
 		cancel:             cancel,
 		logger:             logger,
 		srcPollTruncate:    200 * time.Millisecond,
-		truncateDetectorCh: make(chan struct{}, 1),
+		srcRescan:          5 * time.Second,
+		truncateDetectorCh: make(chan string, 1),
 		truncateErrCh:      make(chan error, 1),
 	}
 }
 
+// IsGlob reports whether path contains any glob meta characters.
+func IsGlob(path string) bool {
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFromBeginning makes Start read the source files that already exist
+// from their first byte instead of from their end.
+func (t *TailAndRedirect) ReadFromBeginning() {
+	t.initialWhence = io.SeekStart
+}
+
+// UseCheckpoint resumes source files from the offsets recorded in store and
+// records the current offsets every interval and on Stop. The redirect file
+// is appended to instead of truncated so that lines redirected before a
+// restart are still rotated.
+func (t *TailAndRedirect) UseCheckpoint(store *checkpoint.Store, interval time.Duration) {
+	t.checkpoint = store
+	t.checkpointInterval = interval
+}
+
+// StreamTo sends every complete line, without its trailing newline, to ch.
+// When redirect is false no redirect file is written at all.
+func (t *TailAndRedirect) StreamTo(ch chan<- []byte, redirect bool) {
+	t.stream = ch
+	if !redirect {
+		t.dstFilename = ""
+	}
+}
+
+// CheckpointPublished makes the checkpoint record only the lines whose
+// window has been published, as committed through Mark, so that a restart
+// reads again the lines that were only counted in an unpublished window.
+func (t *TailAndRedirect) CheckpointPublished() {
+	t.publishedOnly = true
+}
+
+// Mark returns a function committing the offsets, and the reader position,
+// reached by the lines streamed so far. It is called as a window ends and
+// the function once every line streamed before has been published.
+func (t *TailAndRedirect) Mark() func() {
+	files := t.trackedFiles()
+	offsets := make([]int64, len(files))
+	for i, tf := range files {
+		offsets[i] = tf.offset.Load()
+	}
+	var position string
+	if p, ok := t.reader.(Positioner); ok {
+		position = p.Position()
+	}
+	return func() {
+		for i, tf := range files {
+			tf.published.Store(offsets[i])
+		}
+		if position != "" {
+			t.mu.Lock()
+			t.publishedPosition = position
+			t.mu.Unlock()
+		}
+	}
+}
+
+// ReadFrom makes the tailer redirect and stream the lines of r instead of
+// tailing the source files.
+func (t *TailAndRedirect) ReadFrom(r Reader) {
+	t.reader = r
+}
+
 func (t *TailAndRedirect) Start(rotateChan <-chan bool) error {
 	if err := t.openDstFile(); err != nil {
 		t.logger.Error("failed to open destination", zap.Error(err))
 		return err
 	}
+	if t.reader != nil {
+		return t.runReader(rotateChan)
+	}
 	if err := t.initFsWatcher(); err != nil {
 		t.logger.Error("failed to init fsnotify", zap.Error(err))
 		return err
@@ -69,18 +210,27 @@ func (t *TailAndRedirect) Start(rotateChan <-chan bool) error {
 		t.logger.Error("failed to init source", zap.Error(err))
 	}
 
+	// Stop may run concurrently with Start.
+	t.mu.Lock()
 	t.flushTicker = time.NewTicker(100 * time.Millisecond)
+	if t.srcIsGlob {
+		t.rescanTicker = time.NewTicker(t.srcRescan)
+	}
+	t.mu.Unlock()
 
 	go t.handleRotate(rotateChan)
 	go t.detectTruncate()
 	go t.periodicFlush()
+	if t.checkpoint != nil {
+		go t.periodicCheckpoint()
+	}
 
 	for {
 		select {
 		case <-t.ctx.Done():
 			return nil
 		default:
-			t.readLineAndRedirect()
+			t.readAndRedirect()
 			if err := t.watchSrcFileEvent(); err != nil {
 				if err == ErrFileDeleted {
 					t.logger.Info("reopening after delete")
@@ -107,10 +257,17 @@ func (t *TailAndRedirect) handleRotate(rotateChan <-chan bool) {
 }
 
 func (t *TailAndRedirect) openDstFile() error {
+	if t.dstFilename == "" {
+		return nil
+	}
 	if err := os.MkdirAll(t.dstFilePath, 0755); err != nil {
 		return fmt.Errorf("mkdir failed: %w", err)
 	}
-	f, err := os.Create(t.dstFilename)
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if t.checkpoint != nil {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(t.dstFilename, flag, 0644)
 	if err != nil {
 		return fmt.Errorf("create file failed: %w", err)
 	}
@@ -119,14 +276,38 @@ func (t *TailAndRedirect) openDstFile() error {
 	return nil
 }
 
+// initOpenSrcFile opens the source files. A plain path is waited for until
+// it exists, while a glob opens whatever currently matches and relies on
+// watch events and rescans to pick up files created later.
 func (t *TailAndRedirect) initOpenSrcFile() error {
+	if t.srcIsGlob {
+		matches, err := filepath.Glob(t.srcPattern)
+		if err != nil {
+			return err
+		}
+		for _, path := range matches {
+			if t.trackedFile(path) != nil {
+				continue
+			}
+			if err := t.openSrcFile(path, whenceResume); err != nil {
+				t.logger.Warn("failed to open source file", zap.String("file", path), zap.Error(err))
+			}
+		}
+		if len(matches) == 0 {
+			t.logger.Info("waiting for source logs", zap.String("src", t.srcPattern))
+		}
+		return nil
+	}
 	for {
-		err := t.openSrcFileAndSeekEnd()
+		if t.trackedFile(t.srcPattern) != nil {
+			return nil
+		}
+		err := t.openSrcFile(t.srcPattern, whenceResume)
 		if err == nil {
 			return nil
 		}
 		if os.IsNotExist(err) {
-			t.logger.Info("waiting for source log", zap.String("src", t.srcFilename))
+			t.logger.Info("waiting for source log", zap.String("src", t.srcPattern))
 		}
 		if err := t.watchSrcFileEvent(); err != nil {
 			return err
@@ -134,41 +315,101 @@ func (t *TailAndRedirect) initOpenSrcFile() error {
 	}
 }
 
-func (t *TailAndRedirect) openSrcFileAndSeekEnd() error {
-	t.resetSrcFile()
-	f, err := os.OpenFile(t.srcFilename, os.O_RDONLY, 0644)
+// openSrcFile (re)opens path and positions it according to whence.
+func (t *TailAndRedirect) openSrcFile(path string, whence int) error {
+	t.closeSrcFile(path)
+	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
-	t.srcFile = f
-	t.srcOffset, err = f.Seek(0, io.SeekEnd)
+	var offset int64
+	if whence == whenceResume {
+		offset, err = t.resumeOffset(f, path)
+	} else {
+		offset, err = f.Seek(0, whence)
+	}
 	if err != nil {
 		f.Close()
 		return err
 	}
-	t.srcReader = bufio.NewReaderSize(f, 64*1024)
-	t.logger.Info("source file opened", zap.String("file", t.srcFilename))
+	tf := &tailedFile{
+		path:   path,
+		file:   f,
+		reader: bufio.NewReaderSize(f, 64*1024),
+	}
+	tf.offset.Store(offset)
+	tf.published.Store(offset)
+
+	t.filesMu.Lock()
+	t.srcFiles[path] = tf
+	t.filesMu.Unlock()
+	t.logger.Info("source file opened", zap.String("file", path), zap.Int64("offset", offset))
 	return nil
 }
 
-func (t *TailAndRedirect) resetSrcFile() {
-	if t.srcFile != nil {
-		t.srcFile.Close()
+func (t *TailAndRedirect) resumeOffset(f *os.File, path string) (int64, error) {
+	if t.checkpoint != nil {
+		if e, ok := t.checkpoint.Get(path); ok {
+			info, err := f.Stat()
+			if err == nil && e.Matches(info) && e.Offset <= info.Size() {
+				t.logger.Info("resuming from checkpoint", zap.String("file", path), zap.Int64("offset", e.Offset))
+				return f.Seek(e.Offset, io.SeekStart)
+			}
+			t.logger.Info("checkpoint does not match source file", zap.String("file", path))
+		}
+	}
+	return f.Seek(0, t.initialWhence)
+}
+
+func (t *TailAndRedirect) closeSrcFile(path string) {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	if tf, ok := t.srcFiles[path]; ok {
+		tf.file.Close()
+		delete(t.srcFiles, path)
+	}
+}
+
+func (t *TailAndRedirect) trackedFile(path string) *tailedFile {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	return t.srcFiles[path]
+}
+
+func (t *TailAndRedirect) trackedFiles() []*tailedFile {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	files := make([]*tailedFile, 0, len(t.srcFiles))
+	for _, tf := range t.srcFiles {
+		files = append(files, tf)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
+
+func (t *TailAndRedirect) readAndRedirect() {
+	for _, tf := range t.trackedFiles() {
+		t.readLineAndRedirect(tf)
 	}
-	t.srcReader = nil
-	t.srcFile = nil
 }
 
-func (t *TailAndRedirect) readLineAndRedirect() {
+func (t *TailAndRedirect) readLineAndRedirect(tf *tailedFile) {
 
-	if t.srcReader == nil {
+	if tf == nil || tf.reader == nil {
 		return
 	}
 	for {
-		line, err := t.srcReader.ReadBytes('\n')
-		if len(line) > 0 {
+		line, err := tf.reader.ReadBytes('\n')
+		if t.stream != nil {
+			if !t.streamLine(tf, line) {
+				return
+			}
+		} else if line, ok := tf.completeLine(line); ok {
 			t.mu.RLock()
 			_, werr := t.dstWriter.Write(line)
+			if werr == nil {
+				tf.offset.Add(int64(len(line)))
+			}
 			t.mu.RUnlock()
 			if werr != nil {
 				t.logger.Error("write failed", zap.Error(werr))
@@ -176,21 +417,135 @@ func (t *TailAndRedirect) readLineAndRedirect() {
 			}
 		}
 		if err != nil {
-			if err == io.EOF {
-				if t.srcFile != nil {
-					if off, serr := t.srcFile.Seek(0, io.SeekCurrent); serr == nil {
-						t.srcOffset = off
-					}
-				}
-			}
 			break
 		}
 	}
 }
 
+// completeLine returns line, joined to the start of it read before, once
+// it ends with a newline. A line without a trailing newline is held back
+// until it is complete, so a line is never split into two events nor mixed
+// with a line of another file redirected to the same file.
+func (tf *tailedFile) completeLine(line []byte) ([]byte, bool) {
+	if len(line) == 0 {
+		return nil, false
+	}
+	if line[len(line)-1] != '\n' {
+		tf.partial = append(tf.partial, line...)
+		return nil, false
+	}
+	if len(tf.partial) > 0 {
+		line = append(tf.partial, line...)
+		tf.partial = nil
+	}
+	return line, true
+}
+
+// streamLine redirects and streams one line read from tf once it is
+// complete. It returns false when the line could not be handed off.
+func (t *TailAndRedirect) streamLine(tf *tailedFile, line []byte) bool {
+	line, ok := tf.completeLine(line)
+	if !ok {
+		return true
+	}
+
+	if t.dstWriter != nil {
+		t.mu.RLock()
+		_, werr := t.dstWriter.Write(line)
+		t.mu.RUnlock()
+		if werr != nil {
+			t.logger.Error("write failed", zap.Error(werr))
+			return false
+		}
+	}
+	select {
+	case t.stream <- bytes.TrimRight(line, "\r\n"):
+	case <-t.ctx.Done():
+		return false
+	}
+	tf.offset.Add(int64(len(line)))
+	return true
+}
+
+func (t *TailAndRedirect) runReader(rotateChan <-chan bool) error {
+	t.mu.Lock()
+	t.flushTicker = time.NewTicker(100 * time.Millisecond)
+	t.mu.Unlock()
+	go t.handleRotate(rotateChan)
+	go t.periodicFlush()
+	if p, ok := t.reader.(Positioner); ok && t.checkpoint != nil {
+		if e, ok := t.checkpoint.Get(readerCheckpointKey); ok && e.Position != "" {
+			t.logger.Info("resuming from checkpoint", zap.String("position", e.Position))
+			p.Resume(e.Position)
+			t.mu.Lock()
+			t.publishedPosition = e.Position
+			t.mu.Unlock()
+		}
+		go t.periodicCheckpoint()
+	}
+	err := t.reader.Run(t.ctx, t.emit)
+	if errors.Is(err, ErrEndOfInput) {
+		// The last window is rotated once the input has ended, so its
+		// lines must be in the redirect file.
+		t.mu.Lock()
+		if t.dstWriter != nil {
+			if err := t.dstWriter.Flush(); err != nil {
+				t.logger.Warn("flush failed", zap.Error(err))
+			}
+		}
+		t.mu.Unlock()
+	}
+	if err != nil && t.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// emit redirects and streams a line produced by the reader.
+func (t *TailAndRedirect) emit(line []byte) error {
+	if t.dstWriter != nil {
+		t.mu.RLock()
+		// Stop closes the redirect file once the context is cancelled.
+		if err := t.ctx.Err(); err != nil {
+			t.mu.RUnlock()
+			return err
+		}
+		_, err := t.dstWriter.Write(line)
+		if err == nil {
+			err = t.dstWriter.WriteByte('\n')
+		}
+		t.mu.RUnlock()
+		if err != nil {
+			t.logger.Error("write failed", zap.Error(err))
+			return err
+		}
+	}
+	if t.stream != nil {
+		select {
+		case t.stream <- bytes.Clone(line):
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		}
+	}
+	return nil
+}
+
 var ErrFileDeleted = errors.New("source file removed or renamed")
 
+func (t *TailAndRedirect) matchesSrc(name string) bool {
+	name = filepath.Clean(name)
+	if !t.srcIsGlob {
+		return name == t.srcPattern
+	}
+	ok, _ := filepath.Match(t.srcPattern, name)
+	return ok
+}
+
 func (t *TailAndRedirect) watchSrcFileEvent() error {
+	var rescanC <-chan time.Time
+	if t.rescanTicker != nil {
+		rescanC = t.rescanTicker.C
+	}
 	select {
 	case <-t.ctx.Done():
 		return fmt.Errorf("watcher stopped")
@@ -198,29 +553,78 @@ func (t *TailAndRedirect) watchSrcFileEvent() error {
 		if !ok {
 			return fmt.Errorf("event channel closed")
 		}
-		if filepath.Base(event.Name) != t.srcFileShortName {
+		if !t.matchesSrc(event.Name) {
 			return nil
 		}
+		name := filepath.Clean(event.Name)
 		switch {
 		case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
-			t.logger.Info("file deleted/renamed")
-			t.resetSrcFile()
-			return ErrFileDeleted
+			t.logger.Info("file deleted/renamed", zap.String("file", name))
+			t.closeSrcFile(name)
+			if !t.srcIsGlob {
+				return ErrFileDeleted
+			}
 		case event.Has(fsnotify.Create):
-			t.logger.Info("file created")
-			return t.openSrcFileAndSeekEnd()
+			if t.trackedFile(name) != nil {
+				return nil
+			}
+			t.logger.Info("file created", zap.String("file", name))
+			return t.openSrcFile(name, io.SeekStart)
 		}
 	case err := <-t.fsWatcher.Errors:
 		return fmt.Errorf("watcher error: %w", err)
-	case <-t.truncateDetectorCh:
-		t.logger.Info("truncate detected, reopening")
-		return t.openSrcFileAndSeekEnd()
+	case path := <-t.truncateDetectorCh:
+		t.logger.Info("truncate detected, reopening", zap.String("file", path))
+		return t.openSrcFile(path, io.SeekEnd)
 	case <-t.truncateErrCh:
 		return fmt.Errorf("truncate detector stopped")
+	case <-rescanC:
+		t.rescanSrc()
 	}
 	return nil
 }
 
+// rescanSrc watches directories and opens files matching the glob that
+// appeared without an fsnotify event, e.g. under a newly created directory.
+func (t *TailAndRedirect) rescanSrc() {
+	watched := make(map[string]bool)
+	for _, dir := range t.fsWatcher.WatchList() {
+		watched[filepath.Clean(dir)] = true
+	}
+	for _, dir := range t.srcDirs() {
+		if watched[dir] {
+			continue
+		}
+		if err := t.fsWatcher.Add(dir); err != nil {
+			t.logger.Warn("failed to watch directory", zap.String("dir", dir), zap.Error(err))
+		}
+	}
+
+	matches, err := filepath.Glob(t.srcPattern)
+	if err != nil {
+		return
+	}
+	for _, path := range matches {
+		if t.trackedFile(path) != nil {
+			continue
+		}
+		if err := t.openSrcFile(path, io.SeekStart); err != nil {
+			t.logger.Warn("failed to open source file", zap.String("file", path), zap.Error(err))
+		}
+	}
+}
+
+// srcDirs returns the directories that need to be watched for the source
+// pattern. Wildcards in the directory part are expanded.
+func (t *TailAndRedirect) srcDirs() []string {
+	dir := filepath.Dir(t.srcPattern)
+	if !IsGlob(dir) {
+		return []string{dir}
+	}
+	dirs, _ := filepath.Glob(dir)
+	return dirs
+}
+
 func (t *TailAndRedirect) detectTruncate() {
 	ticker := time.NewTicker(t.srcPollTruncate)
 	defer ticker.Stop()
@@ -229,11 +633,11 @@ func (t *TailAndRedirect) detectTruncate() {
 		case <-t.ctx.Done():
 			return
 		case <-ticker.C:
-			if t.srcFile != nil {
-				info, err := t.srcFile.Stat()
-				if err == nil && info.Size() < t.srcOffset {
+			for _, tf := range t.trackedFiles() {
+				info, err := tf.file.Stat()
+				if err == nil && info.Size() < tf.offset.Load() {
 					select {
-					case t.truncateDetectorCh <- struct{}{}:
+					case t.truncateDetectorCh <- tf.path:
 					default:
 					}
 				}
@@ -259,27 +663,102 @@ func (t *TailAndRedirect) periodicFlush() {
 	}
 }
 
+func (t *TailAndRedirect) periodicCheckpoint() {
+	ticker := time.NewTicker(t.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.saveCheckpoint(); err != nil {
+				t.logger.Warn("checkpoint failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// saveCheckpoint flushes the redirect file before recording the offsets so
+// a checkpoint never points past data that only lived in the write buffer.
+func (t *TailAndRedirect) saveCheckpoint() error {
+	entries := make(map[string]checkpoint.Entry)
+	t.mu.Lock()
+	if t.dstWriter != nil {
+		if err := t.dstWriter.Flush(); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	for _, tf := range t.trackedFiles() {
+		info, err := tf.file.Stat()
+		if err != nil {
+			continue
+		}
+		offset := tf.offset.Load()
+		if t.publishedOnly {
+			offset = tf.published.Load()
+		}
+		entries[tf.path] = checkpoint.NewEntry(info, offset)
+	}
+	if p, ok := t.reader.(Positioner); ok {
+		pos := p.Position()
+		if t.publishedOnly {
+			pos = t.publishedPosition
+		}
+		if pos != "" {
+			entries[readerCheckpointKey] = checkpoint.Entry{Position: pos}
+		}
+	}
+	t.mu.Unlock()
+
+	t.checkpoint.Replace(entries)
+	return t.checkpoint.Save()
+}
+
 func (t *TailAndRedirect) initFsWatcher() error {
-	var err error
-	t.fsWatcher, err = fsnotify.NewWatcher()
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	return t.fsWatcher.Add(t.srcFilePath)
+	// Stop may run concurrently with Start.
+	t.mu.Lock()
+	t.fsWatcher = w
+	t.mu.Unlock()
+	for _, dir := range t.srcDirs() {
+		if err := w.Add(dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (t *TailAndRedirect) Stop() {
 	t.logger.Info("stopping tailandredirect component")
 	t.cancel()
-	t.flushTicker.Stop()
+	t.mu.Lock()
+	if t.flushTicker != nil {
+		t.flushTicker.Stop()
+	}
+	if t.rescanTicker != nil {
+		t.rescanTicker.Stop()
+	}
+	t.mu.Unlock()
+	if t.checkpoint != nil {
+		if err := t.saveCheckpoint(); err != nil {
+			t.logger.Warn("checkpoint failed", zap.Error(err))
+		}
+	}
+	t.mu.Lock()
 	if t.dstFile != nil {
 		t.dstWriter.Flush()
 		t.dstFile.Close()
 	}
-	if t.srcFile != nil {
-		t.srcFile.Close()
+	fsWatcher := t.fsWatcher
+	t.mu.Unlock()
+	for _, tf := range t.trackedFiles() {
+		t.closeSrcFile(tf.path)
 	}
-	if t.fsWatcher != nil {
-		t.fsWatcher.Close()
+	if fsWatcher != nil {
+		fsWatcher.Close()
 	}
 }
@@ -7,9 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/akmanon/kpi-metricsd/internal/checkpoint"
 	"github.com/fsnotify/fsnotify"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -85,8 +88,10 @@ func TestTailAndRedirect(t *testing.T) {
 		assert.NoError(t, err)
 		err = tr.initOpenSrcFile()
 		assert.NoError(t, err)
-		assert.NotNil(t, tr.srcFile)
-		assert.NotNil(t, tr.srcReader)
+		tf := tr.trackedFile(srcFile)
+		assert.NotNil(t, tf)
+		assert.NotNil(t, tf.file)
+		assert.NotNil(t, tf.reader)
 		fmt.Println("before srcfile stop")
 		tr.Stop()
 	})
@@ -119,8 +124,10 @@ func TestTailAndRedirect(t *testing.T) {
 		select {
 		case err := <-done:
 			assert.NoError(t, err)
-			assert.NotNil(t, tr.srcFile)
-			assert.NotNil(t, tr.srcReader)
+			tf := tr.trackedFile(srcFile)
+			assert.NotNil(t, tf)
+			assert.NotNil(t, tf.file)
+			assert.NotNil(t, tf.reader)
 		case <-time.After(2 * time.Second):
 			t.Fatal("initOpenSrcFile did not return after file was created")
 		}
@@ -160,28 +167,31 @@ func TestTailAndRedirect(t *testing.T) {
 		assert.NoError(t, err)
 		defer dstF.Close()
 
+		tf := &tailedFile{
+			file:   srcF,
+			reader: bufio.NewReaderSize(srcF, 64*1024),
+		}
 		tr := &TailAndRedirect{
-			srcFile:   srcF,
-			srcReader: bufio.NewReaderSize(srcF, 64*1024),
 			dstFile:   dstF,
 			dstWriter: bufio.NewWriterSize(dstF, 64*1024),
 			logger:    logger,
 		}
 
-		tr.readLineAndRedirect()
+		tr.readLineAndRedirect(tf)
 		tr.dstWriter.Flush()
 		dstF.Sync()
 		b, err := os.ReadFile(dstFile)
 		assert.NoError(t, err)
 		assert.Equal(t, lines[0]+lines[1]+lines[2], string(b))
+		assert.Equal(t, int64(len(b)), tf.offset.Load())
 	})
 
 	t.Run("readLineAndRedirect_NoSrcScanner", func(t *testing.T) {
 		tr := &TailAndRedirect{
-			srcReader: nil,
-			logger:    logger,
+			logger: logger,
 		}
-		tr.readLineAndRedirect()
+		tr.readLineAndRedirect(&tailedFile{})
+		tr.readLineAndRedirect(nil)
 	})
 
 	t.Run("readLineAndRedirect_WriteError", func(t *testing.T) {
@@ -190,9 +200,10 @@ func TestTailAndRedirect(t *testing.T) {
 		defer w.Close()
 
 		dstFile := &errWriter{}
+		tf := &tailedFile{
+			reader: bufio.NewReaderSize(r, 64*1024),
+		}
 		tr := &TailAndRedirect{
-			srcFile:   nil,
-			srcReader: bufio.NewReaderSize(r, 64*1024),
 			dstWriter: bufio.NewWriterSize(dstFile, 64*1024),
 			logger:    logger,
 		}
@@ -202,7 +213,7 @@ func TestTailAndRedirect(t *testing.T) {
 			w.Close()
 		}()
 
-		tr.readLineAndRedirect()
+		tr.readLineAndRedirect(tf)
 	})
 
 	t.Run("detectTruncate_SendsSignalOnTruncate", func(t *testing.T) {
@@ -219,11 +230,12 @@ func TestTailAndRedirect(t *testing.T) {
 		assert.NoError(t, err)
 		defer f.Close()
 
+		tf := &tailedFile{path: srcFile, file: f}
+		tf.offset.Store(12)
 		tr := &TailAndRedirect{
-			srcFile:            f,
-			srcOffset:          12,
+			srcFiles:           map[string]*tailedFile{srcFile: tf},
 			srcPollTruncate:    10 * time.Millisecond,
-			truncateDetectorCh: make(chan struct{}, 1),
+			truncateDetectorCh: make(chan string, 1),
 			ctx:                ctx,
 			logger:             logger,
 		}
@@ -237,7 +249,8 @@ func TestTailAndRedirect(t *testing.T) {
 		assert.NoError(t, err)
 
 		select {
-		case <-tr.truncateDetectorCh:
+		case path := <-tr.truncateDetectorCh:
+			assert.Equal(t, srcFile, path)
 		case <-time.After(500 * time.Millisecond):
 			t.Fatal("did not receive truncate signal")
 		}
@@ -250,13 +263,13 @@ func TestTailAndRedirect(t *testing.T) {
 
 		tr := &TailAndRedirect{
 			srcPollTruncate:    10 * time.Millisecond,
-			truncateDetectorCh: make(chan struct{}, 1),
+			truncateDetectorCh: make(chan string, 1),
 			ctx:                ctx,
 			logger:             logger,
 		}
 
 		go func() {
-			tr.truncateDetectorCh <- struct{}{}
+			tr.truncateDetectorCh <- ""
 		}()
 
 		cancel()
@@ -279,10 +292,9 @@ func TestTailAndRedirect(t *testing.T) {
 		f.Close()
 
 		tr := &TailAndRedirect{
-			srcFile:            f,
-			srcOffset:          0,
+			srcFiles:           map[string]*tailedFile{srcFile: {path: srcFile, file: f}},
 			srcPollTruncate:    10 * time.Millisecond,
-			truncateDetectorCh: make(chan struct{}, 1),
+			truncateDetectorCh: make(chan string, 1),
 			ctx:                ctx,
 			logger:             logger,
 		}
@@ -296,6 +308,446 @@ func TestTailAndRedirect(t *testing.T) {
 	})
 }
 
+func TestTailAndRedirectGlob(t *testing.T) {
+	logger := zap.NewNop()
+
+	t.Run("Start_TailsAllMatchingFiles", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		dstFile := filepath.Join(tmpDir, "out", "dst.log")
+		existing := filepath.Join(tmpDir, "a.log")
+		ignored := filepath.Join(tmpDir, "a.txt")
+		assert.NoError(t, os.WriteFile(existing, []byte("old line\n"), 0644))
+		assert.NoError(t, os.WriteFile(ignored, nil, 0644))
+
+		tr := NewTailAndRedirect(filepath.Join(tmpDir, "*.log"), dstFile, logger)
+		done := make(chan error)
+		go func() {
+			done <- tr.Start(make(chan bool))
+		}()
+		<-trReady(tr)
+		timeSleep(300)
+
+		appendFile(t, existing, "from a\n")
+		appendFile(t, ignored, "ignored\n")
+		created := filepath.Join(tmpDir, "b.log")
+		appendFile(t, created, "from b\n")
+
+		waitForFileLines(dstFile, []string{"from a", "from b"}, t)
+		tr.Stop()
+		<-done
+
+		b, err := os.ReadFile(dstFile)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(b), "old line")
+		assert.NotContains(t, string(b), "ignored")
+		assert.Len(t, tr.srcFiles, 0)
+	})
+
+	t.Run("readLineAndRedirect_KeepsPartialLinesPerFile", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		dstFile := filepath.Join(tmpDir, "dst.log")
+		dstF, err := os.Create(dstFile)
+		assert.NoError(t, err)
+		defer dstF.Close()
+		tr := &TailAndRedirect{
+			dstFile:   dstF,
+			dstWriter: bufio.NewWriterSize(dstF, 64*1024),
+			logger:    logger,
+		}
+		open := func(name, content string) *tailedFile {
+			path := filepath.Join(tmpDir, name)
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			f, err := os.Open(path)
+			assert.NoError(t, err)
+			t.Cleanup(func() { f.Close() })
+			return &tailedFile{path: path, file: f, reader: bufio.NewReader(f)}
+		}
+		a := open("a.log", "abc")
+		b := open("b.log", "xyz\n")
+
+		tr.readLineAndRedirect(a)
+		tr.readLineAndRedirect(b)
+		assert.Equal(t, int64(0), a.offset.Load(), "a partial line is not past the offset")
+		appendFile(t, a.path, "def\n")
+		tr.readLineAndRedirect(a)
+
+		tr.dstWriter.Flush()
+		out, err := os.ReadFile(dstFile)
+		assert.NoError(t, err)
+		assert.Equal(t, "xyz\nabcdef\n", string(out))
+		assert.Equal(t, int64(7), a.offset.Load())
+		assert.Equal(t, int64(4), b.offset.Load())
+	})
+
+	t.Run("rescanSrc_PicksUpNewDirectories", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		tr := NewTailAndRedirect(filepath.Join(tmpDir, "*", "app.log"), filepath.Join(tmpDir, "dst.log"), logger)
+		assert.NoError(t, tr.initFsWatcher())
+		defer tr.Stop()
+		assert.Empty(t, tr.fsWatcher.WatchList())
+
+		podDir := filepath.Join(tmpDir, "pod-1")
+		assert.NoError(t, os.MkdirAll(podDir, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(podDir, "app.log"), []byte("line\n"), 0644))
+
+		tr.rescanSrc()
+		assert.Equal(t, []string{podDir}, tr.fsWatcher.WatchList())
+		tf := tr.trackedFile(filepath.Join(podDir, "app.log"))
+		assert.NotNil(t, tf)
+		assert.Equal(t, int64(0), tf.offset.Load())
+	})
+
+	t.Run("matchesSrc", func(t *testing.T) {
+		tr := NewTailAndRedirect("/var/log/app/*.log", "dst.log", logger)
+		assert.True(t, tr.srcIsGlob)
+		assert.True(t, tr.matchesSrc("/var/log/app/x.log"))
+		assert.False(t, tr.matchesSrc("/var/log/app/x.log.1"))
+
+		tr = NewTailAndRedirect("./app.log", "dst.log", logger)
+		assert.False(t, tr.srcIsGlob)
+		assert.True(t, tr.matchesSrc("app.log"))
+		assert.False(t, tr.matchesSrc("other.log"))
+	})
+}
+
+func TestTailAndRedirectCheckpoint(t *testing.T) {
+	logger := zap.NewNop()
+
+	run := func(tr *TailAndRedirect) func() {
+		done := make(chan error)
+		go func() {
+			done <- tr.Start(make(chan bool))
+		}()
+		<-trReady(tr)
+		timeSleep(300)
+		return func() {
+			tr.Stop()
+			<-done
+		}
+	}
+
+	t.Run("Start_ResumesFromCheckpoint", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srcFile := filepath.Join(tmpDir, "src.log")
+		dstFile := filepath.Join(tmpDir, "dst.log")
+		cpFile := filepath.Join(tmpDir, "checkpoint.json")
+		assert.NoError(t, os.WriteFile(srcFile, []byte("before start\n"), 0644))
+
+		store, err := checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		tr := NewTailAndRedirect(srcFile, dstFile, logger)
+		tr.UseCheckpoint(store, time.Hour)
+		stop := run(tr)
+		appendFile(t, srcFile, "while running\n")
+		waitForFileContains(dstFile, "while running\n", t)
+		stop()
+
+		appendFile(t, srcFile, "while stopped\n")
+
+		store, err = checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		e, ok := store.Get(srcFile)
+		assert.True(t, ok)
+		assert.Equal(t, int64(len("before start\nwhile running\n")), e.Offset)
+
+		tr = NewTailAndRedirect(srcFile, dstFile, logger)
+		tr.UseCheckpoint(store, time.Hour)
+		stop = run(tr)
+		waitForFileContains(dstFile, "while running\nwhile stopped\n", t)
+		stop()
+	})
+
+	t.Run("Start_FallsBackWhenInodeChanged", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srcFile := filepath.Join(tmpDir, "src.log")
+		dstFile := filepath.Join(tmpDir, "dst.log")
+		assert.NoError(t, os.WriteFile(srcFile, []byte("first\nsecond\n"), 0644))
+
+		store, err := checkpoint.Open(filepath.Join(tmpDir, "checkpoint.json"))
+		assert.NoError(t, err)
+		store.Replace(map[string]checkpoint.Entry{srcFile: {Dev: 0, Inode: 0, Offset: 6}})
+
+		tr := NewTailAndRedirect(srcFile, dstFile, logger)
+		tr.UseCheckpoint(store, time.Hour)
+		tr.ReadFromBeginning()
+		stop := run(tr)
+		waitForFileContains(dstFile, "first\nsecond\n", t)
+		stop()
+	})
+}
+
+func TestTailAndRedirectStream(t *testing.T) {
+	logger := zap.NewNop()
+
+	t.Run("Start_StreamsCompleteLines", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srcFile := filepath.Join(tmpDir, "src.log")
+		dstFile := filepath.Join(tmpDir, "dst.log")
+		assert.NoError(t, os.WriteFile(srcFile, nil, 0644))
+
+		lines := make(chan []byte, 10)
+		tr := NewTailAndRedirect(srcFile, dstFile, logger)
+		tr.StreamTo(lines, false)
+		done := make(chan error)
+		go func() {
+			done <- tr.Start(make(chan bool))
+		}()
+		<-trReady(tr)
+		timeSleep(300)
+
+		appendFile(t, srcFile, "first\r\nsec")
+		timeSleep(300)
+		appendFile(t, srcFile, "ond\n")
+
+		for _, want := range []string{"first", "second"} {
+			select {
+			case line := <-lines:
+				assert.Equal(t, want, string(line))
+			case <-time.After(2 * time.Second):
+				t.Fatalf("did not receive line %q", want)
+			}
+		}
+		tr.Stop()
+		<-done
+
+		_, err := os.Stat(dstFile)
+		assert.True(t, os.IsNotExist(err), "no redirect file expected")
+	})
+
+	t.Run("Stop_SavesCheckpoint", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srcFile := filepath.Join(tmpDir, "src.log")
+		cpFile := filepath.Join(tmpDir, "checkpoint.json")
+		assert.NoError(t, os.WriteFile(srcFile, nil, 0644))
+
+		store, err := checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		lines := make(chan []byte, 10)
+		tr := NewTailAndRedirect(srcFile, filepath.Join(tmpDir, "dst.log"), logger)
+		tr.UseCheckpoint(store, time.Hour)
+		tr.StreamTo(lines, false)
+		done := make(chan error)
+		go func() {
+			done <- tr.Start(make(chan bool))
+		}()
+		<-trReady(tr)
+		timeSleep(300)
+
+		appendFile(t, srcFile, "first\nsecond\n")
+		for range 2 {
+			select {
+			case <-lines:
+			case <-time.After(2 * time.Second):
+				t.Fatal("did not receive line")
+			}
+		}
+		tr.Stop()
+		<-done
+
+		store, err = checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		e, ok := store.Get(srcFile)
+		assert.True(t, ok)
+		assert.Equal(t, int64(len("first\nsecond\n")), e.Offset)
+	})
+
+	t.Run("Stop_SavesPublishedCheckpoint", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srcFile := filepath.Join(tmpDir, "src.log")
+		cpFile := filepath.Join(tmpDir, "checkpoint.json")
+		assert.NoError(t, os.WriteFile(srcFile, nil, 0644))
+
+		store, err := checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		lines := make(chan []byte, 10)
+		tr := NewTailAndRedirect(srcFile, filepath.Join(tmpDir, "dst.log"), logger)
+		tr.UseCheckpoint(store, time.Hour)
+		tr.StreamTo(lines, false)
+		tr.CheckpointPublished()
+		done := make(chan error)
+		go func() {
+			done <- tr.Start(make(chan bool))
+		}()
+		<-trReady(tr)
+		timeSleep(300)
+
+		receive := func(want string) {
+			select {
+			case line := <-lines:
+				assert.Equal(t, want, string(line))
+			case <-time.After(2 * time.Second):
+				t.Fatalf("did not receive line %q", want)
+			}
+		}
+		appendFile(t, srcFile, "first\n")
+		receive("first")
+		commit := tr.Mark()
+		appendFile(t, srcFile, "second\n")
+		receive("second")
+		// Only the window holding the first line is published.
+		commit()
+		tr.Stop()
+		<-done
+
+		store, err = checkpoint.Open(cpFile)
+		assert.NoError(t, err)
+		e, ok := store.Get(srcFile)
+		assert.True(t, ok)
+		assert.Equal(t, int64(len("first\n")), e.Offset)
+	})
+
+	t.Run("streamLine_AlsoRedirects", func(t *testing.T) {
+		lines := make(chan []byte, 1)
+		var buf strings.Builder
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tr := &TailAndRedirect{
+			ctx:       ctx,
+			stream:    lines,
+			dstWriter: bufio.NewWriter(&buf),
+			logger:    logger,
+		}
+		tf := &tailedFile{}
+		assert.True(t, tr.streamLine(tf, []byte("a line\n")))
+		tr.dstWriter.Flush()
+		assert.Equal(t, "a line\n", buf.String())
+		assert.Equal(t, "a line", string(<-lines))
+		assert.Equal(t, int64(7), tf.offset.Load())
+
+		cancel()
+		tr.stream = make(chan []byte)
+		assert.False(t, tr.streamLine(tf, []byte("blocked\n")))
+		assert.Equal(t, int64(7), tf.offset.Load())
+	})
+}
+
+// sliceReader is a Reader emitting a fixed list of lines.
+type sliceReader []string
+
+func (r sliceReader) Run(ctx context.Context, emit func([]byte) error) error {
+	for _, line := range r {
+		if err := emit([]byte(line)); err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+type readerFunc func(ctx context.Context, emit func([]byte) error) error
+
+func (f readerFunc) Run(ctx context.Context, emit func([]byte) error) error {
+	return f(ctx, emit)
+}
+
+func TestTailAndRedirectReader(t *testing.T) {
+	dstFile := filepath.Join(t.TempDir(), "dst.log")
+	lines := make(chan []byte, 10)
+	tr := NewTailAndRedirect("", dstFile, zap.NewNop())
+	tr.ReadFrom(sliceReader{"first", "second"})
+	tr.StreamTo(lines, true)
+	done := make(chan error)
+	go func() {
+		done <- tr.Start(make(chan bool))
+	}()
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case line := <-lines:
+			assert.Equal(t, want, string(line))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive line %q", want)
+		}
+	}
+	waitForFileContains(dstFile, "first\nsecond\n", t)
+
+	tr.Stop()
+	assert.NoError(t, <-done)
+
+	t.Run("Start_ReturnsEndOfInput", func(t *testing.T) {
+		tr := NewTailAndRedirect("", filepath.Join(t.TempDir(), "dst.log"), zap.NewNop())
+		tr.ReadFrom(readerFunc(func(ctx context.Context, emit func([]byte) error) error {
+			return ErrEndOfInput
+		}))
+		assert.ErrorIs(t, tr.Start(make(chan bool)), ErrEndOfInput)
+		tr.Stop()
+	})
+
+	t.Run("Checkpoint_RecordsPosition", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+		assert.NoError(t, err)
+		store.Replace(map[string]checkpoint.Entry{readerCheckpointKey: {Position: "c1"}})
+		r := &positionReader{lines: []string{"c2", "c3"}}
+		tr := NewTailAndRedirect("", filepath.Join(dir, "dst.log"), zap.NewNop())
+		tr.ReadFrom(r)
+		tr.UseCheckpoint(store, time.Hour)
+		assert.ErrorIs(t, tr.Start(make(chan bool)), ErrEndOfInput)
+		assert.Equal(t, "c1", r.resumed)
+		tr.Stop()
+
+		store, err = checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+		assert.NoError(t, err)
+		e, ok := store.Get(readerCheckpointKey)
+		assert.True(t, ok)
+		assert.Equal(t, "c3", e.Position)
+	})
+}
+
+// positionReader emits its lines, each one being its own position, then
+// ends.
+type positionReader struct {
+	lines   []string
+	resumed string
+	pos     atomic.Value
+}
+
+func (r *positionReader) Run(ctx context.Context, emit func([]byte) error) error {
+	for _, line := range r.lines {
+		if err := emit([]byte(line)); err != nil {
+			return err
+		}
+		r.pos.Store(line)
+	}
+	return ErrEndOfInput
+}
+
+func (r *positionReader) Position() string {
+	pos, _ := r.pos.Load().(string)
+	return pos
+}
+
+func (r *positionReader) Resume(position string) {
+	r.resumed = position
+	r.pos.Store(position)
+}
+
+func appendFile(t *testing.T, path, content string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(content)
+	assert.NoError(t, err)
+	f.Close()
+}
+
+// waitForFileLines waits until the file contains every expected line, in any order.
+func waitForFileLines(filename string, expected []string, t *testing.T) {
+	for i := 0; i < 20; i++ {
+		b, _ := os.ReadFile(filename)
+		found := 0
+		for _, line := range expected {
+			if strings.Contains(string(b), line+"\n") {
+				found++
+			}
+		}
+		if found == len(expected) {
+			return
+		}
+		timeSleep(100)
+	}
+	t.Fatalf("file %s did not contain expected lines after waiting", filename)
+}
+
 // errWriter implements io.Writer but always returns an error
 type errWriter struct{}
 
@@ -308,10 +760,14 @@ func trReady(tr *TailAndRedirect) <-chan struct{} {
 	ch := make(chan struct{})
 	go func() {
 		for {
-			if tr.fsWatcher != nil {
+			tr.mu.RLock()
+			ready := tr.fsWatcher != nil
+			tr.mu.RUnlock()
+			if ready {
 				close(ch)
 				return
 			}
+			time.Sleep(time.Millisecond)
 		}
 	}()
 	return ch
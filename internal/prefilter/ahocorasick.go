@@ -0,0 +1,98 @@
+package prefilter
+
+// automaton is an Aho-Corasick automaton searching for a set of patterns
+// regardless of ASCII case. Its transitions form a complete table over
+// byte classes: bytes that occur in no pattern share class 0.
+type automaton struct {
+	classes  [256]byte
+	nclasses int
+	delta    []int32
+	// out holds the patterns ending at each state, including those
+	// reached through failure links.
+	out [][]int32
+}
+
+func newAutomaton(patterns []string) *automaton {
+	a := &automaton{nclasses: 1}
+	for _, p := range patterns {
+		for i := 0; i < len(p); i++ {
+			b := lower(p[i])
+			if a.classes[b] == 0 {
+				a.classes[b] = byte(a.nclasses)
+				a.nclasses++
+			}
+		}
+	}
+	for b := 'A'; b <= 'Z'; b++ {
+		a.classes[b] = a.classes[b+'a'-'A']
+	}
+
+	// Build the trie, with -1 for missing transitions.
+	a.addState()
+	for i, p := range patterns {
+		s := int32(0)
+		for j := 0; j < len(p); j++ {
+			t := int(s)*a.nclasses + int(a.classes[p[j]])
+			if a.delta[t] < 0 {
+				// addState grows delta, so it is indexed again.
+				next := a.addState()
+				a.delta[t] = next
+			}
+			s = a.delta[t]
+		}
+		a.out[s] = append(a.out[s], int32(i))
+	}
+
+	// Replace missing transitions by those of the failure state, in
+	// breadth first order so that shallower states are complete first.
+	fail := make([]int32, len(a.out))
+	queue := []int32{0}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for c := 0; c < a.nclasses; c++ {
+			t := &a.delta[int(s)*a.nclasses+c]
+			if *t < 0 {
+				if s == 0 {
+					*t = 0
+				} else {
+					*t = a.delta[int(fail[s])*a.nclasses+c]
+				}
+				continue
+			}
+			if s != 0 {
+				fail[*t] = a.delta[int(fail[s])*a.nclasses+c]
+			}
+			a.out[*t] = append(a.out[*t], a.out[fail[*t]]...)
+			queue = append(queue, *t)
+		}
+	}
+	return a
+}
+
+func (a *automaton) addState() int32 {
+	for i := 0; i < a.nclasses; i++ {
+		a.delta = append(a.delta, -1)
+	}
+	a.out = append(a.out, nil)
+	return int32(len(a.out) - 1)
+}
+
+// scan calls fn with the end offset and index of every pattern occurring
+// in text.
+func (a *automaton) scan(text []byte, fn func(end, pattern int)) {
+	s := int32(0)
+	for i, b := range text {
+		s = a.delta[int(s)*a.nclasses+int(a.classes[b])]
+		for _, p := range a.out[s] {
+			fn(i+1, int(p))
+		}
+	}
+}
+
+func lower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
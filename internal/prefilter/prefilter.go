@@ -0,0 +1,235 @@
+// Package prefilter screens lines for many regular expressions at once.
+// Literals that every match of an expression must contain are searched for
+// in a single pass with an Aho-Corasick automaton, so that only the
+// expressions whose literals occur in a line need to run on it.
+package prefilter
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// maxAlternatives bounds the number of literals kept for one expression.
+// An alternation of more literals is not worth screening for.
+const maxAlternatives = 32
+
+// literal is a string that must occur in a match. A fold literal matches
+// regardless of ASCII case.
+type literal struct {
+	text string
+	fold bool
+}
+
+// Filter reports which of a set of regular expressions may match a line.
+// It is safe for concurrent use.
+type Filter struct {
+	n          int
+	unfiltered []int
+	literals   []literal
+	// targets holds the indexes of the expressions requiring each literal.
+	targets [][]int
+	ac      *automaton
+}
+
+// New builds a filter for res. Expressions are identified by their index
+// in res, and a nil expression is a candidate for every line.
+func New(res []*regexp.Regexp) *Filter {
+	f := &Filter{n: len(res)}
+	index := make(map[literal]int)
+	for i, re := range res {
+		lits := literals(re)
+		if lits == nil {
+			f.unfiltered = append(f.unfiltered, i)
+			continue
+		}
+		for _, lit := range lits {
+			p, ok := index[lit]
+			if !ok {
+				p = len(f.literals)
+				index[lit] = p
+				f.literals = append(f.literals, lit)
+				f.targets = append(f.targets, nil)
+			}
+			f.targets[p] = append(f.targets[p], i)
+		}
+	}
+	patterns := make([]string, len(f.literals))
+	for i, lit := range f.literals {
+		patterns[i] = lit.text
+	}
+	f.ac = newAutomaton(patterns)
+	return f
+}
+
+// Len returns the number of expressions of the filter.
+func (f *Filter) Len() int {
+	return f.n
+}
+
+// Unfiltered returns the indexes of the expressions without a required
+// literal, which are candidates for every line.
+func (f *Filter) Unfiltered() []int {
+	return f.unfiltered
+}
+
+// Candidates sets candidates[i] for every expression i that may match line
+// and clears the others. candidates must have Len elements.
+func (f *Filter) Candidates(line []byte, candidates []bool) {
+	clear(candidates)
+	for _, i := range f.unfiltered {
+		candidates[i] = true
+	}
+	f.ac.scan(line, func(end, p int) {
+		lit := f.literals[p]
+		// The automaton ignores case, so case sensitive literals are
+		// checked again.
+		if !lit.fold && string(line[end-len(lit.text):end]) != lit.text {
+			return
+		}
+		for _, i := range f.targets[p] {
+			candidates[i] = true
+		}
+	})
+}
+
+// literals returns literals of which every match of re contains at least
+// one, or nil if there is no such set.
+func literals(re *regexp.Regexp) []literal {
+	if re == nil {
+		return nil
+	}
+	// regexp.Compile parses with the Perl flags.
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return required(parsed.Simplify())
+}
+
+// required returns the literals of which every match of re contains one.
+func required(re *syntax.Regexp) []literal {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalOf(re.Rune, re.Flags&syntax.FoldCase != 0)
+	case syntax.OpCapture, syntax.OpPlus:
+		return required(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return required(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		return requiredConcat(re.Sub)
+	case syntax.OpAlternate:
+		var alts []literal
+		for _, sub := range re.Sub {
+			lits := required(sub)
+			if lits == nil {
+				return nil
+			}
+			alts = append(alts, lits...)
+		}
+		if len(alts) > maxAlternatives {
+			return nil
+		}
+		return alts
+	}
+	return nil
+}
+
+// requiredConcat picks the most selective literals among the parts of a
+// concatenation, joining adjacent literal parts.
+func requiredConcat(subs []*syntax.Regexp) []literal {
+	var best []literal
+	consider := func(lits []literal) {
+		if better(lits, best) {
+			best = lits
+		}
+	}
+
+	var run []rune
+	var runFold bool
+	flush := func() {
+		if len(run) > 0 {
+			consider(literalOf(run, runFold))
+			run = nil
+		}
+	}
+	for _, sub := range subs {
+		if sub.Op != syntax.OpLiteral {
+			flush()
+			consider(required(sub))
+			continue
+		}
+		fold := sub.Flags&syntax.FoldCase != 0
+		if fold != runFold {
+			flush()
+		}
+		run = append(run, sub.Rune...)
+		runFold = fold
+	}
+	flush()
+	return best
+}
+
+// better reports whether a screens out more lines than b, judging by the
+// length of their shortest literal and then by their number.
+func better(a, b []literal) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	if la, lb := shortest(a), shortest(b); la != lb {
+		return la > lb
+	}
+	return len(a) < len(b)
+}
+
+func shortest(lits []literal) int {
+	n := len(lits[0].text)
+	for _, lit := range lits[1:] {
+		n = min(n, len(lit.text))
+	}
+	return n
+}
+
+// literalOf returns the literal made of runes. As the automaton only folds
+// ASCII case, a case folded literal is cut down to its longest part whose
+// runes fold to ASCII only: (?i)k also matches the Kelvin sign.
+func literalOf(runes []rune, fold bool) []literal {
+	if fold {
+		var best []rune
+		start := 0
+		for i := 0; i <= len(runes); i++ {
+			if i < len(runes) && foldsToASCII(runes[i]) {
+				continue
+			}
+			if i-start > len(best) {
+				best = runes[start:i]
+			}
+			start = i + 1
+		}
+		runes = best
+	}
+	if len(runes) == 0 {
+		return nil
+	}
+	text := string(runes)
+	if fold {
+		text = strings.ToLower(text)
+	}
+	return []literal{{text: text, fold: fold}}
+}
+
+// foldsToASCII reports whether every rune r folds to is ASCII.
+func foldsToASCII(r rune) bool {
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package prefilter
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiterals(t *testing.T) {
+	for _, tt := range []struct {
+		regex string
+		want  []literal
+	}{
+		{"ERROR", []literal{{"ERROR", false}}},
+		{`status=(?P<status>5\d\d) path=/api`, []literal{{" path=/api", false}}},
+		{`took=(?P<took>\d+)ms`, []literal{{"took=", false}}},
+		{"(?i)timeout", []literal{{"timeout", true}}},
+		{"(?i)error code=(?P<code>\\d+)", []literal{{"error code=", true}}},
+		{"(?:GET|POST) /api", []literal{{" /api", false}}},
+		{"level=(?:ERROR|FATAL)", []literal{{"level=", false}}},
+		{"ERROR|FATAL", []literal{{"ERROR", false}, {"FATAL", false}}},
+		{"(?:db|cache)+ down", []literal{{" down", false}}},
+		{`\d+`, nil},
+		{".*", nil},
+		{"ERROR|.*", nil},
+		{"(?:ERROR)?", nil},
+		{"(?i)kill", []literal{{"ill", true}}},
+		{"(?i)disk full", []literal{{" full", true}}},
+		{"(?i)café", []literal{{"caf", true}}},
+		{"(?i)ks", nil},
+	} {
+		t.Run(tt.regex, func(t *testing.T) {
+			assert.Equal(t, tt.want, literals(regexp.MustCompile(tt.regex)))
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	exprs := []string{
+		"ERROR",
+		"(?i)timeout",
+		`status=5\d\d`,
+		"level=(?:WARN|ERROR)",
+		`\d+`,
+		"she|hers",
+		"ERROR.*db",
+		"(?i)disk full",
+	}
+	lines := []string{
+		"ERROR db timeout",
+		"error: Connection TIMEOUT",
+		"status=503 path=/api",
+		"status=200 path=/api",
+		"level=WARN disk",
+		"ushers took 15ms",
+		"nothing to see",
+		"DISK FULL",
+		"dis\u212A Full",
+		"",
+	}
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		res[i] = regexp.MustCompile(expr)
+	}
+	f := New(res)
+	assert.Equal(t, len(exprs), f.Len())
+	assert.Equal(t, []int{4}, f.Unfiltered())
+
+	candidates := make([]bool, f.Len())
+	for _, line := range lines {
+		f.Candidates([]byte(line), candidates)
+		for i, re := range res {
+			if re.MatchString(line) {
+				assert.True(t, candidates[i], "%q should be a candidate for %q", exprs[i], line)
+			}
+		}
+	}
+
+	f.Candidates([]byte("nothing to see"), candidates)
+	assert.Equal(t, []bool{false, false, false, false, true, false, false, false}, candidates)
+	f.Candidates([]byte("ushers error"), candidates)
+	assert.Equal(t, []bool{false, false, false, false, true, true, false, false}, candidates, "case sensitive literals must match exactly")
+}
+
+func TestAutomaton(t *testing.T) {
+	a := newAutomaton([]string{"he", "she", "his", "hers"})
+	var found []string
+	a.scan([]byte("USHERS"), func(end, p int) {
+		found = append(found, []string{"he", "she", "his", "hers"}[p]+"@"+string(rune('0'+end)))
+	})
+	assert.ElementsMatch(t, []string{"she@4", "he@4", "hers@6"}, found)
+}
@@ -0,0 +1,253 @@
+// Package syslog receives syslog messages over UDP, TCP and unix sockets
+// and parses RFC 5424 and RFC 3164 messages.
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a parsed syslog message. Header fields that are absent or
+// NILVALUE are empty.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData maps SD-IDs to their parameters, RFC 5424 only.
+	StructuredData map[string]map[string]string
+	Body           []byte
+}
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// defaultPriority is user.notice, assumed by RFC 3164 for messages without
+// a priority.
+const defaultPriority = 13
+
+// Parse parses an RFC 5424 message, recognised by its version 1 after the
+// priority, or else an RFC 3164 message. RFC 3164 parsing is lenient, as
+// devices rarely follow it: the timestamp, hostname and tag are each
+// optional.
+func Parse(frame []byte) (*Message, error) {
+	pri, rest, err := parsePriority(frame)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Facility: pri / 8, Severity: pri % 8}
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		if err := m.parse5424(rest[2:]); err != nil {
+			return nil, fmt.Errorf("RFC 5424: %w", err)
+		}
+		return m, nil
+	}
+	m.parse3164(rest)
+	return m, nil
+}
+
+func parsePriority(frame []byte) (int, []byte, error) {
+	if len(frame) == 0 || frame[0] != '<' {
+		return defaultPriority, frame, nil
+	}
+	end := bytes.IndexByte(frame, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, fmt.Errorf("invalid priority")
+	}
+	pri, err := strconv.Atoi(string(frame[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, nil, fmt.Errorf("invalid priority %q", frame[1:end])
+	}
+	return pri, frame[end+1:], nil
+}
+
+func (m *Message) parse5424(rest []byte) error {
+	var header [5]string
+	for i := range header {
+		field, after, ok := bytes.Cut(rest, []byte(" "))
+		if !ok && i < len(header)-1 {
+			return fmt.Errorf("truncated header")
+		}
+		if string(field) != "-" {
+			header[i] = string(field)
+		}
+		rest = after
+	}
+	if header[0] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, header[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", header[0])
+		}
+		m.Timestamp = ts
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = header[1], header[2], header[3], header[4]
+
+	rest, err := m.parseStructuredData(rest)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return fmt.Errorf("expected a space after structured data")
+		}
+		rest = bytes.TrimPrefix(rest[1:], []byte("\xef\xbb\xbf"))
+	}
+	m.Body = rest
+	return nil
+}
+
+// parseStructuredData parses the SD-ELEMENTs at the start of rest and
+// returns what follows them.
+func (m *Message) parseStructuredData(rest []byte) ([]byte, error) {
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("missing structured data")
+	}
+	if rest[0] == '-' {
+		return rest[1:], nil
+	}
+	m.StructuredData = make(map[string]map[string]string)
+	for len(rest) > 0 && rest[0] == '[' {
+		end := bytes.IndexAny(rest, " ]")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated structured data")
+		}
+		id := string(rest[1:end])
+		params := make(map[string]string)
+		m.StructuredData[id] = params
+		rest = rest[end:]
+		for len(rest) > 0 && rest[0] == ' ' {
+			eq := bytes.IndexByte(rest, '=')
+			if eq < 0 || eq+1 >= len(rest) || rest[eq+1] != '"' {
+				return nil, fmt.Errorf("invalid parameter in [%s]", id)
+			}
+			name := string(rest[1:eq])
+			value, n, err := parseParamValue(rest[eq+2:])
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s of [%s]: %w", name, id, err)
+			}
+			params[name] = value
+			rest = rest[eq+2+n:]
+		}
+		if len(rest) == 0 || rest[0] != ']' {
+			return nil, fmt.Errorf("unterminated structured data [%s]", id)
+		}
+		rest = rest[1:]
+	}
+	return rest, nil
+}
+
+// parseParamValue unescapes a parameter value up to its closing quote and
+// returns it with the number of bytes consumed, quote included.
+func parseParamValue(b []byte) (string, int, error) {
+	var value strings.Builder
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			if i+1 < len(b) && (b[i+1] == '"' || b[i+1] == '\\' || b[i+1] == ']') {
+				i++
+			}
+		case '"':
+			return value.String(), i + 1, nil
+		}
+		value.WriteByte(b[i])
+	}
+	return "", 0, fmt.Errorf("unterminated value")
+}
+
+func (m *Message) parse3164(rest []byte) {
+	timestamped := false
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, string(rest[:len(time.Stamp)]), time.Local); err == nil {
+			m.Timestamp = ts.AddDate(time.Now().Year(), 0, 0)
+			rest, timestamped = rest[len(time.Stamp)+1:], true
+		}
+	}
+	if !timestamped {
+		// Some devices send RFC 3339 timestamps in RFC 3164 messages.
+		if field, after, ok := bytes.Cut(rest, []byte(" ")); ok {
+			if ts, err := time.Parse(time.RFC3339Nano, string(field)); err == nil {
+				m.Timestamp = ts
+				rest, timestamped = after, true
+			}
+		}
+	}
+	if timestamped {
+		if field, after, ok := bytes.Cut(rest, []byte(" ")); ok && !bytes.ContainsAny(field, ":[") {
+			m.Hostname = string(field)
+			rest = after
+		}
+	}
+
+	// The tag is the program name, optionally followed by [pid], up to
+	// the colon ending it.
+	if i := bytes.IndexAny(rest, ":[ "); i > 0 && rest[i] != ' ' {
+		tag, after := rest[:i], rest[i:]
+		var pid []byte
+		if after[0] == '[' {
+			end := bytes.IndexByte(after, ']')
+			if end < 0 {
+				m.Body = rest
+				return
+			}
+			pid, after = after[1:end], after[end+1:]
+		}
+		if len(after) > 0 && after[0] == ':' {
+			m.AppName, m.ProcID = string(tag), string(pid)
+			rest = bytes.TrimPrefix(after[1:], []byte(" "))
+		}
+	}
+	m.Body = rest
+}
+
+// Lookup returns the header fields facility and severity, by name, their
+// numeric facility_code and severity_code, hostname, app_name, proc_id,
+// msg_id and message, and structured data parameters as SD-ID.name, such
+// as origin.ip or exampleSDID@32473.iut.
+func (m *Message) Lookup(path string) (any, bool) {
+	switch path {
+	case "facility":
+		return facilities[m.Facility], true
+	case "severity":
+		return severities[m.Severity], true
+	case "facility_code":
+		return float64(m.Facility), true
+	case "severity_code":
+		return float64(m.Severity), true
+	case "message":
+		return string(m.Body), true
+	case "hostname":
+		return present(m.Hostname)
+	case "app_name":
+		return present(m.AppName)
+	case "proc_id":
+		return present(m.ProcID)
+	case "msg_id":
+		return present(m.MsgID)
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i] != '.' {
+			continue
+		}
+		if params, ok := m.StructuredData[path[:i]]; ok {
+			if v, ok := params[path[i+1:]]; ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func present(s string) (any, bool) {
+	return s, s != ""
+}
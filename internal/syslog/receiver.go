@@ -0,0 +1,260 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"go.uber.org/zap"
+)
+
+// Receiver listens for syslog messages and hands each one to the pipeline
+// of its source as a line.
+type Receiver struct {
+	cfg     config.Syslog
+	maxSize int
+	logger  *zap.Logger
+
+	// emitMu serialises messages received on different sockets.
+	emitMu sync.Mutex
+	emit   func([]byte) error
+
+	mu sync.Mutex
+	// closers holds the listeners and open connections to close when the
+	// receiver stops.
+	closers   map[io.Closer]struct{}
+	unixPaths []string
+	wg        sync.WaitGroup
+}
+
+func NewReceiver(cfg config.Syslog, logger *zap.Logger) *Receiver {
+	return &Receiver{cfg: cfg, maxSize: cfg.MaxSize(), logger: logger, closers: make(map[io.Closer]struct{})}
+}
+
+// Run listens on every configured socket and calls emit with every message
+// received until ctx is cancelled. Newlines within a message are escaped as
+// #012, as rsyslog does, so that each message stays on one line.
+func (r *Receiver) Run(ctx context.Context, emit func([]byte) error) error {
+	r.mu.Lock()
+	r.emit = emit
+	r.mu.Unlock()
+	defer r.close()
+	if err := r.listen(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (r *Receiver) listen() error {
+	if r.cfg.UDP != "" {
+		conn, err := net.ListenPacket("udp", r.cfg.UDP)
+		if err != nil {
+			return fmt.Errorf("failed to listen for syslog %w", err)
+		}
+		r.servePackets(conn)
+	}
+	if r.cfg.Unixgram != "" {
+		r.removeSocket(r.cfg.Unixgram)
+		conn, err := net.ListenPacket("unixgram", r.cfg.Unixgram)
+		if err != nil {
+			return fmt.Errorf("failed to listen for syslog %w", err)
+		}
+		r.unixPaths = append(r.unixPaths, r.cfg.Unixgram)
+		r.servePackets(conn)
+	}
+	if r.cfg.TCP != "" {
+		l, err := net.Listen("tcp", r.cfg.TCP)
+		if err != nil {
+			return fmt.Errorf("failed to listen for syslog %w", err)
+		}
+		r.serveStreams(l)
+	}
+	if r.cfg.Unix != "" {
+		r.removeSocket(r.cfg.Unix)
+		l, err := net.Listen("unix", r.cfg.Unix)
+		if err != nil {
+			return fmt.Errorf("failed to listen for syslog %w", err)
+		}
+		r.unixPaths = append(r.unixPaths, r.cfg.Unix)
+		r.serveStreams(l)
+	}
+	return nil
+}
+
+// removeSocket removes a socket file left behind by a previous run.
+func (r *Receiver) removeSocket(path string) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+}
+
+// track registers c to be closed when the receiver stops. It returns false
+// if the receiver is already stopping.
+func (r *Receiver) track(c io.Closer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emit == nil {
+		return false
+	}
+	r.closers[c] = struct{}{}
+	return true
+}
+
+// untrack forgets c once it has been closed.
+func (r *Receiver) untrack(c io.Closer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.closers, c)
+}
+
+func (r *Receiver) close() {
+	r.mu.Lock()
+	closers := r.closers
+	r.closers, r.emit = make(map[io.Closer]struct{}), nil
+	r.mu.Unlock()
+	for c := range closers {
+		c.Close()
+	}
+	r.wg.Wait()
+	for _, path := range r.unixPaths {
+		_ = os.Remove(path)
+	}
+}
+
+// servePackets reads one message per datagram.
+func (r *Receiver) servePackets(conn net.PacketConn) {
+	r.track(conn)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		buf := make([]byte, r.maxSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					r.logger.Warn("syslog receive failed", zap.Error(err))
+				}
+				return
+			}
+			if err := r.deliver(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// serveStreams accepts connections and reads the messages framed on them.
+func (r *Receiver) serveStreams(l net.Listener) {
+	r.track(l)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					r.logger.Warn("syslog accept failed", zap.Error(err))
+				}
+				return
+			}
+			if !r.track(conn) {
+				conn.Close()
+				return
+			}
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				defer r.untrack(conn)
+				defer conn.Close()
+				r.readStream(conn)
+			}()
+		}
+	}()
+}
+
+// readStream reads the messages of a stream connection, framed by octet
+// counting or by newlines as described in RFC 6587.
+func (r *Receiver) readStream(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), r.maxSize+len(strconv.Itoa(r.maxSize))+1)
+	scanner.Split(splitFrame)
+	for scanner.Scan() {
+		if err := r.deliver(scanner.Bytes()); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		r.logger.Warn("syslog connection dropped", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+	}
+}
+
+// splitFrame splits a stream into messages. A frame starting with a
+// number and a space is octet counted, as in "12 <13>1 - - - -", otherwise
+// it ends at a newline or NUL.
+func splitFrame(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	// Skip the newline some senders append to octet counted frames.
+	if data[0] == '\n' || data[0] == 0 {
+		return 1, nil, nil
+	}
+	if data[0] >= '1' && data[0] <= '9' {
+		digits := 1
+		for digits < len(data) && digits < 10 && data[digits] >= '0' && data[digits] <= '9' {
+			digits++
+		}
+		switch {
+		case digits == len(data) && !atEOF:
+			return 0, nil, nil
+		case digits < len(data) && data[digits] == ' ':
+			n, _ := strconv.Atoi(string(data[:digits]))
+			end := digits + 1 + n
+			if len(data) < end {
+				if atEOF {
+					return 0, nil, fmt.Errorf("truncated message")
+				}
+				return 0, nil, nil
+			}
+			return end, data[digits+1 : end], nil
+		}
+	}
+	if i := bytes.IndexAny(data, "\n\x00"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// deliver emits a message, without its trailing newline and with the
+// newlines it contains escaped. It fails once the receiver stops.
+func (r *Receiver) deliver(msg []byte) error {
+	msg = bytes.TrimRight(msg, "\r\n\x00")
+	if len(msg) == 0 {
+		return nil
+	}
+	if bytes.ContainsAny(msg, "\r\n") {
+		msg = bytes.ReplaceAll(msg, []byte("\r"), []byte("#015"))
+		msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("#012"))
+	}
+	r.emitMu.Lock()
+	defer r.emitMu.Unlock()
+	r.mu.Lock()
+	emit := r.emit
+	r.mu.Unlock()
+	if emit == nil {
+		return net.ErrClosed
+	}
+	return emit(msg)
+}
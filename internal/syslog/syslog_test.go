@@ -0,0 +1,219 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akmanon/kpi-metricsd/internal/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("RFC 5424", func(t *testing.T) {
+		m, err := Parse([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appl\"ication"][origin ip="192.0.2.1"] ` + "\xef\xbb\xbf" + `An application event`))
+		assert.NoError(t, err)
+		assert.Equal(t, 20, m.Facility)
+		assert.Equal(t, 5, m.Severity)
+		assert.Equal(t, time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), m.Timestamp.UTC())
+		assert.Equal(t, "mymachine.example.com", m.Hostname)
+		assert.Equal(t, "evntslog", m.AppName)
+		assert.Empty(t, m.ProcID)
+		assert.Equal(t, "ID47", m.MsgID)
+		assert.Equal(t, "An application event", string(m.Body))
+
+		for path, want := range map[string]any{
+			"facility":                      "local4",
+			"severity":                      "notice",
+			"severity_code":                 float64(5),
+			"app_name":                      "evntslog",
+			"message":                       "An application event",
+			"exampleSDID@32473.iut":         "3",
+			"exampleSDID@32473.eventSource": `Appl"ication`,
+			"origin.ip":                     "192.0.2.1",
+		} {
+			v, ok := m.Lookup(path)
+			assert.True(t, ok, path)
+			assert.Equal(t, want, v, path)
+		}
+		for _, path := range []string{"proc_id", "origin.port", "unknown"} {
+			_, ok := m.Lookup(path)
+			assert.False(t, ok, path)
+		}
+	})
+
+	t.Run("RFC 5424 without structured data or message", func(t *testing.T) {
+		m, err := Parse([]byte(`<34>1 - - su - - -`))
+		assert.NoError(t, err)
+		assert.True(t, m.Timestamp.IsZero())
+		assert.Equal(t, "su", m.AppName)
+		assert.Nil(t, m.StructuredData)
+		assert.Empty(t, m.Body)
+	})
+
+	t.Run("RFC 3164", func(t *testing.T) {
+		m, err := Parse([]byte(`<38>Oct 11 22:14:15 host1 sshd[4321]: Failed password for root`))
+		assert.NoError(t, err)
+		assert.Equal(t, 4, m.Facility)
+		assert.Equal(t, 6, m.Severity)
+		assert.Equal(t, time.October, m.Timestamp.Month())
+		assert.Equal(t, time.Now().Year(), m.Timestamp.Year())
+		assert.Equal(t, "host1", m.Hostname)
+		assert.Equal(t, "sshd", m.AppName)
+		assert.Equal(t, "4321", m.ProcID)
+		assert.Equal(t, "Failed password for root", string(m.Body))
+	})
+
+	t.Run("lenient RFC 3164", func(t *testing.T) {
+		m, err := Parse([]byte(`kernel: eth0 link up`))
+		assert.NoError(t, err)
+		assert.Equal(t, defaultPriority, m.Facility*8+m.Severity)
+		assert.Empty(t, m.Hostname)
+		assert.Equal(t, "kernel", m.AppName)
+		assert.Equal(t, "eth0 link up", string(m.Body))
+
+		m, err = Parse([]byte(`<13>2024-05-01T12:00:00Z router: a: b`))
+		assert.NoError(t, err)
+		assert.Equal(t, "router", m.AppName, "a tag directly after the timestamp is not a hostname")
+		assert.Equal(t, "a: b", string(m.Body))
+
+		m, err = Parse([]byte(`<13>no tag here`))
+		assert.NoError(t, err)
+		assert.Empty(t, m.AppName)
+		assert.Equal(t, "no tag here", string(m.Body))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, frame := range []string{
+			`<192>1 - - - - - -`,
+			`<x>message`,
+			`<13>1 2003-10-11 host app - - -`,
+			`<13>1 - host app`,
+			`<13>1 - host app - - [id a="1"`,
+			`<13>1 - host app - - [id a=1] msg`,
+			`<13>1 - host app - - [id]msg`,
+		} {
+			_, err := Parse([]byte(frame))
+			assert.Error(t, err, frame)
+		}
+	})
+}
+
+func TestSplitFrame(t *testing.T) {
+	input := "15 <13>1 - - - - -<13>first\n<13>second\x0011 <13>a\nb c d\n<13>last"
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Split(splitFrame)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"<13>1 - - - - -", "<13>first", "<13>second", "<13>a\nb c d", "<13>last"}, frames)
+
+	scanner = bufio.NewScanner(strings.NewReader("20 <13>short"))
+	scanner.Split(splitFrame)
+	assert.False(t, scanner.Scan())
+	assert.ErrorContains(t, scanner.Err(), "truncated")
+}
+
+func TestReceiver(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Syslog{
+		TCP:      freeTCPAddr(t),
+		Unix:     filepath.Join(dir, "log.sock"),
+		Unixgram: filepath.Join(dir, "dgram.sock"),
+	}
+	r := NewReceiver(cfg, zap.NewNop())
+
+	var mu sync.Mutex
+	var got []string
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, func(line []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, string(line))
+			return nil
+		})
+	}()
+
+	send := func(network, addr, data string) {
+		var conn net.Conn
+		var err error
+		for range 50 {
+			if conn, err = net.Dial(network, addr); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(data))
+		assert.NoError(t, err)
+	}
+	send("tcp", cfg.TCP, "<13>tcp one\n16 <13>tcp two\nline")
+	send("unix", cfg.Unix, "<13>unix\r\n")
+	send("unixgram", cfg.Unixgram, "<13>dgram\n")
+
+	want := []string{"<13>tcp one", "<13>tcp two#012line", "<13>unix", "<13>dgram"}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == len(want)
+	}, 2*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.ElementsMatch(t, want, got)
+	mu.Unlock()
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.NoFileExists(t, cfg.Unix, "socket files are removed on shutdown")
+	assert.NoFileExists(t, cfg.Unixgram)
+}
+
+func TestReceiverClosedConnections(t *testing.T) {
+	cfg := config.Syslog{TCP: freeTCPAddr(t)}
+	r := NewReceiver(cfg, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, func([]byte) error { return nil })
+	}()
+	tracked := func() int {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.closers)
+	}
+	assert.Eventually(t, func() bool { return tracked() == 1 }, 2*time.Second, 10*time.Millisecond, "the listener is tracked")
+
+	for range 100 {
+		conn, err := net.Dial("tcp", cfg.TCP)
+		if !assert.NoError(t, err) {
+			break
+		}
+		_, err = conn.Write([]byte("<13>message\n"))
+		assert.NoError(t, err)
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool { return tracked() == 1 }, 2*time.Second, 10*time.Millisecond,
+		"closed connections are no longer tracked")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func freeTCPAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
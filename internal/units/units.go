@@ -0,0 +1,113 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// factors converts a unit suffix to the base unit of its kind: seconds for
+// durations and bytes for sizes. KB, MB and GB are decimal, KiB, MiB and GiB
+// are binary.
+var factors = map[string]float64{
+	"ns":  1e-9,
+	"us":  1e-6,
+	"µs":  1e-6,
+	"ms":  1e-3,
+	"s":   1,
+	"m":   60,
+	"h":   3600,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// Valid reports whether unit is a known unit. The empty unit means the
+// value is used as is.
+func Valid(unit string) bool {
+	if unit == "" {
+		return true
+	}
+	_, ok := factors[strings.ToLower(unit)]
+	return ok
+}
+
+// Parse converts text such as "123ms", "0.45s", "12 KB" or "42" to a value
+// in the base unit. defaultUnit applies when text has no unit suffix.
+func Parse(text, defaultUnit string) (float64, error) {
+	text = strings.TrimSpace(text)
+	end := numberEnd(text)
+	if end == 0 {
+		return 0, fmt.Errorf("no number in %q", text)
+	}
+	v, err := strconv.ParseFloat(text[:end], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	unit := strings.TrimSpace(text[end:])
+	if unit == "" {
+		unit = defaultUnit
+	}
+	if unit == "" {
+		return v, nil
+	}
+	factor, ok := factors[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	return v * factor, nil
+}
+
+// sizeUnits are the units ParseBytes accepts.
+var sizeUnits = map[string]bool{"b": true, "kb": true, "mb": true, "gb": true, "kib": true, "mib": true, "gib": true}
+
+// ParseBytes converts a size such as "100MB" or "512 KiB" to bytes. A number
+// without a unit is a number of bytes.
+func ParseBytes(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	unit := strings.ToLower(strings.TrimSpace(text[numberEnd(text):]))
+	if unit != "" && !sizeUnits[unit] {
+		return 0, fmt.Errorf("%q is not a size", text)
+	}
+	v, err := Parse(text, "b")
+	if err != nil {
+		return 0, err
+	}
+	return int64(v), nil
+}
+
+// numberEnd returns the length of the decimal number at the start of s.
+func numberEnd(s string) int {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	digits := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		if s[i] != '.' {
+			digits++
+		}
+		i++
+	}
+	if digits == 0 {
+		return 0
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '-' || s[j] == '+') {
+			j++
+		}
+		if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
@@ -0,0 +1,61 @@
+package units
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text        string
+		defaultUnit string
+		want        float64
+	}{
+		{"123ms", "", 0.123},
+		{"0.45s", "", 0.45},
+		{"1500ns", "", 1.5e-6},
+		{"2m", "", 120},
+		{"12 KB", "", 12000},
+		{"1MiB", "", 1 << 20},
+		{"42", "", 42},
+		{"250", "ms", 0.25},
+		{"1.5e3", "us", 1.5e-3},
+		{"3 mb", "", 3e6},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.text, tt.defaultUnit)
+		assert.NoError(t, err, tt.text)
+		assert.InDelta(t, tt.want, got, 1e-12, tt.text)
+	}
+
+	for _, text := range []string{"", "ms", "12 parsecs", "."} {
+		_, err := Parse(text, "")
+		assert.Error(t, err, text)
+	}
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid(""))
+	assert.True(t, Valid("ms"))
+	assert.True(t, Valid("KB"))
+	assert.False(t, Valid("parsec"))
+}
+
+func TestParseBytes(t *testing.T) {
+	for text, want := range map[string]int64{
+		"100":     100,
+		"100MB":   100e6,
+		"512 KiB": 512 << 10,
+		"1.5gb":   1.5e9,
+	} {
+		got, err := ParseBytes(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, want, got, text)
+	}
+
+	for _, text := range []string{"10m", "5s", "MB", "10 parsecs"} {
+		_, err := ParseBytes(text)
+		assert.Error(t, err, text)
+	}
+}
@@ -16,23 +16,38 @@ import (
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+		case "test-kpis":
+			os.Exit(runTestKPIs(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	loggerCfg := zap.NewProductionConfig()
 	loggerCfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	logger, _ := loggerCfg.Build()
 	defer logger.Sync()
 
 	cfgPath := flag.String("config", "config.yaml", "Path to yaml config file")
+	input := flag.String("input", "", `Read the log source from stdin, for "-", or from a named pipe`)
+	flag.Usage = func() {
+		usage(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	cfg, err := config.LoadCfg(*cfgPath)
+	cfg, err := config.LoadCfgWithInput(*cfgPath, *input)
 	if err != nil {
 		logger.Fatal("failed to load config", zap.Error(err))
 	}
 
-	app, err := app.New(cfg, logger)
+	app, err := app.New(cfg, *cfgPath, logger)
 	if err != nil {
 		log.Fatalf("Failed to create application: %v", err)
 	}
+	app.SetInput(*input)
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -48,6 +63,17 @@ func main() {
 		cancel()
 	}()
 
+	// Reload the config on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			logger.Info("Reload signal received")
+			_ = app.Reload()
+		}
+	}()
+
 	// Run application
 	if err := app.Run(ctx); err != nil {
 		logger.Fatal("main application failed", zap.Error(err))